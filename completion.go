@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Shells completion scripts are generated for
+const (
+	CompletionBash = "bash"
+	CompletionZsh  = "zsh"
+	CompletionFish = "fish"
+)
+
+// Subcommands
+const (
+	cmdCompletion  = "completion" // Print the completion script
+	cmdVersion     = "version"    // Print the version of goxver
+	cmdConfig      = "config"     // Work with configuration, only check is supported
+	cmdConfigCheck = "check"      // Validate all sources of mappings
+	cmdInit        = "init"       // Write the configuration file proposed for the project
+)
+
+// Subcommands completed as the first argument
+var Commands = []string{
+	cmdCompletion,
+	cmdVersion,
+	cmdConfig,
+	cmdInit,
+}
+
+// Kinds of values flags take for completion
+const (
+	completeNone  = iota // Flag is boolean and takes no value
+	completeAny          // Any value, nothing to complete
+	completeFile         // File path
+	completeDir          // Directory path
+	completeWords        // One of the words listed
+)
+
+// completionFlag describes the command line flag for completion scripts.
+type completionFlag struct {
+	Name  string
+	Usage string
+	Kind  int
+	Words []string
+}
+
+// completionFiles are flags taking file paths and completionDirs are flags taking directory paths.
+var (
+	completionFiles = []string{"c", "o", "emit-go", "targets", "manifest"}
+	completionDirs  = []string{"d", "repo"}
+)
+
+// completionGens returns all generator names with parametrized generators given
+// as the prefix as well, e.g. hash and hash:.
+func completionGens() []string {
+	gens := make([]string, 0, len(ValidGens)+len(ParamGens))
+	gens = append(gens, ValidGens...)
+	for _, gen := range ParamGens {
+		gens = append(gens, gen+genParamSeparator)
+	}
+	return gens
+}
+
+// completionWords returns values the flag with the name given takes if they are known.
+func completionWords(name string) []string {
+	switch name {
+	case "format":
+		return ValidFormats
+	case "print":
+		return completionGens()
+	case "bazel-style":
+		return []string{BazelStyleJSON, BazelStyleBzl}
+	case "sep":
+		return []string{SepSpace, SepNewline, SepNull}
+	case "log-format":
+		return []string{LogFormatText, LogFormatJSON}
+	case "shell":
+		return []string{ShellPosix, ShellPowerShell, ShellCmd}
+	case "quote":
+		return ValidQuotes
+	}
+	return nil
+}
+
+// completionFlags describes all flags registered sorted by name.
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		cf := completionFlag{Name: f.Name, Usage: f.Usage, Kind: completeAny}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			cf.Kind = completeNone
+		} else if words := completionWords(f.Name); len(words) > 0 {
+			cf.Kind, cf.Words = completeWords, words
+		} else if containsString(completionFiles, f.Name) {
+			cf.Kind = completeFile
+		} else if containsString(completionDirs, f.Name) {
+			cf.Kind = completeDir
+		}
+		flags = append(flags, cf)
+	})
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Name < flags[j].Name
+	})
+	return flags
+}
+
+// containsString tests if the list contains the string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// printCompletion prints the completion script for the shell given as the only argument.
+func printCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: goxver %s %s|%s|%s", cmdCompletion, CompletionBash, CompletionZsh, CompletionFish)
+	}
+
+	flags := completionFlags()
+	switch args[0] {
+	case CompletionBash:
+		fmt.Print(formatBashCompletion(flags))
+	case CompletionZsh:
+		fmt.Print(formatZshCompletion(flags))
+	case CompletionFish:
+		fmt.Print(formatFishCompletion(flags))
+	default:
+		return fmt.Errorf("unsupported shell %s", args[0])
+	}
+	return nil
+}
+
+// formatBashCompletion makes the bash completion script.
+func formatBashCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	sb.WriteString("# bash completion for goxver\n")
+	sb.WriteString("_goxver() {\n")
+	sb.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	sb.WriteString("\tcase \"$prev\" in\n")
+	for _, f := range flags {
+		switch f.Kind {
+		case completeFile:
+			fmt.Fprintf(&sb, "\t-%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", f.Name)
+		case completeDir:
+			fmt.Fprintf(&sb, "\t-%s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", f.Name)
+		case completeWords:
+			fmt.Fprintf(&sb, "\t-%s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;\n", f.Name, quoteShell(strings.Join(f.Words, " ")))
+		case completeAny:
+			fmt.Fprintf(&sb, "\t-%s) return ;;\n", f.Name)
+		}
+	}
+	sb.WriteString("\tesac\n")
+
+	names := make([]string, 0, len(flags))
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+	}
+	sb.WriteString("\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(&sb, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", quoteShell(strings.Join(names, " ")))
+	sb.WriteString("\telif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	fmt.Fprintf(&sb, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", quoteShell(strings.Join(Commands, " ")))
+	sb.WriteString("\telif [[ \"$prev\" == " + cmdCompletion + " ]]; then\n")
+	fmt.Fprintf(&sb, "\t\tCOMPREPLY=($(compgen -W '%s %s %s' -- \"$cur\"))\n", CompletionBash, CompletionZsh, CompletionFish)
+	sb.WriteString("\tfi\n")
+	sb.WriteString("}\n")
+	sb.WriteString("complete -F _goxver goxver\n")
+	return sb.String()
+}
+
+// formatZshCompletion makes the zsh completion script.
+func formatZshCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	sb.WriteString("#compdef goxver\n\n")
+	sb.WriteString("_arguments \\\n")
+	for _, f := range flags {
+		spec := "-" + f.Name + "[" + escapeZshSpec(f.Usage) + "]"
+		switch f.Kind {
+		case completeAny:
+			spec += ":" + f.Name + ": "
+		case completeFile:
+			spec += ":" + f.Name + ":_files"
+		case completeDir:
+			spec += ":" + f.Name + ":_files -/"
+		case completeWords:
+			spec += ":" + f.Name + ":(" + strings.Join(f.Words, " ") + ")"
+		}
+		sb.WriteString("\t" + quoteShell(spec) + " \\\n")
+	}
+	fmt.Fprintf(&sb, "\t'1::command:(%s)' \\\n", strings.Join(Commands, " "))
+	fmt.Fprintf(&sb, "\t'2::shell:(%s %s %s)'\n", CompletionBash, CompletionZsh, CompletionFish)
+	return sb.String()
+}
+
+// escapeZshSpec escapes characters which have special meaning in the description of
+// the _arguments specification.
+func escapeZshSpec(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// formatFishCompletion makes the fish completion script.
+func formatFishCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	sb.WriteString("# fish completion for goxver\n")
+	fmt.Fprintf(&sb, "complete -c goxver -n __fish_use_subcommand -f -a %s\n", quoteShell(strings.Join(Commands, " ")))
+	fmt.Fprintf(&sb, "complete -c goxver -n '__fish_seen_subcommand_from %s' -f -a '%s %s %s'\n",
+		cmdCompletion, CompletionBash, CompletionZsh, CompletionFish)
+	for _, f := range flags {
+		line := "complete -c goxver -o " + f.Name + " -d " + quoteShell(f.Usage)
+		switch f.Kind {
+		case completeAny:
+			line += " -x"
+		case completeFile:
+			line += " -r -F"
+		case completeDir:
+			line += " -x -a '(__fish_complete_directories)'"
+		case completeWords:
+			line += " -x -a " + quoteShell(strings.Join(f.Words, " "))
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
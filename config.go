@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Constants of configuration files
+const (
+	tomlConfigName     = defaultConfigName + extTOML
+	extTOML            = ".toml"
+	tomlTableStart     = "["
+	rootDirective      = "root"
+	defaultsDirective  = "defaults"
+	tagPrefixDirective = "tag_prefix"
+	tagFilterDirective = "tag_filter"
+	formatDirective    = "format"
+	quoteDirective     = "quote"
+)
+
+// Directives of affixes of -X flag values
+const (
+	valuePrefixDirective = "value_prefix"
+	valueSuffixDirective = "value_suffix"
+	valueGensDirective   = "value_gens"
+)
+
+// Location of the user configuration file
+const (
+	xdgConfigHomeEnv     = "XDG_CONFIG_HOME"
+	xdgConfigHomeDefault = ".config"
+	userConfigDirName    = "goxver"
+	userConfigName       = "config"
+)
+
+// Sources of mappings reported in verbose mode, from the lowest precedence to the highest
+const (
+	SourceBuiltin = "builtin" // DefaultMappings
+	SourceHome    = "home"    // The user configuration
+	SourceProject = "project" // The project configuration
+	SourceEnv     = "env"     // The environment variable $GOXVER_MAP
+	SourceFlag    = "flag"    // The command line flag -m
+)
+
+// mapEnv is the environment variable with mappings in the same syntax as -m.
+const mapEnv = "GOXVER_MAP"
+
+// targetSources maps keys of targetDict to sources they come from.
+var targetSources = make(map[string]string)
+
+// mergeMapping merges mappings from the source into targetDict overriding mappings
+// merged before. Overrides are reported in verbose mode with their sources.
+func mergeMapping(m TargetMap, source string) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		gen := m[name]
+		if prev, ok := targetDict[name]; ok {
+			msgWith(Fields{"target": name, "generator": gen, "source": source},
+				"Mapping %s = %s from %s overrides %s from %s\n", name, gen, source, prev, targetSources[name])
+		}
+		targetDict[name] = gen
+		targetSources[name] = source
+	}
+}
+
+// Config is the content of the configuration file.
+type Config struct {
+	Targets   TargetMap
+	Root      string // The root directory of the project relative to the configuration file
+	Defaults  bool   // Seed mappings with DefaultMappings
+	TagPrefix string // The prefix tags must have, see -tag-prefix
+	TagFilter string // The regular expression tags must match, see -tag-filter
+	Format    string // The output format used unless -format is given
+	Quote     string // The style of quoting -X flags, see -quote
+	// Affixes of -X flag values, see -value-prefix, -value-suffix and -value-gens
+	ValuePrefix string
+	ValueSuffix string
+	ValueGens   []string
+}
+
+// tomlConfig is the schema of TOML configuration file, e.g.
+//
+//	root = "../"
+//	defaults = true
+//	tag_prefix = "backend/"
+//	tag_filter = '^backend/v\d'
+//	format = "yaml"
+//	quote = "double"
+//	value_suffix = "-nightly"
+//	value_gens = ["version", "tag"]
+//
+//	[targets]
+//	Version = "version"
+//	"GitCommit|Revision" = "hash_long"
+//
+// Keys of targets are the same as in mappings.
+type tomlConfig struct {
+	Root        string            `toml:"root"`
+	Defaults    bool              `toml:"defaults"`
+	TagPrefix   string            `toml:"tag_prefix"`
+	TagFilter   string            `toml:"tag_filter"`
+	Format      string            `toml:"format"`
+	Quote       string            `toml:"quote"`
+	ValuePrefix string            `toml:"value_prefix"`
+	ValueSuffix string            `toml:"value_suffix"`
+	ValueGens   []string          `toml:"value_gens"`
+	Targets     map[string]string `toml:"targets"`
+}
+
+// isTOMLConfig tests if the configuration file is TOML by the extension or, if the extension
+// is not known, by the content which has the table header, while line configuration has not.
+func isTOMLConfig(path string, data []byte) bool {
+	if strings.EqualFold(filepath.Ext(path), extTOML) {
+		return true
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), tomlTableStart) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTOMLConfig parses the TOML configuration reporting every problem found.
+// Unknown keys are errors so typos do not pass silently.
+func parseTOMLConfig(path string, data []byte) (*Config, []error) {
+	var conf tomlConfig
+	meta, err := toml.Decode(string(data), &conf)
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", path, err.Error())}
+	}
+
+	var errs []error
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		errs = append(errs, fmt.Errorf("%s: unknown keys %s", path, strings.Join(keys, ", ")))
+	}
+	if _, err := regexp.Compile(conf.TagFilter); err != nil {
+		errs = append(errs, fmt.Errorf("%s: invalid %s %s: %s", path, tagFilterDirective, conf.TagFilter, err.Error()))
+	}
+	if len(conf.Format) > 0 && !isValidFormat(conf.Format) {
+		errs = append(errs, fmt.Errorf("%s: invalid %s %s, valid formats are %s", path, formatDirective, conf.Format, strings.Join(ValidFormats, ", ")))
+	}
+	if len(conf.Quote) > 0 && !containsString(ValidQuotes, conf.Quote) {
+		errs = append(errs, fmt.Errorf("%s: invalid %s %s, valid styles are %s", path, quoteDirective, conf.Quote, strings.Join(ValidQuotes, ", ")))
+	}
+	for _, gen := range conf.ValueGens {
+		if !isValidGen(gen) && !containsString(ParamGens, gen) {
+			errs = append(errs, fmt.Errorf("%s: invalid generator %s in %s", path, gen, valueGensDirective))
+		}
+	}
+
+	names := make([]string, 0, len(conf.Targets))
+	for name := range conf.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := make(TargetMap, len(conf.Targets))
+	for _, name := range names {
+		item, err := parseTargetMapping(name + mapAssignment + conf.Targets[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: targets.%s: %s", path, name, err.Error()))
+			continue
+		}
+		for key, gen := range item {
+			if prev, ok := m[key]; ok && prev != gen {
+				errs = append(errs, fmt.Errorf("%s: targets.%s: conflicting generators %s and %s for %s", path, name, prev, gen, key))
+				continue
+			}
+			m[key] = gen
+		}
+	}
+	return &Config{Targets: m, Root: conf.Root, Defaults: conf.Defaults, TagPrefix: conf.TagPrefix, TagFilter: conf.TagFilter, Format: conf.Format, Quote: conf.Quote,
+		ValuePrefix: conf.ValuePrefix, ValueSuffix: conf.ValueSuffix, ValueGens: conf.ValueGens}, errs
+}
+
+// readConfigData reads the configuration file in the line or TOML format.
+// Besides mappings the line format accepts directives root = path, defaults = true|false,
+// tag_prefix = prefix, tag_filter = regexp, format = name, quote = none|single|double,
+// value_prefix = text, value_suffix = text and value_gens = gen,...
+func readConfigData(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, errs := parseConfigData(path, data)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return conf, nil
+}
+
+// parseConfigData parses the configuration file content reporting every problem found
+// instead of stopping at the first one. Problems are prefixed with the file and the line.
+func parseConfigData(path string, data []byte) (*Config, []error) {
+	if isTOMLConfig(path, data) {
+		return parseTOMLConfig(path, data)
+	}
+
+	var (
+		errs   []error
+		lineNo int
+	)
+	conf := &Config{Targets: make(TargetMap)}
+	_ = iterTextLines(ioutil.NopCloser(bytes.NewReader(data)), func(line []byte) error {
+		lineNo++
+		if err := parseConfigLine(conf, string(line)); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s", path, lineNo, err.Error()))
+		}
+		return nil
+	})
+	return conf, errs
+}
+
+// parseConfigLine parses the directive or the mapping on the line of the configuration file.
+func parseConfigLine(conf *Config, line string) error {
+	if value, ok := parseDirective(line, rootDirective); ok {
+		conf.Root = value
+		return nil
+	}
+	if value, ok := parseDirective(line, defaultsDirective); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %s", defaultsDirective, value)
+		}
+		conf.Defaults = enabled
+		return nil
+	}
+	if value, ok := parseDirective(line, tagPrefixDirective); ok {
+		conf.TagPrefix = value
+		return nil
+	}
+	if value, ok := parseDirective(line, tagFilterDirective); ok {
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("invalid %s %s: %s", tagFilterDirective, value, err.Error())
+		}
+		conf.TagFilter = value
+		return nil
+	}
+	if value, ok := parseDirective(line, formatDirective); ok {
+		if !isValidFormat(value) {
+			return fmt.Errorf("invalid %s %s, valid formats are %s", formatDirective, value, strings.Join(ValidFormats, ", "))
+		}
+		conf.Format = value
+		return nil
+	}
+	if value, ok := parseDirective(line, quoteDirective); ok {
+		if !containsString(ValidQuotes, value) {
+			return fmt.Errorf("invalid %s %s, valid styles are %s", quoteDirective, value, strings.Join(ValidQuotes, ", "))
+		}
+		conf.Quote = value
+		return nil
+	}
+	if value, ok := parseDirective(line, valuePrefixDirective); ok {
+		conf.ValuePrefix = value
+		return nil
+	}
+	if value, ok := parseDirective(line, valueSuffixDirective); ok {
+		conf.ValueSuffix = value
+		return nil
+	}
+	if value, ok := parseDirective(line, valueGensDirective); ok {
+		conf.ValueGens = splitValueGens(value)
+		for _, gen := range conf.ValueGens {
+			if !isValidGen(gen) && !containsString(ParamGens, gen) {
+				return fmt.Errorf("invalid generator %s in %s", gen, valueGensDirective)
+			}
+		}
+		return nil
+	}
+
+	item, err := parseTargetMapping(line)
+	if err != nil {
+		return err
+	}
+	for key, gen := range item {
+		if pkg, _ := splitNameKey(key); len(pkg) > 0 && len(conf.Targets[key]) > 0 && conf.Targets[key] != gen {
+			return fmt.Errorf("conflicting generators %s and %s for %s", conf.Targets[key], gen, key)
+		}
+	}
+	conf.Targets.CopyFrom(item)
+	return nil
+}
+
+// parseDirective returns the value of the directive name = value if the line is the one.
+// Directive names are reserved, so they cannot be mapped unqualified.
+func parseDirective(line, name string) (string, bool) {
+	parts := strings.SplitN(line, mapAssignment, 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) != name {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// mappingSource is mappings with the name of the source they are read from.
+type mappingSource struct {
+	Name    string
+	Targets TargetMap
+}
+
+// checkConfig loads all sources of mappings and reports to STDERR every problem found:
+// invalid lines of configuration files, invalid generators and parameters, and root directories,
+// packages of qualified mappings and commands of exec generators which do not exist.
+// It returns ExitUsage, the code the run fails with on the same problems, if there is any problem
+// and ExitOk with the summary written to w otherwise.
+func checkConfig(w io.Writer) int {
+	var (
+		problems []string
+		sources  []mappingSource
+	)
+	report := func(err error) {
+		problems = append(problems, err.Error())
+	}
+
+	root, err := filepath.Abs(rootDir)
+	if err != nil || !fileExists(root) {
+		report(fmt.Errorf("-d %s: path does not exist", rootDir))
+	}
+
+	if _, err := regexp.Compile(tagFilter); err != nil {
+		report(fmt.Errorf("-tag-filter %s: %s", tagFilter, err.Error()))
+	}
+	if useDefaults {
+		sources = append(sources, mappingSource{Name: SourceBuiltin, Targets: DefaultMappings})
+	}
+	if !noConfig {
+		paths, err := findConfigFiles(root, configPath)
+		if err != nil {
+			report(err)
+		}
+		userPath := userConfigFile()
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				report(err)
+				continue
+			}
+			conf, errs := parseConfigData(path, data)
+			for _, err := range errs {
+				report(err)
+			}
+			if conf == nil {
+				continue
+			}
+			if len(conf.Root) > 0 {
+				if dir, err := resolveConfigRoot(path, conf.Root); err != nil {
+					report(fmt.Errorf("%s: %s", path, err.Error()))
+				} else if path != userPath && !isFlagSet("d") {
+					root = dir
+				}
+			}
+			if conf.Defaults {
+				sources = append(sources, mappingSource{Name: SourceBuiltin, Targets: DefaultMappings})
+			}
+			sources = append(sources, mappingSource{Name: path, Targets: conf.Targets})
+		}
+
+		if envMap := os.Getenv(mapEnv); len(envMap) > 0 {
+			if m, err := parseTargetMapping(envMap); err != nil {
+				report(fmt.Errorf("$%s: %s", mapEnv, err.Error()))
+			} else {
+				sources = append(sources, mappingSource{Name: "$" + mapEnv, Targets: m})
+			}
+		}
+	}
+	for _, configMap := range configMaps {
+		if m, err := parseTargetMapping(configMap); err != nil {
+			report(fmt.Errorf("-m %s: %s", configMap, err.Error()))
+		} else {
+			sources = append(sources, mappingSource{Name: "-m " + configMap, Targets: m})
+		}
+	}
+
+	// Check what mappings refer to against the root directory
+	rootDir = root
+	if len(repoDir) == 0 {
+		repoDir = root
+	} else if dir, err := filepath.Abs(repoDir); err == nil {
+		repoDir = dir
+	}
+	if pkg, err := rootPkg(root); err == nil {
+		rootPackage = pkg
+	}
+	var count int
+	for _, source := range sources {
+		names := make([]string, 0, len(source.Targets))
+		for name := range source.Targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			count++
+			if err := checkMappingRefs(name, source.Targets[name]); err != nil {
+				report(fmt.Errorf("%s: %s: %s", source.Name, name, err.Error()))
+			}
+		}
+	}
+
+	for _, problem := range problems {
+		_, _ = fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%d problems found\n", len(problems))
+		return ExitUsage
+	}
+	fmt.Fprintf(w, "OK: %d mappings from %d sources\n", count, len(sources))
+	return ExitOk
+}
+
+// checkMappingRefs tests if the package of the qualified mapping is found in the project and
+// the command of the exec generator is found in $PATH or the repository directory.
+// Packages outside of the project are not tested.
+func checkMappingRefs(name, spec string) error {
+	if pkg, _ := splitNameKey(name); len(pkg) > 0 && pkg != mainPkgName {
+		importPath := resolveKeyPkg(pkg)
+		if importPath == rootPackage || strings.HasPrefix(importPath, rootPackage+"/") {
+			dir := filepath.Join(rootDir, filepath.FromSlash(strings.TrimPrefix(importPath, rootPackage)))
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("package %s is not found in %s", pkg, rootDir)
+			}
+		}
+	}
+
+	gen, _, _, err := parseTargetSpec(spec)
+	if err != nil {
+		return err
+	}
+	if name, param := splitGen(gen); name == GenExec {
+		args, err := splitLDFlags(param)
+		if err != nil || len(args) == 0 {
+			return fmt.Errorf("invalid command %s", param)
+		}
+		command := args[0]
+		if strings.ContainsRune(command, filepath.Separator) || strings.Contains(command, "/") {
+			if !filepath.IsAbs(command) {
+				command = filepath.Join(repoDir, command)
+			}
+			if !fileExists(command) {
+				return fmt.Errorf("command %s is not found", args[0])
+			}
+		} else if _, err := exec.LookPath(command); err != nil {
+			return fmt.Errorf("command %s is not found", args[0])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindConfigFile(t *testing.T) {
+	base, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, base, map[string]string{
+		"project/.goxver":       "",
+		"empty/main.go":         "package main\n",
+		"cwd/.goxver":           "",
+		"gopath/src/.goxver":    "",
+		"conflict/.goxver":      "",
+		"conflict/.goxver.toml": "",
+		"toml/.goxver.toml":     "",
+		"dir/.goxver/config":    "",
+	})
+	path := func(name string) string {
+		return filepath.Join(base, filepath.FromSlash(name))
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	defer func(gopath string) { _ = os.Setenv(goPathEnv, gopath) }(os.Getenv(goPathEnv))
+
+	// The project directory goes first, then the current directory and $GOPATH/src last
+	tests := []struct {
+		project, cwd, gopath string
+		want                 string
+		wantErr              string
+	}{
+		{project: "project", cwd: "cwd", gopath: "gopath", want: path("project/.goxver")},
+		{project: "empty", cwd: "cwd", gopath: "gopath", want: defaultConfigName},
+		{project: "empty", cwd: "empty", gopath: "gopath", want: path("gopath/src/.goxver")},
+		{project: "empty", cwd: "empty", gopath: "empty"},
+		{project: "toml", cwd: "cwd", gopath: "gopath", want: path("toml/.goxver.toml")},
+		{project: "dir", cwd: "empty", gopath: "empty"},
+		{project: "conflict", cwd: "cwd", gopath: "gopath", wantErr: "conflicting configuration files"},
+		{project: "empty", cwd: "conflict", gopath: "gopath", wantErr: "conflicting configuration files"},
+	}
+	for _, tt := range tests {
+		if err := os.Chdir(path(tt.cwd)); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Setenv(goPathEnv, path(tt.gopath))
+
+		got, err := findConfigFile(path(tt.project))
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s in %s: error %v, want %q", tt.project, tt.cwd, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s in %s: found %q, %v, want %q", tt.project, tt.cwd, got, err, tt.want)
+		}
+	}
+}
+
+func TestFindConfigFiles(t *testing.T) {
+	home, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, home, map[string]string{
+		".goxver":         "",
+		"project/.goxver": "",
+		"other/.goxver":   "",
+	})
+	defer func(home, xdg string) {
+		_ = os.Setenv("HOME", home)
+		_ = os.Setenv(xdgConfigHomeEnv, xdg)
+	}(os.Getenv("HOME"), os.Getenv(xdgConfigHomeEnv))
+	_ = os.Setenv("HOME", home)
+	_ = os.Unsetenv(xdgConfigHomeEnv)
+
+	user, project, other := filepath.Join(home, ".goxver"), filepath.Join(home, "project", ".goxver"), filepath.Join(home, "other", ".goxver")
+	tests := []struct {
+		dir, config string
+		want        []string
+	}{
+		// The user configuration is loaded first, so the project one overrides it
+		{filepath.Dir(project), "", []string{user, project}},
+		{filepath.Dir(project), other, []string{user, other}},
+		// The user configuration given with -c is loaded once
+		{filepath.Dir(project), user, []string{user}},
+		{home, "", []string{user}},
+	}
+	for _, tt := range tests {
+		got, err := findConfigFiles(tt.dir, tt.config)
+		if err != nil || strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("findConfigFiles(%s, %q) = %q, %v, want %q", tt.dir, tt.config, got, err, tt.want)
+		}
+	}
+
+	// XDG configuration goes before ~/.goxver
+	writeFiles(t, home, map[string]string{"xdg/goxver/config": ""})
+	_ = os.Setenv(xdgConfigHomeEnv, filepath.Join(home, "xdg"))
+	if got := userConfigFile(); got != filepath.Join(home, "xdg", "goxver", "config") {
+		t.Errorf("userConfigFile() = %q", got)
+	}
+}
+
+func TestResolveConfigRoot(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{"build/.goxver": "", "main.go": "package main\n"})
+	path := filepath.Join(dir, "build", defaultConfigName)
+
+	tests := []struct {
+		root    string
+		want    string
+		wantErr string
+	}{
+		{"..", dir, ""},
+		{"../", dir, ""},
+		{".", filepath.Join(dir, "build"), ""},
+		{dir, dir, ""},
+		{"../missing", "", "invalid root ../missing"},
+		{"../main.go", "", "not a directory"},
+	}
+	for _, tt := range tests {
+		got, err := resolveConfigRoot(path, tt.root)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("root %s: error %v, want %q", tt.root, err, tt.wantErr)
+			}
+		} else if err != nil || got != tt.want {
+			t.Errorf("root %s: %q, %v, want %q", tt.root, got, err, tt.want)
+		}
+	}
+}
+
+func TestConfigRoot(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		"build/.goxver":  "root = ..\nVersion=version\nRelease=tag\n",
+		"tools/go.mod":   "module example.com/tools\n",
+		"tools/main.go":  "package main\n\nvar Release string\n\nfunc main() {}\n",
+		"broken/.goxver": "root = ../missing\nVersion=version\n",
+	})
+
+	tests := []struct {
+		name string
+		cwd  string
+		args []string
+		want string
+		code int
+	}{
+		{"root of config", "build", nil, "-X main.Release=v1.2.3 -X main.Version=v1.2.3", ExitOk},
+		{"config given", ".", []string{"-c", "build/.goxver"}, "-X main.Release=v1.2.3 -X main.Version=v1.2.3", ExitOk},
+		{"-d overrides root", "build", []string{"-d", "../tools", "-repo", dir}, "-X main.Release=v1.2.3", ExitOk},
+		{"missing root", "broken", nil, "", ExitUsage},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, filepath.Join(dir, tt.cwd), nil, tt.args...)
+		if code != tt.code || stdout != tt.want {
+			t.Errorf("%s: exit code %d, STDOUT %q, want %d, %q, STDERR %s", tt.name, code, stdout, tt.code, tt.want, stderr)
+		}
+	}
+}
+
+func TestParseConfigData(t *testing.T) {
+	want := Config{
+		Targets: TargetMap{
+			"Version":                        "version",
+			"GitCommit":                      "hash_long",
+			"Revision":                       "hash_long",
+			"example.com/app/info.BuildTime": `time(format="2006-01-02, 15:04",utc=true)`,
+			"Release":                        "tag|untagged",
+		},
+		Root:        "../",
+		Defaults:    true,
+		TagPrefix:   "backend/",
+		TagFilter:   `^backend/v\d`,
+		Format:      FormatYAML,
+		Quote:       QuoteDouble,
+		ValuePrefix: "build-",
+		ValueSuffix: "-nightly",
+		ValueGens:   []string{GenVersion, GenTag},
+	}
+
+	// Both formats of the same configuration give the same result
+	for _, name := range []string{"full.toml", "full.goxver"} {
+		conf, err := readConfigData(filepath.Join("testdata", "config", name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			continue
+		}
+		if len(conf.Targets) != len(want.Targets) {
+			t.Errorf("%s: targets %v, want %v", name, conf.Targets, want.Targets)
+		}
+		for key, gen := range want.Targets {
+			if conf.Targets[key] != gen {
+				t.Errorf("%s: target %s = %q, want %q", name, key, conf.Targets[key], gen)
+			}
+		}
+		got, expected := *conf, want
+		got.Targets, expected.Targets = nil, nil
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", expected) {
+			t.Errorf("%s: got\n%#v\nwant\n%#v", name, got, expected)
+		}
+	}
+
+	// The TOML configuration is recognized by the table without the extension
+	conf, err := readConfigData(filepath.Join("testdata", "config", "sniffed"))
+	if err != nil || conf.TagPrefix != "backend/" || conf.Targets["Version"] != GenVersion {
+		t.Errorf("sniffed: %+v, %v", conf, err)
+	}
+
+	// Every problem of the file is reported
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"unknown-key.toml", []string{"unknown keys tag_prefx, target, target.Commit"}},
+		{"invalid-values.toml", []string{
+			"invalid tag_filter (unclosed",
+			"invalid format xml",
+			"invalid quote backtick",
+			"invalid generator unknown in value_gens",
+			"targets.Version: invalid mapping",
+		}},
+		{"syntax.toml", []string{"syntax.toml: "}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join("testdata", "config", tt.name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, errs := parseConfigData(path, data)
+		if len(errs) != len(tt.want) {
+			t.Errorf("%s: errors %v, want %d", tt.name, errs, len(tt.want))
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), tt.want[i]) {
+				t.Errorf("%s: error %q does not contain %q", tt.name, err.Error(), tt.want[i])
+			}
+		}
+	}
+}
+
+func TestTOMLConfig(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "backend/v1.2.3", "v2.0.0")
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		tomlConfigName: "tag_prefix = \"backend/\"\nvalue_suffix = \"-rc\"\nvalue_gens = [\"version\"]\n\n[targets]\nVersion = \"version\"\nCommit = \"hash_long\"\n",
+	})
+
+	stdout, stderr, code := runMain(t, dir, nil)
+	if want := "-X main.Commit=" + hash + " -X main.Version=v1.2.3-rc"; code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+
+	// Both configuration files in the same directory is the error, whatever they contain
+	writeFiles(t, dir, map[string]string{defaultConfigName: "Version=version\n"})
+	_, stderr, code = runMain(t, dir, nil)
+	if code != ExitUsage || !strings.Contains(stderr, "conflicting configuration files") {
+		t.Errorf("conflicting configuration: exit code %d, STDERR %s", code, stderr)
+	}
+}
+
+func TestNoConfig(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":          "module example.com/app\n",
+		"main.go":         "package main\n\nvar (\n\tVersion string\n\tCommit  string\n)\n\nfunc main() {}\n",
+		"info/info.go":    "package info\n\nvar Build string\n",
+		"info/.goxver":    "Build=hash_long\n",
+		defaultConfigName: "root = info\nVersion=tag\n",
+	}, "v1.2.3", "release")
+	defer cleanup()
+	home, cleanupHome := tempDir(t)
+	defer cleanupHome()
+	writeFiles(t, home, map[string]string{".goxver": "Commit=hash_long\n"})
+	env := []string{"HOME=" + home, mapEnv + "=Version=version"}
+
+	// Without -no-config the user and project configurations, nested ones and $GOXVER_MAP are all used,
+	// -d overrides the root of the project configuration
+	stdout, stderr, code := runMain(t, dir, env, "-d", ".")
+	if want := "-X example.com/app/info.Build=" + hash + " -X main.Commit=" + hash + " -X main.Version=v1.2.3"; code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+
+	// With -no-config only -m is used, the root of the configuration is not followed
+	// and even conflicting configuration files are not an error
+	writeFiles(t, dir, map[string]string{tomlConfigName: "[targets]\n"})
+	stdout, stderr, code = runMain(t, dir, env, "-no-config", "-m", "Commit=hash_short")
+	if want := "-X main.Commit=" + hash[:7]; code != ExitOk || stdout != want {
+		t.Errorf("-no-config: exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+	if stdout, _, code := runMain(t, dir, env, "-no-config"); code != ExitOk || len(stdout) > 0 {
+		t.Errorf("-no-config without -m: exit code %d, STDOUT %q", code, stdout)
+	}
+
+	// Configurations cannot be asked for explicitly at the same time
+	for _, args := range [][]string{{"-no-config", "-defaults"}, {"-no-config", "-c", defaultConfigName}} {
+		if _, stderr, code := runMain(t, dir, env, args...); code != ExitUsage || !strings.Contains(stderr, "-no-config cannot be used with -c or -defaults") {
+			t.Errorf("%v: exit code %d, STDERR %s", args, code, stderr)
+		}
+	}
+}
+
+func TestMappingPrecedence(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":          "module example.com/app\n",
+		"main.go":         "package main\n\nvar (\n\tVersion   string\n\tCommit    string\n\tGitCommit string\n\tGitSHA    string\n\tBuildDate string\n)\n\nfunc main() {}\n",
+		defaultConfigName: "GitCommit=hash:5\nGitSHA=hash:5\nBuildDate=hash:5\n",
+	}, "v1.2.3")
+	defer cleanup()
+	home, cleanupHome := tempDir(t)
+	defer cleanupHome()
+	writeFiles(t, home, map[string]string{".goxver": "Commit=hash:4\nGitCommit=hash:4\nGitSHA=hash:4\nBuildDate=hash:4\n"})
+	env := []string{"HOME=" + home, mapEnv + "=GitSHA=hash:6,BuildDate=hash:6"}
+
+	// Each source overrides ones before it: builtin, home, project, env and flag
+	stdout, stderr, code := runMain(t, dir, env, "-defaults", "-m", "BuildDate=commit_count", "-v")
+	want := "-X main.BuildDate=1 -X main.Commit=" + hash[:4] + " -X main.GitCommit=" + hash[:5] + " -X main.GitSHA=" + hash[:6] + " -X main.Version=v1.2.3"
+	if code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+
+	// Verbose mode reports every override with both sources
+	for _, override := range []string{
+		"Mapping Commit = hash:4 from home overrides hash_short from builtin",
+		"Mapping GitCommit = hash:5 from project overrides hash:4 from home",
+		"Mapping GitSHA = hash:6 from env overrides hash:5 from project",
+		"Mapping BuildDate = commit_count from flag overrides hash:6 from env",
+	} {
+		if !strings.Contains(stderr, override) {
+			t.Errorf("%q is not reported in\n%s", override, stderr)
+		}
+	}
+
+	// The environment variable has the syntax of -m
+	env[1] = mapEnv + "=GitSHA"
+	if _, stderr, code := runMain(t, dir, env); code != ExitUsage || !strings.Contains(stderr, "failed to parse $"+mapEnv) {
+		t.Errorf("invalid $%s: exit code %d, STDERR %s", mapEnv, code, stderr)
+	}
+}
+
+func TestMappingEnvExpansion(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	env := []string{"GEN=hash_short", "NAME=Commit", "PFX=rel-", "EMPTY="}
+
+	// Both ${ENV} and $ENV are expanded in names, generators and options of -m and $GOXVER_MAP
+	tests := []struct {
+		env  []string
+		args []string
+		want string
+	}{
+		{nil, []string{"-m", "Version=${GEN}"}, "-X main.Version=" + hash[:7]},
+		{nil, []string{"-m", "$NAME=version"}, "-X main.Commit=v1.2.3"},
+		{nil, []string{"-m", "Version=version(prefix=${PFX})"}, "-X main.Version=rel-v1.2.3"},
+		{nil, []string{"-m", "Version=version(suffix=-dev${EMPTY})"}, "-X main.Version=v1.2.3-dev"},
+		{[]string{mapEnv + "=Version=version(prefix=$PFX)"}, nil, "-X main.Version=rel-v1.2.3"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, append(env, tt.env...), tt.args...)
+		if code != ExitOk || stdout != tt.want || len(stderr) > 0 {
+			t.Errorf("%v %v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.env, tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// Variables which are not set expand to nothing with the warning
+	stdout, stderr, code := runMain(t, dir, env, "-m", "Version=version(suffix=-dev${MISSING})")
+	if code != ExitOk || stdout != "-X main.Version=v1.2.3-dev" || stderr != warnPrefix+"environment variable MISSING is not set\n" {
+		t.Errorf("unset variable: exit code %d, STDOUT %q, STDERR %q", code, stdout, stderr)
+	}
+
+	// Mapping lines of configuration files are expanded too
+	writeFiles(t, dir, map[string]string{defaultConfigName: "$NAME=${GEN}\nVersion=version(prefix=${PFX})\n"})
+	stdout, stderr, code = runMain(t, dir, env)
+	if want := "-X main.Commit=" + hash[:7] + " -X main.Version=rel-v1.2.3"; code != ExitOk || stdout != want {
+		t.Errorf("configuration: exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+}
+
+func TestDefaultMappings(t *testing.T) {
+	// The conventional table is the documented one, changes must be deliberate
+	want := TargetMap{
+		"Version":   GenVersion,
+		"Commit":    GenHashShort,
+		"GitCommit": GenHashLong,
+		"GitSHA":    GenHashLong,
+		"BuildDate": GenTime,
+		"BuildTime": GenTime,
+	}
+	if fmt.Sprint(DefaultMappings) != fmt.Sprint(want) {
+		t.Errorf("DefaultMappings = %v, want %v", DefaultMappings, want)
+	}
+
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nvar (\n\tVersion   string\n\tCommit    string\n\tGitCommit string\n\tGitSHA    string\n\tBuildDate string\n\tBuildTime string\n)\n\nfunc main() {}\n",
+	}, "v1.2.3")
+	defer cleanup()
+	// Times are mapped to the version to compare outputs
+	stamped := "-X main.BuildDate=v1.2.3 -X main.BuildTime=v1.2.3 -X main.Commit=" + hash[:7] + " -X main.GitCommit=" + hash + " -X main.GitSHA=" + hash + " -X main.Version=v1.2.3"
+
+	// Defaults are enabled with the flag or the configuration and both -m and the configuration override them
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   string
+	}{
+		{"no defaults", "", []string{"-m", "BuildDate|BuildTime=version"}, "-X main.BuildDate=v1.2.3 -X main.BuildTime=v1.2.3"},
+		{"flag", "", []string{"-defaults", "-m", "BuildDate|BuildTime=version"}, stamped},
+		{"configuration", "defaults = true\nBuildDate|BuildTime=version\n", nil, stamped},
+		{"disabled in configuration", "defaults = false\nBuildDate|BuildTime=version\n", nil, "-X main.BuildDate=v1.2.3 -X main.BuildTime=v1.2.3"},
+		{"override", "defaults = true\nBuildDate|BuildTime=version\nCommit=hash:4\n", []string{"-m", "Version=tag(prefix=release-)"},
+			"-X main.BuildDate=v1.2.3 -X main.BuildTime=v1.2.3 -X main.Commit=" + hash[:4] + " -X main.GitCommit=" + hash + " -X main.GitSHA=" + hash + " -X main.Version=release-v1.2.3"},
+	}
+	for _, tt := range tests {
+		writeFiles(t, dir, map[string]string{defaultConfigName: tt.config})
+		stdout, stderr, code := runMain(t, dir, nil, tt.args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%s: exit code %d, STDOUT %q, want %q, STDERR %s", tt.name, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// The table is listed with -list
+	writeFiles(t, dir, map[string]string{defaultConfigName: ""})
+	stdout, stderr, code := runMain(t, dir, nil, "-defaults", "-list")
+	const defaults = "Defaults:\n  - BuildDate = time\n  - BuildTime = time\n  - Commit = hash_short\n  - GitCommit = hash_long\n  - GitSHA = hash_long\n  - Version = version\n"
+	if code != ExitOk || !strings.HasSuffix(stdout, defaults) {
+		t.Errorf("-list: exit code %d, STDOUT %q, want the suffix %q, STDERR %s", code, stdout, defaults, stderr)
+	}
+}
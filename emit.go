@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// generatedHeader marks the Go source file generated by goxver.
+const generatedHeader = "// Code generated by goxver. DO NOT EDIT."
+
+// emitGo generates the Go source file which assigns values of targets in init().
+// Only targets of one package are assigned, that is the package given with -emit-pkg or
+// the first package in the sorted order. Integer targets of other packages are errors as
+// nothing else can stamp them. If the path has no directory the file is placed into
+// the directory of the package.
+func emitGo(values []TargetValue, path string) error {
+	if len(values) == 0 {
+		msg("No targets to emit Go source for\n")
+		return nil
+	}
+
+	// Select targets of the package and sort them so the output is deterministic
+	selected := make([]TargetValue, 0, len(values))
+	pkg := emitPkg
+	if len(pkg) == 0 {
+		for _, t := range values {
+			if len(pkg) == 0 || t.Pkg < pkg {
+				pkg = t.Pkg
+			}
+		}
+	}
+	for _, t := range values {
+		if t.Pkg == pkg {
+			selected = append(selected, t)
+		} else if isIntType(t.Type) {
+			return withCode(ExitUsage, fmt.Errorf("%s.%s is %s and can be stamped only in the package Go source is generated for, which is %s, see -emit-pkg",
+				t.Pkg, t.Var, t.Type, pkg))
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no targets found in package %s", pkg)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Var < selected[j].Var
+	})
+
+	// Find the package name from the file the target is declared in
+	file, err := parser.ParseFile(token.NewFileSet(), selected[0].File, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return err
+	}
+	if filepath.Base(path) == path {
+		path = filepath.Join(filepath.Dir(selected[0].File), path)
+	}
+
+	// Compose the source
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n\npackage %s\n", generatedHeader, file.Name.Name)
+
+	var assigned int
+	for _, t := range selected {
+		value := t.Value
+		if len(value) == 0 {
+			continue
+		}
+		if assigned == 0 {
+			buf.WriteString("\nfunc init() {\n")
+		}
+		if isIntType(t.Type) {
+			fmt.Fprintf(&buf, "\t%s = %s\n", t.Var, value)
+		} else {
+			fmt.Fprintf(&buf, "\t%s = %s\n", t.Var, strconv.Quote(value))
+		}
+		assigned++
+	}
+	if assigned > 0 {
+		buf.WriteString("}\n")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	msgWith(Fields{"file": path}, "Writing Go source of package %s to %s\n", pkg, path)
+	return writeFileAtomic(path, src)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+func TestEmitGoIntTargets(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nimport \"fmt\"\n\nvar (\n\tVersion string\n\tBuild   int\n\tStamp   int64\n)\n\nfunc main() {\n\tfmt.Println(Version, Build, Stamp > 0)\n}\n",
+	}, "v1.2.3")
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommit(t, repo, dir, map[string]string{"README": "app\n"})
+	mapping := "Version=version,Build=commit_count,Stamp=timestamp"
+
+	// The linker cannot set integer variables, so -X flags are not produced at all
+	for _, format := range []string{FormatLDFlags, FormatLines, FormatGoReleaser, FormatBazel, FormatYAML} {
+		stdout, stderr, code := runMain(t, dir, nil, "-m", mapping, "-format", format)
+		if code != ExitUsage || len(stdout) > 0 || !strings.Contains(stderr, "main.Build in main.go is int; the linker sets only string variables") {
+			t.Errorf("%s: exit code %d, STDOUT %q, STDERR %q", format, code, stdout, stderr)
+		}
+	}
+
+	// The generated source assigns the raw numbers
+	_, stderr, code := runMain(t, dir, nil, "-m", mapping, "-emit-go", "version_gen.go")
+	if code != ExitOk {
+		t.Fatalf("-emit-go: exit code %d, STDERR %s", code, stderr)
+	}
+	if out := buildAndRun(t, dir); out != "v1.2.3 2 true\n" {
+		t.Errorf("stamped binary printed %q", out)
+	}
+}
+
+func TestLDFlagsIntTargets(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":          "module example.com/app\n",
+		"main.go":         "package main\n\nvar (\n\tVersion string\n\tBuild   int\n)\n\nfunc main() {}\n",
+		defaultConfigName: "Version=version\nBuild=commit_count\n",
+	}, "v1.2.3")
+	defer cleanup()
+	const warning = warnPrefix + "main.Build in main.go is int and skipped; the linker sets only string variables, stamp it with -emit-go\n"
+
+	// The integer variable mapped by the configuration is skipped with the warning even without -v
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatLDFlags, "-X main.Version=v1.2.3"},
+		{FormatLines, "-X main.Version=v1.2.3\n"},
+		{FormatGoReleaser, "ldflags:\n  - -X main.Version={{.Tag}}\n"},
+		{FormatBazel, "{\n  \"main.Version\": \"v1.2.3\"\n}\n"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, nil, "-format", tt.format)
+		if code != ExitOk || stdout != tt.want || stderr != warning {
+			t.Errorf("%s: exit code %d, STDOUT %q, want %q, STDERR %q", tt.format, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// The variable mapped explicitly with -m cannot be skipped
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Build=commit_count")
+	if code != ExitUsage || len(stdout) > 0 || !strings.Contains(stderr, "main.Build in main.go is int; the linker sets only string variables, stamp it with -emit-go") {
+		t.Errorf("-m: exit code %d, STDOUT %q, STDERR %q", code, stdout, stderr)
+	}
+}
+
+func TestEmitGoIntTargetsOfOtherPackage(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":        "module example.com/app\n",
+		"main.go":       "package main\n\nvar Version string\n",
+		"info/info.go":  "package info\n\nvar Build int\n",
+		"other/info.go": "package other\n\nvar Version string\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	_, stderr, code := runMain(t, dir, nil, "-m", "Version=version,Build=commit_count", "-emit-go", "version_gen.go", "-emit-pkg", mainPkgName)
+	if code != ExitUsage || !strings.Contains(stderr, "example.com/app/info.Build is int and can be stamped only in the package") {
+		t.Errorf("exit code %d, STDERR %q", code, stderr)
+	}
+}
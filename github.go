@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// Constants of GitHub Actions outputs
+const (
+	githubOutputEnv       = "GITHUB_OUTPUT"
+	githubOutputDelimiter = "GOXVER_EOF"
+	githubLDFlagsName     = "ldflags"
+)
+
+// printGitHub prints generated values as GitHub Actions step outputs keyed by variable names.
+// The outputs are appended to the file $GITHUB_OUTPUT points to or printed with printOutput if it is not set.
+func printGitHub(values []TargetValue) error {
+	value := formatGitHub(values)
+	path := os.Getenv(githubOutputEnv)
+	if len(path) == 0 {
+		printOutput(value)
+		return nil
+	}
+	return appendGitHubOutput(path, value)
+}
+
+// writeGitHubOutput appends generator values keyed by generator names and the ldflags value
+// to the file $GITHUB_OUTPUT points to. If it is not set the outputs are printed to STDERR
+// with the warning, so they do not mix with the normal output.
+func writeGitHubOutput(repo *git.Repository, values []TargetValue) error {
+	genValues, err := generatorValues(repo, values)
+	if err != nil {
+		return err
+	}
+	gens := make([]string, 0, len(genValues))
+	for gen := range genValues {
+		gens = append(gens, gen)
+	}
+	sort.Strings(gens)
+
+	var sb strings.Builder
+	for _, gen := range gens {
+		writeGitHubOutputLine(&sb, strings.ToLower(envName(gen)), genValues[gen])
+	}
+
+	ldflags, err := formatLDFlags(generateLDFlags(values))
+	if err != nil {
+		return err
+	}
+	writeGitHubOutputLine(&sb, githubLDFlagsName, ldflags)
+
+	path := os.Getenv(githubOutputEnv)
+	if len(path) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%s$%s is not set, outputs are:\n%s", warnPrefix, githubOutputEnv, sb.String())
+		return nil
+	}
+	return appendGitHubOutput(path, sb.String())
+}
+
+// appendGitHubOutput appends outputs to the file.
+func appendGitHubOutput(path, value string) error {
+	msgWith(Fields{"file": path}, "Appending outputs to %s\n", path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(value); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// formatGitHub makes one name=value line per variable sorted by name.
+// Variables with empty values are omitted and a variable found in several packages is output once.
+func formatGitHub(values []TargetValue) string {
+	var sb strings.Builder
+	seen := make(map[string]bool)
+	for _, v := range sortedByVar(values) {
+		if seen[v.Var] {
+			continue
+		}
+		seen[v.Var] = true
+
+		if len(v.Value) == 0 {
+			continue
+		}
+		writeGitHubOutputLine(&sb, v.Var, v.Value)
+	}
+	return sb.String()
+}
+
+// writeGitHubOutputLine writes the output in the form name=value. The multiline value uses
+// the name<<DELIMITER form with the delimiter which does not occur in the value.
+func writeGitHubOutputLine(sb *strings.Builder, name, value string) {
+	if !strings.ContainsAny(value, "\n\r") {
+		sb.WriteString(name + mapAssignment + value + "\n")
+		return
+	}
+	delimiter := githubOutputDelimiter
+	for i := 1; strings.Contains(value, delimiter); i++ {
+		delimiter = githubOutputDelimiter + "_" + strconv.Itoa(i)
+	}
+	sb.WriteString(name + "<<" + delimiter + "\n" + value + "\n" + delimiter + "\n")
+}
+
+// sortedByVar returns the copy of values sorted by variable and then by package.
+func sortedByVar(values []TargetValue) []TargetValue {
+	sorted := make([]TargetValue, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Var != sorted[j].Var {
+			return sorted[i].Var < sorted[j].Var
+		}
+		return sorted[i].Pkg < sorted[j].Pkg
+	})
+	return sorted
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitHubOutputs(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	path := filepath.Join(dir, "github_output")
+	const existing = "previous=1\n"
+	want := "Commit=" + hash + "\nVersion=v1.2.3\n"
+
+	// The outputs are appended to $GITHUB_OUTPUT and nothing is printed
+	writeFiles(t, dir, map[string]string{"github_output": existing})
+	stdout, stderr, code := runMain(t, dir, []string{githubOutputEnv + "=" + path}, "-m", "Version=version,Commit=hash_long", "-github")
+	if code != ExitOk || len(stdout) > 0 {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != existing+want {
+		t.Errorf("$%s %q, %v, want %q", githubOutputEnv, data, err, existing+want)
+	}
+
+	// Without $GITHUB_OUTPUT the outputs are printed to STDOUT or written into the output file
+	stdout, stderr, code = runMain(t, dir, nil, "-m", "Version=version,Commit=hash_long", "-github")
+	if code != ExitOk || stdout != want {
+		t.Errorf("STDOUT: exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+	out := filepath.Join(dir, "out", "outputs.txt")
+	stdout, stderr, code = runMain(t, dir, nil, "-m", "Version=version,Commit=hash_long", "-github", "-o", out)
+	if code != ExitOk || len(stdout) > 0 {
+		t.Errorf("-o: exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	if data, err := ioutil.ReadFile(out); err != nil || string(data) != want {
+		t.Errorf("-o: output %q, %v, want %q", data, err, want)
+	}
+}
+
+func TestGitHubOutputFile(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	path := filepath.Join(dir, "github_output")
+	ldflags := "-X main.Commit=" + hash + " -X main.Version=v1.2.3"
+	outputs := "hash_long=" + hash + "\nversion=v1.2.3\nldflags=" + ldflags + "\n"
+
+	// Generator values and ldflags are appended to $GITHUB_OUTPUT besides the output printed
+	writeFiles(t, dir, map[string]string{"github_output": "previous=1\n"})
+	stdout, stderr, code := runMain(t, dir, []string{githubOutputEnv + "=" + path}, "-m", "Version=version,Commit=hash_long", "-github-output")
+	if code != ExitOk || stdout != ldflags || len(stderr) > 0 {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %q", code, stdout, stderr)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "previous=1\n"+outputs {
+		t.Errorf("$%s %q, %v, want %q", githubOutputEnv, data, err, outputs)
+	}
+
+	// Without $GITHUB_OUTPUT the outputs go to STDERR with the warning, so STDOUT has only the output
+	stdout, stderr, code = runMain(t, dir, nil, "-m", "Version=version,Commit=hash_long", "-github-output")
+	if want := warnPrefix + "$" + githubOutputEnv + " is not set, outputs are:\n" + outputs; code != ExitOk || stdout != ldflags || stderr != want {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %q, want %q", code, stdout, stderr, want)
+	}
+}
+
+func TestWriteGitHubOutputLine(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        string
+	}{
+		{"Version", "v1.2.3", "Version=v1.2.3\n"},
+		{"Version", "", "Version=\n"},
+		{"Notes", "a\nb", "Notes<<" + githubOutputDelimiter + "\na\nb\n" + githubOutputDelimiter + "\n"},
+		{"Notes", "a\r\n" + githubOutputDelimiter, "Notes<<" + githubOutputDelimiter + "_1\na\r\n" + githubOutputDelimiter + "\n" + githubOutputDelimiter + "_1\n"},
+	}
+	for _, tt := range tests {
+		var sb strings.Builder
+		writeGitHubOutputLine(&sb, tt.name, tt.value)
+		if sb.String() != tt.want {
+			t.Errorf("writeGitHubOutputLine(%s, %q) = %q, want %q", tt.name, tt.value, sb.String(), tt.want)
+		}
+	}
+}
@@ -2,4 +2,9 @@ module github.com/workanator/goxver
 
 go 1.12
 
-require gopkg.in/src-d/go-git.v4 v4.13.1 // indirect
+require (
+	github.com/BurntSushi/toml v0.3.0
+	gopkg.in/src-d/go-billy.v4 v4.3.2
+	gopkg.in/src-d/go-git.v4 v4.13.1
+	gopkg.in/yaml.v3 v3.0.1
+)
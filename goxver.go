@@ -12,75 +12,278 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"gopkg.in/src-d/go-billy.v4/osfs"
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 )
 
 // Exit codes
 const (
-	ExitOk   = 0
-	ExitFail = 1
+	ExitOk         = 0 // Success, also when there is nothing to do, e.g. no git repository found
+	ExitFail       = 1 // Unclassified failure or problems found in check mode
+	ExitUsage      = 2 // Invalid command line, configuration or mapping
+	ExitScan       = 3 // Scanning source files failed, with -strict only
+	ExitGit        = 4 // Reading the git repository failed
+	ExitOutput     = 5 // Producing or writing output failed
+	ExitNotStamped = 6 // Nothing would be stamped in check mode
 )
 
+// Environment variables git uses to locate the repository
+const (
+	gitDirEnv      = "GIT_DIR"       // The git directory
+	gitWorkTreeEnv = "GIT_WORK_TREE" // The work tree of the git directory
+)
+
+// ExitError is the error which carries the exit code of its class.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+// withCode classifies the error with the exit code unless it is classified already.
+func withCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ExitError); ok {
+		return err
+	}
+	return &ExitError{Code: code, Err: err}
+}
+
+// fail panics with the message followed by the error if one is given. The exit code is
+// the one of the error class if the error is classified, otherwise the code given.
+func fail(code int, s string, err error) {
+	if err != nil {
+		if e, ok := err.(*ExitError); ok {
+			code = e.Code
+		}
+		if len(s) > 0 {
+			s += ": " + err.Error()
+		} else {
+			s = err.Error()
+		}
+	}
+	panic(&ExitError{Code: code, Err: errors.New(s)})
+}
+
+// exit prints statistics if they are enabled and exits with the code.
+func exit(code int) {
+	if showStats {
+		printStats()
+	}
+	os.Exit(code)
+}
+
 // Constants to have less or no magic numbers
 const (
 	currentDir        = "."
+	stdinName         = "-"
 	defaultConfigName = ".goxver"
 	goModName         = "go.mod"
+	goModComment      = "//"
 	goPathEnv         = "GOPATH"
 	goSourceSuffix    = ".go"
-	goTestSuffix      = " _test.go"
+	goTestSuffix      = "_test.go"
 	dirChunkSize      = 100
 	typeString        = "string"
+	mainPkgName       = "main"
+	typeInt           = "int"
+	typeInt64         = "int64"
 	timeFormat        = "2006-01-02_15:04:05_Z07:00"
+	pseudoTimeFormat  = "20060102150405"
+	pseudoHashLength  = 12
 	versionPrefix     = "v"
 	versionSeparator  = "."
 	gitDirName        = ".git"
 	srcDirName        = "src"
 	mapSeparator      = ","
 	mapAssignment     = "="
+	nameWildcards     = "*?"
+	globSpecials      = "*?[\\"
+	mapNameSeparator  = "|"
+	pkgVarSeparator   = "."
+	relativePkgPrefix = "./"
+	annotationPrefix  = "//goxver:"
+	genParamSeparator = ":"
+	hashLength        = 40
+	shortHashLength   = 7
+	ldflagsPrefix     = "-ldflags="
+	linkerSetFlag     = "-X"
+	dirPerm           = 0755
+	filePerm          = 0644
+	defaultEnvPrefix  = "GOXVER_"
 )
 
 // Generator names
 const (
-	GenVersion   = "version"    // The most recent symver in format vX[.Y[.Z]] or X[.Y[.Z]] form tags
-	GenTag       = "tag"        // The most recent tag
-	GenHashShort = "hash_short" // The short hash of the revision
-	GenHashLong  = "hash_long"  // The long hash of the revision
-	GenTime      = "time"       // The current time in format YYYY-MM-DD_HH:MM:SS_Z
+	GenVersion        = "version"         // The most recent symver in format vX[.Y[.Z]] or X[.Y[.Z]] form tags
+	GenTag            = "tag"             // The most recent tag
+	GenHashShort      = "hash_short"      // The short hash of the revision
+	GenHashLong       = "hash_long"       // The long hash of the revision
+	GenTime           = "time"            // The current time in format YYYY-MM-DD_HH:MM:SS_Z
+	GenHash           = "hash"            // The hash of the revision abbreviated to the length given as hash:N
+	GenCommitCount    = "commit_count"    // The number of commits reachable from the revision
+	GenTimestamp      = "timestamp"       // The current time as Unix timestamp
+	GenGOOS           = "goos"            // The target operating system
+	GenGOARCH         = "goarch"          // The target architecture
+	GenHost           = "host"            // The name of the build host
+	GenUser           = "user"            // The name of the user running the build
+	GenAheadBehind    = "ahead_behind"    // The number of commits ahead and behind the upstream branch, e.g. +3-1
+	GenOnTag          = "on_tag"          // Either true if HEAD is exactly at a version tag or false
+	GenTreeHash       = "tree_hash"       // The hash of the tree of the revision
+	GenNextPatch      = "next_patch"      // The most recent version with the patch number incremented
+	GenNextMinor      = "next_minor"      // The most recent version with the minor number incremented
+	GenNextMajor      = "next_major"      // The most recent version with the major number incremented
+	GenPseudo         = "pseudo"          // The Go module pseudo-version of the revision
+	GenExec           = "exec"            // The output of the command given as exec:command
+	GenEnv            = "env"             // The value of the environment variable given as env:NAME
+	GenCommitter      = "committer"       // The name of the committer of the revision
+	GenCommitterEmail = "committer_email" // The email of the committer of the revision
+	GenSigned         = "signed"          // Either true if the revision carries the PGP signature or false
+	GenRootHash       = "root_hash"       // The hash of the initial commit of the repository
 )
 
+// Generators which produce integer values and can stamp integer variables
+var NumericGens = []string{
+	GenCommitCount,
+	GenTimestamp,
+}
+
+// Generators which take the parameter given as gen:param
+var ParamGens = []string{
+	GenHash,
+	GenExec,
+	GenEnv,
+}
+
 var ValidGens = []string{
 	GenVersion,
 	GenTag,
 	GenHashShort,
 	GenHashLong,
 	GenTime,
+	GenHash,
+	GenCommitCount,
+	GenTimestamp,
+	GenGOOS,
+	GenGOARCH,
+	GenHost,
+	GenUser,
+	GenAheadBehind,
+	GenOnTag,
+	GenTreeHash,
+	GenNextPatch,
+	GenNextMinor,
+	GenNextMajor,
+	GenPseudo,
+	GenExec,
+	GenEnv,
+	GenCommitter,
+	GenCommitterEmail,
+	GenSigned,
+	GenRootHash,
 }
 
+// GenDescriptions describes values each generator produces.
+var GenDescriptions = map[string]string{
+	GenVersion:        "The most recent semantic version from tags in format vX.Y.Z or X.Y.Z",
+	GenTag:            "The most recent tag",
+	GenHashShort:      "The short hash of the HEAD revision",
+	GenHashLong:       "The long hash of the HEAD revision",
+	GenTime:           "The current time in format YYYY-MM-DD_HH:MM:SS_Z",
+	GenHash:           "The hash of the HEAD revision abbreviated to N characters given as hash:N",
+	GenCommitCount:    "The number of commits reachable from the HEAD revision",
+	GenTimestamp:      "The current time as Unix timestamp",
+	GenGOOS:           "The target operating system given with -goos or $GOOS",
+	GenGOARCH:         "The target architecture given with -goarch or $GOARCH",
+	GenHost:           "The name of the build host, empty with -reproducible",
+	GenUser:           "The name of the user running the build, empty with -reproducible",
+	GenAheadBehind:    "The number of commits ahead and behind the upstream branch, e.g. +3-1",
+	GenOnTag:          "Either true if HEAD is exactly at a version tag or false",
+	GenTreeHash:       "The hash of the tree of the HEAD revision which changes only with contents",
+	GenNextPatch:      "The most recent semantic version with the patch number incremented, e.g. v1.2.4 after v1.2.3",
+	GenNextMinor:      "The most recent semantic version with the minor number incremented, e.g. v1.3.0 after v1.2.3",
+	GenNextMajor:      "The most recent semantic version with the major number incremented, e.g. v2.0.0 after v1.2.3",
+	GenPseudo:         "The Go module pseudo-version of the HEAD revision, e.g. v1.2.4-0.20230102150405-abcdef012345",
+	GenExec:           "The trimmed output of the command given as exec:command run in the repository directory",
+	GenEnv:            "The value of the environment variable given as env:NAME, empty if it is not set",
+	GenCommitter:      "The name of the committer of the HEAD revision which may differ from the author after rebase",
+	GenCommitterEmail: "The email of the committer of the HEAD revision",
+	GenSigned:         "Either true if the HEAD revision carries the PGP signature or false, the signature is not verified",
+	GenRootHash:       "The hash of the initial commit reachable from the HEAD revision, the oldest one if there are several",
+}
+
+// Version information of goxver itself which is populated by goxver at build time,
+// see .goxver in the project root.
+var (
+	goxverVersion   = "dev"
+	goxverCommit    = "unknown"
+	goxverBuildTime = "unknown"
+)
+
 // Target is the name and location of the variable to push some data into.
 type Target struct {
-	Var string
-	Pkg string
-	Gen string
+	Var  string
+	Pkg  string
+	Gen  string
+	File string
+	Type string
+	Key  string // The mapping key matched, e.g. Version or example.com/app/internal.Version, or the annotation
+	Opts GenOptions
+	// The literal used if the generator gives the empty value, e.g. v0.0.0-dev of version|v0.0.0-dev
+	Fallback string
+}
+
+// Skipped is the variable which matches some target name but cannot be used as a target.
+type Skipped struct {
+	Target
+	Reason string
 }
 
+// Reasons of skipping variables
+const (
+	reasonNotString     = "not a string variable"
+	reasonNotNumericGen = "integer variable with non-numeric generator"
+	reasonTestFile      = "declared in test file"
+	reasonExcludedDir   = "declared in excluded directory"
+	reasonConstraints   = "excluded by build constraints"
+)
+
 // TargetMap maps targets to generators.
 type TargetMap map[string]string
 
@@ -93,33 +296,150 @@ func (tm *TargetMap) CopyFrom(other TargetMap) {
 	}
 }
 
+// DefaultMappings maps conventional variable names to generators, see -defaults.
+// The configuration file and -m override them. The init subcommand proposes them as well.
+var DefaultMappings = TargetMap{
+	"Version":   GenVersion,
+	"Commit":    GenHashShort,
+	"GitCommit": GenHashLong,
+	"GitSHA":    GenHashLong,
+	"BuildDate": GenTime,
+	"BuildTime": GenTime,
+}
+
 var (
 	// The map of known target variable names and generators for them.
 	// Variables names are case insensitive.
 	targetDict = TargetMap{}
+
+	// The import path of the root package which is known once the mapping is loaded.
+	rootPackage string
 )
 
 // Regular expressions for parsing various things
 var (
-	reGoModPackage = regexp.MustCompile("^module (.+)$")
+	reGoModPackage = regexp.MustCompile(`^\s*module\s+(.+)$`)
 	reVersion      = regexp.MustCompile(`^v?\d+(?:\.\d+){0,2}`)
+	reCalVer       = regexp.MustCompile(`^v?(?:\d{4}|\d{2})\.\d{1,2}(?:\.\d+)?$`)
+	reSemver       = regexp.MustCompile(`^v(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+	reIdentifier   = regexp.MustCompile(`^[\p{L}_][\p{L}\p{Nd}_]*$`)
+
+	// The filter of tags compiled from -tag-filter once the configuration is loaded
+	reTagFilter *regexp.Regexp
 )
 
+// configFormat is the output format declared in the configuration used unless -format is given.
+var configFormat string
+
 // Command line options
 var (
-	rootDir     string // The root directory of project (-d path)
-	configPath  string // The path to the configuration file (-c path)
-	configMap   string // The mapping (-m mapping)
-	doubleQuote bool   // Put generated values into double quotes (-qq)
-	verbose     bool   // Enable verbose mode (-v)
+	rootDir          string      // The root directory of project (-d path)
+	configPath       string      // The path to the configuration file (-c path)
+	repoDir          string      // The directory of the git repository, the root directory by default (-repo path)
+	configMaps       stringsFlag // Mappings merged in order (-m mapping)
+	outputPath       string      // The path to the file to write output into (-o path)
+	outputFormat     string      // The output format (-format name)
+	envPrefix        string      // The prefix of variable names in env and make formats (-env-prefix prefix)
+	bazelStyle       string      // The style of bazel format (-bazel-style json|bzl)
+	dockerNewline    bool        // Separate docker build arguments with line breaks (-docker-newline)
+	print0           bool        // Terminate -X flags with NUL, the same as -format nul (-print0)
+	flagSep          string      // The separator between -X flags in ldflags format (-sep space|newline|null)
+	doubleQuote      bool        // Prefer double quotes when quoting -X flags (-qq)
+	quoteStyle       string      // The only kind of quotes used when quoting -X flags (-quote none|single|double)
+	dryRun           bool        // Explain decisions instead of producing output (-dry-run)
+	checkMode        bool        // Validate the configuration instead of producing output (-check)
+	listMode         bool        // List discovered targets instead of producing output (-list)
+	wrapFlags        bool        // Print the complete -ldflags= argument (-wrap)
+	listGens         bool        // Print available generators and exit (-list-generators)
+	showVersion      bool        // Print the version of goxver and exit (-version)
+	patchFlags       stringsFlag // Manifest files to patch (-patch FILE:KEYPATH=gen)
+	extraFlags       stringsFlag // Raw linker flags put before -X flags (-extra flags)
+	mergeFlags       string      // Existing linker flags to merge -X flags into (-merge flags)
+	shellName        string      // The shell to quote ldflags output for (-shell posix|powershell|cmd)
+	emitGoPath       string      // The path to Go source file to generate instead of output (-emit-go path)
+	emitPkg          string      // The import path of the package to generate Go source for (-emit-pkg pkg)
+	githubOutput     bool        // Write GitHub Actions outputs instead of output (-github)
+	githubOutputFile bool        // Write generator values and ldflags as GitHub Actions outputs as well (-github-output)
+	printGen         string      // The generator to print the raw value of (-print gen)
+	targetOS         string      // The target operating system (-goos os)
+	reproducible     bool        // Suppress values depending on the build machine (-reproducible)
+	calver           bool        // Interpret version tags as calendar versions (-calver)
+	failOnSanitize   bool        // Fail instead of stripping control characters from values (-fail-on-sanitize)
+	targetArch       string      // The target architecture (-goarch arch)
+	verbose          bool        // Enable verbose mode (-v)
+	veryVerbose      bool        // Enable verbose mode with details of decisions (-vv)
+	showStats        bool        // Print the timing of processing phases to STDERR (-stats)
+	strict           bool        // Fail if scanning source files fails (-strict)
+	logFormat        string      // The format of verbose messages (-log-format text|json)
+	useDefaults      bool        // Seed mappings with conventional variable names (-defaults)
+	defaultVersion   string      // The version if no version is tagged (-default-version version)
+	noConfig         bool        // Use only mappings given with -m (-no-config)
+	caseSensitive    bool        // Match variable names to mappings exactly (-case-sensitive)
+	tagPrefix        string      // The prefix tags must have which is stripped, e.g. backend/ (-tag-prefix prefix)
+	tagFilter        string      // The regular expression tags must match, e.g. ^v\d (-tag-filter regexp)
+	valuePrefix      string      // The text put before non-empty stamped values (-value-prefix text)
+	valueSuffix      string      // The text put after non-empty stamped values, e.g. -nightly (-value-suffix text)
+	valueGens        string      // Generators -value-prefix and -value-suffix apply to, all if empty (-value-gens gen,...)
+	targetsPath      string      // The file listing targets instead of scanning sources, - is STDIN (-targets path)
+	manifestPath     string      // The JSON file to write stamped variables and values into (-manifest path)
+	stripSymbols     bool        // Append -s -w to linker flags (-strip)
+	forceInit        bool        // Overwrite the configuration file with init subcommand (-f)
+	emptyPlaceholder string      // The value stamped instead of empty generated values in every output (-empty placeholder)
 )
 
 func init() {
 	flag.StringVar(&rootDir, "d", currentDir, "The root directory of the project")
+	flag.StringVar(&repoDir, "repo", "", "The directory of the git repository if it differs from the root directory")
 	flag.StringVar(&configPath, "c", "", "The path to the configuration file")
-	flag.StringVar(&configMap, "m", "", "The mapping")
-	flag.BoolVar(&doubleQuote, "qq", false, "Double quote values")
+	flag.Var(&configMaps, "m", "The mapping, later ones override earlier ones (repeatable)")
+	flag.StringVar(&outputPath, "o", "", "Write output to the file instead of STDOUT")
+	flag.StringVar(&outputFormat, "format", FormatLDFlags, "The output format, one of "+strings.Join(ValidFormats, ", "))
+	flag.StringVar(&envPrefix, "env-prefix", defaultEnvPrefix, "The prefix of variable names in env and make formats")
+	flag.StringVar(&bazelStyle, "bazel-style", BazelStyleJSON, "The style of bazel format, json or bzl")
+	flag.BoolVar(&dockerNewline, "docker-newline", false, "Separate docker build arguments with line breaks")
+	flag.BoolVar(&print0, "print0", false, "Terminate -X flags with NUL, the same as -format nul")
+	flag.StringVar(&flagSep, "sep", SepSpace, "The separator between -X flags in ldflags format, space, newline or null")
+	flag.BoolVar(&doubleQuote, "qq", false, "Prefer double quotes when quoting -X flags")
+	flag.StringVar(&quoteStyle, "quote", QuoteAuto, "Quote -X flags only with the kind of quotes, none, single or double")
+	flag.BoolVar(&dryRun, "dry-run", false, "Explain what would be stamped without producing output")
+	flag.BoolVar(&checkMode, "check", false, "Validate the configuration and report unmatched mappings")
+	flag.BoolVar(&listMode, "list", false, "List discovered targets without touching the git repository")
+	flag.BoolVar(&wrapFlags, "wrap", false, "Print the complete -ldflags= argument")
+	flag.BoolVar(&listGens, "list-generators", false, "Print available generators and exit")
+	flag.BoolVar(&showVersion, "version", false, "Print the version of goxver and exit")
+	flag.Var(&extraFlags, "extra", "Raw linker flags put verbatim before -X flags, e.g. \"-s -w\" (repeatable)")
+	flag.StringVar(&mergeFlags, "merge", "", "Merge -X flags into the existing linker flags replacing duplicates, - reads them from STDIN")
+	flag.StringVar(&shellName, "shell", ShellNone, "Quote ldflags output as a single argument of the shell, posix, powershell or cmd")
+	flag.Var(&patchFlags, "patch", "Set the key of YAML or JSON file to the generator value, FILE:KEYPATH=gen (repeatable)")
+	flag.StringVar(&emitGoPath, "emit-go", "", "Generate Go source file assigning values instead of printing output")
+	flag.StringVar(&emitPkg, "emit-pkg", "", "The import path of the package to generate Go source for")
+	flag.BoolVar(&githubOutputFile, "github-output", false, "Append generator values and ldflags to $GITHUB_OUTPUT besides printing output")
+	flag.BoolVar(&githubOutput, "github", false, "Append name=value outputs to $GITHUB_OUTPUT or print them if it is not set")
+	flag.StringVar(&printGen, "print", "", "Print the raw value of the generator and exit")
+	flag.StringVar(&targetOS, "goos", build.Default.GOOS, "The target operating system, defaults to $GOOS or the host one")
+	flag.StringVar(&targetArch, "goarch", build.Default.GOARCH, "The target architecture, defaults to $GOARCH or the host one")
+	flag.BoolVar(&calver, "calver", false, "Interpret version tags as calendar versions YYYY.MM[.MICRO] keeping zero padding")
+	flag.BoolVar(&reproducible, "reproducible", false, "Suppress host and user values for reproducible builds")
+	flag.BoolVar(&failOnSanitize, "fail-on-sanitize", false, "Fail if a value contains control characters or invalid UTF-8 instead of stripping them")
 	flag.BoolVar(&verbose, "v", false, "Enable verbose mode")
+	flag.BoolVar(&veryVerbose, "vv", false, "Enable verbose mode with details of scan and mapping decisions")
+	flag.BoolVar(&strict, "strict", false, "Fail if scanning source files fails instead of ignoring broken files")
+	flag.BoolVar(&showStats, "stats", false, "Print the timing of processing phases to STDERR")
+	flag.StringVar(&logFormat, "log-format", LogFormatText, "The format of verbose messages, text or json")
+	flag.StringVar(&defaultVersion, "default-version", "", "The version generated if no version is tagged, e.g. v0.0.0-dev")
+	flag.StringVar(&tagPrefix, "tag-prefix", "", "Consider only tags with the prefix and strip it, e.g. backend/")
+	flag.StringVar(&tagFilter, "tag-filter", "", "Consider only tags which names match the regular expression, e.g. ^v\\d")
+	flag.StringVar(&valuePrefix, "value-prefix", "", "Put the text before non-empty stamped values")
+	flag.StringVar(&valueSuffix, "value-suffix", "", "Put the text after non-empty stamped values, e.g. -nightly")
+	flag.StringVar(&valueGens, "value-gens", "", "Apply -value-prefix and -value-suffix only to the generators, e.g. version,tag")
+	flag.StringVar(&emptyPlaceholder, "empty", "", "Stamp variables with the placeholder if generated values are empty instead of omitting them")
+	flag.BoolVar(&forceInit, "f", false, "Overwrite the existing configuration file with init subcommand")
+	flag.BoolVar(&stripSymbols, "strip", false, "Append -s -w to linker flags unless given already to omit the symbol table and debug information")
+	flag.StringVar(&manifestPath, "manifest", "", "Write stamped variables, generators and values with the commit and the build time to the JSON file")
+	flag.StringVar(&targetsPath, "targets", "", "Read targets as pkg.Var=gen lines from the file instead of scanning sources, - reads them from STDIN")
+	flag.BoolVar(&caseSensitive, "case-sensitive", false, "Match variable names to mappings case sensitive")
+	flag.BoolVar(&noConfig, "no-config", false, "Use only mappings given with -m ignoring configuration files, defaults and $GOXVER_MAP")
+	flag.BoolVar(&useDefaults, "defaults", false, "Map conventional variable names like Version and Commit before the configuration and -m")
 }
 
 func main() {
@@ -129,135 +449,653 @@ func main() {
 	defer func() {
 		if r := recover(); r != nil {
 			_, _ = fmt.Fprintln(os.Stderr, r)
-			os.Exit(ExitFail)
+			if e, ok := r.(*ExitError); ok {
+				exit(e.Code)
+			}
+			exit(ExitFail)
 		}
 	}()
 
+	// Run the subcommand
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case cmdCompletion:
+			if err := printCompletion(os.Args[2:]); err != nil {
+				fail(ExitUsage, "", err)
+			}
+			exit(ExitOk)
+		case cmdVersion:
+			printVersion(os.Stdout)
+			exit(ExitOk)
+		case cmdConfig:
+			if len(os.Args) < 3 || os.Args[2] != cmdConfigCheck {
+				fail(ExitUsage, "usage: goxver "+cmdConfig+" "+cmdConfigCheck+" [flags]", nil)
+			}
+			_ = flag.CommandLine.Parse(os.Args[3:])
+			outputOpts.Path = outputPath
+			code := ExitOk
+			captureOutput(func(w io.Writer) {
+				code = checkConfig(w)
+			})
+			exit(code)
+		case cmdInit:
+			_ = flag.CommandLine.Parse(os.Args[2:])
+			exit(initConfig())
+		}
+	}
+
 	// Prepare
 	flag.Parse()
 
+	// Informational output goes to the output file as well, other output options are resolved later
+	outputOpts.Path = outputPath
+	if showVersion {
+		captureOutput(printVersion)
+		exit(ExitOk)
+	}
+	if listGens {
+		captureOutput(printGenerators)
+		exit(ExitOk)
+	}
+
+	if bazelStyle != BazelStyleJSON && bazelStyle != BazelStyleBzl {
+		fail(ExitUsage, "invalid bazel style "+bazelStyle, nil)
+	}
+	switch shellName {
+	case ShellNone, ShellPosix, ShellPowerShell, ShellCmd:
+	default:
+		fail(ExitUsage, "invalid shell "+shellName, nil)
+	}
+	if logFormat != LogFormatText && logFormat != LogFormatJSON {
+		fail(ExitUsage, "invalid log format "+logFormat, nil)
+	}
+	if veryVerbose {
+		verbose = true
+	}
+	if _, ok := flagSeparators[flagSep]; !ok {
+		fail(ExitUsage, "invalid separator "+flagSep, nil)
+	}
+
+	var printOpts GenOptions
+	if noConfig && (len(configPath) > 0 || useDefaults) {
+		fail(ExitUsage, "-no-config cannot be used with -c or -defaults", nil)
+	}
+
+	if len(printGen) > 0 {
+		if printGen, printOpts, err = parseGenSpec(printGen); err != nil {
+			fail(ExitUsage, "invalid generator", err)
+		}
+	}
+
+	if mergeFlags == stdinName && targetsPath == stdinName {
+		fail(ExitUsage, "-merge and -targets cannot both read from STDIN", nil)
+	}
+	var listedTargets []Target
+	if len(targetsPath) > 0 {
+		if listedTargets, err = readTargetList(targetsPath); err != nil {
+			fail(ExitUsage, "failed to read targets", err)
+		}
+	}
+
+	if mergeFlags == stdinName {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fail(ExitUsage, "failed to read linker flags to merge", err)
+		}
+		mergeFlags = strings.TrimSpace(string(data))
+	}
+
+	patches := make([]Patch, 0, len(patchFlags))
+	for _, s := range patchFlags {
+		p, err := parsePatch(s)
+		if err != nil {
+			fail(ExitUsage, "failed to parse patch", err)
+		}
+		patches = append(patches, p)
+	}
+
 	if dir, err := filepath.Abs(rootDir); err != nil {
-		panic("failed to get absolute path: " + err.Error())
+		fail(ExitUsage, "failed to get absolute path", err)
 	} else {
 		rootDir = dir
 	}
 
 	// Exit with error if the directory i snot found
 	if !fileExists(rootDir) {
-		panic("path does not exist")
-	}
-	// Exit silently if the git repository does not exists
-	if !fileExists(filepath.Join(rootDir, gitDirName)) {
-		msg("No git repository found\n")
-		os.Exit(ExitOk)
+		fail(ExitUsage, "path does not exist", nil)
 	}
 
-	// Load the configuration file
-	if len(configPath) == 0 {
-		configPath = findConfigFile(rootDir)
+	// Load the configuration file which can declare the root directory unless it is given with -d
+	configStart := time.Now()
+	if useDefaults {
+		mergeMapping(DefaultMappings, SourceBuiltin)
 	}
-	if len(configPath) > 0 {
-		msg("Loading configuration from %s\n", configPath)
-		if err := readConfigFile(configPath); err != nil {
-			panic("failed to read configuration file: " + err.Error())
+	var configPaths []string
+	if !noConfig {
+		if configPaths, err = findConfigFiles(rootDir, configPath); err != nil {
+			fail(ExitUsage, "failed to find configuration file", err)
 		}
-	} else {
+	}
+	userPath := userConfigFile()
+	for i, path := range configPaths {
+		source := SourceProject
+		if path == userPath {
+			source = SourceHome
+		}
+		msgWith(Fields{"file": path, "order": i + 1, "source": source}, "Loading configuration %d of %d from %s\n", i+1, len(configPaths), path)
+		root, err := readConfigFile(path, source)
+		if err != nil {
+			fail(ExitUsage, "failed to read configuration file", err)
+		}
+		if len(root) == 0 {
+			continue
+		}
+		if source == SourceHome {
+			msgWith(Fields{"file": path}, "Ignore root %s of user configuration\n", root)
+		} else if isFlagSet("d") {
+			msgWith(Fields{"file": path}, "Ignore root %s of configuration, use %s given with -d\n", root, rootDir)
+		} else {
+			msgWith(Fields{"file": path}, "Use root %s of configuration\n", root)
+			rootDir = root
+		}
+	}
+	if len(configPaths) == 0 {
 		msg("Use no configuration file\n")
 	}
 
-	if len(configMap) > 0 {
+	// Mappings of the environment override configuration files and -m overrides them all
+	if envMap := os.Getenv(mapEnv); len(envMap) > 0 && !noConfig {
+		m, err := parseTargetMapping(envMap)
+		if err != nil {
+			fail(ExitUsage, "failed to parse $"+mapEnv, err)
+		}
+		mergeMapping(m, SourceEnv)
+	}
+	for _, configMap := range configMaps {
 		m, err := parseTargetMapping(configMap)
 		if err != nil {
-			panic("failed to parse mapping: " + err.Error())
+			fail(ExitUsage, "failed to parse mapping", err)
+		}
+		mergeMapping(m, SourceFlag)
+	}
+	if len(tagFilter) > 0 {
+		if reTagFilter, err = regexp.Compile(tagFilter); err != nil {
+			fail(ExitUsage, "invalid tag filter "+tagFilter, err)
+		}
+	}
+	if outputOpts, err = resolveOutputOptions(configFormat); err != nil {
+		fail(ExitUsage, "", err)
+	}
+	if quoteStyle != QuoteAuto && !containsString(ValidQuotes, quoteStyle) {
+		fail(ExitUsage, "invalid quote style "+quoteStyle, nil)
+	}
+	for _, gen := range splitValueGens(valueGens) {
+		if !isValidGen(gen) && !containsString(ParamGens, gen) {
+			fail(ExitUsage, "invalid generator "+gen+" in -value-gens", nil)
+		}
+	}
+	recordStat("config load", configStart, "")
+
+	if len(repoDir) == 0 {
+		repoDir = rootDir
+	} else if dir, err := filepath.Abs(repoDir); err != nil {
+		fail(ExitUsage, "failed to get absolute path", err)
+	} else {
+		repoDir = dir
+	}
+	// Exit silently if the git repository does not exists.
+	// Listing targets does not need the repository so it goes further.
+	if !listMode && !fileExists(repoGitDir()) {
+		msg("No git repository found\n")
+		if checkMode {
+			printOutput("Problem: no git repository found\n")
+			exit(ExitNotStamped)
+		}
+		printResult(nil, nil)
+		exit(ExitOk)
+	}
+
+	// Print the single generator value bypassing targets
+	if len(printGen) > 0 {
+		repo, err := openRepo()
+		if err != nil {
+			fail(ExitGit, "failed to open git repository", err)
+		}
+		value, err := generateRawValue(repo, printGen, printOpts)
+		if err != nil {
+			fail(ExitGit, "failed to generate value", err)
+		}
+		if len(value) > 0 {
+			value += "\n"
+		}
+		printOutput(value)
+		exit(ExitOk)
+	}
+
+	// Patch manifest files with generated values
+	if len(patches) > 0 {
+		repo, err := openRepo()
+		if err != nil {
+			fail(ExitGit, "failed to open git repository", err)
+		}
+		if err = applyPatches(repo, patches); err != nil {
+			fail(ExitOutput, "failed to patch manifests", err)
 		}
-		targetDict.CopyFrom(m)
 	}
 
 	if len(targetDict) > 0 {
 		msg("Target mappings:\n")
 		for t, g := range targetDict {
-			msg("  - %s = %s\n", t, g)
+			msgWith(Fields{"target": t, "generator": g, "source": targetSources[t]}, "  - %s = %s (%s)\n", t, g, targetSources[t])
 		}
 	} else {
+		// Targets can still be annotated in source files
 		msg("No mappings\n")
-		os.Exit(ExitOk)
 	}
 
 	// Find which is the root package
 	pkg, err := rootPkg(rootDir)
 	if err != nil {
-		panic("failed to find root package: " + err.Error())
+		fail(ExitScan, "failed to find root package", err)
 	} else if len(pkg) == 0 {
-		panic("failed to find root package")
+		fail(ExitScan, "failed to find root package", nil)
 	}
+	rootPackage = pkg
 
-	// Find all target variables which should be substituted
-	targets, err := findAllTargets(rootDir)
-	if err != nil {
+	// Find all target variables which should be substituted unless they are listed
+	var (
+		targets []Target
+		skipped []Skipped
+		scanErr error
+	)
+	if len(targetsPath) > 0 {
+		msg("Use %d targets listed in %s\n", len(listedTargets), targetsPath)
+		targets = listedTargets
+	} else {
+		targets, skipped, scanErr = findAllTargets(rootDir)
+	}
+	if err = scanErr; err != nil {
 		// Do not panic of errors while parsing source code because
 		// here can be issued files in the work tree but they maybe not required for build.
 		// Also having goxver failing on source will fail the command the tool can
-		// be embedded into.
-		msg("failed to scan targets: " + err.Error() + "\n")
+		// be embedded into. Unless that is what is asked for with -strict.
+		if strict {
+			fail(ExitScan, "failed to scan targets", err)
+		}
+		warn(nil, "failed to scan targets: %s\n", err.Error())
 	}
 
-	// Fix target packages
-	for i := 0; i < len(targets); i++ {
-		stripped := stripHeadPath(targets[i].Pkg, rootDir)
-		if len(stripped) > 0 {
-			targets[i].Pkg = strings.ReplaceAll(pkg+"/"+stripped, string(filepath.Separator), "/")
-		} else {
-			targets[i].Pkg = strings.ReplaceAll(pkg, string(filepath.Separator), "/")
-		}
+	// Fix target packages, listed ones are import paths already
+	for i := 0; i < len(targets) && len(targetsPath) == 0; i++ {
+		targets[i].Pkg = importPath(targets[i].Pkg, rootDir, pkg)
+	}
+	for i := 0; i < len(skipped); i++ {
+		skipped[i].Pkg = importPath(skipped[i].Pkg, rootDir, pkg)
 	}
 
+	// Sort targets as they are found concurrently, so the output does not differ between runs
+	targets = sortedTargets(targets)
+	sort.Slice(skipped, func(i, j int) bool {
+		return lessTarget(skipped[i].Target, skipped[j].Target)
+	})
+
 	// Dump debug info
 	msg("Root package is %s\n", pkg)
 	if len(targets) > 0 {
 		msg("Targets:\n")
 		for _, t := range targets {
-			msg("  - %s.%s with %s generator\n", t.Pkg, t.Var, t.Gen)
+			msgWith(Fields{"file": t.File, "target": t.Pkg + "." + t.Var, "generator": t.GenSpec(), "rule": t.Key},
+				"  - %s.%s with %s generator by %s\n", t.Pkg, t.Var, t.GenSpec(), t.Key)
 		}
 	} else {
 		msg("No targets found\n")
 	}
+	warnDuplicateTargets(targets)
+	warnNonStringTargets(skipped)
+
+	// List targets and exit in list mode
+	if listMode {
+		captureOutput(func(w io.Writer) {
+			printList(w, targets)
+		})
+		exit(ExitOk)
+	}
+
+	// Report how mappings matched and exit in check mode
+	if checkMode {
+		code := ExitOk
+		captureOutput(func(w io.Writer) {
+			code = printCheck(w, targets, skipped, scanErr)
+		})
+		exit(code)
+	}
 
 	// Skip further processing if not targets found.
 	if len(targets) == 0 {
-		os.Exit(ExitOk)
+		if dryRun {
+			captureOutput(func(w io.Writer) {
+				printDryRun(w, nil, nil, skipped)
+			})
+		} else {
+			printResult(nil, nil)
+		}
+		exit(ExitOk)
 	}
 
 	// Open the git repository and generate LDFLAGS argment value.
-	repo, err := git.PlainOpen(rootDir)
+	repo, err := openRepo()
 	if err != nil {
-		panic("failed to open git repository: " + err.Error())
+		fail(ExitGit, "failed to open git repository", err)
+	}
+
+	// Explain what would be done instead of doing that in dry-run mode.
+	if dryRun {
+		captureOutput(func(w io.Writer) {
+			printDryRun(w, repo, targets, skipped)
+		})
+		exit(ExitOk)
 	}
 
-	value, err := generateLDFlags(repo, targets)
+	// Generate values once, so every output has the same ones
+	values, err := generateTargetValues(repo, targets)
 	if err != nil {
-		panic("failed to generate LDFLAGS: " + err.Error())
+		fail(ExitOutput, "failed to generate values", err)
+	}
+	if len(outputOpts.EmitGo) == 0 {
+		if values, err = linkerValues(values); err != nil {
+			fail(ExitUsage, "failed to generate LDFLAGS", err)
+		}
 	}
 
 	// Print LDFLAGS argument at last, yay!
-	fmt.Print(value)
-	os.Exit(ExitOk)
+	printResult(repo, values)
+	if len(manifestPath) > 0 {
+		if err = writeManifest(repo, values, manifestPath); err != nil {
+			fail(ExitOutput, "failed to write manifest", err)
+		}
+	}
+	if githubOutputFile {
+		if err = writeGitHubOutput(repo, values); err != nil {
+			fail(ExitOutput, "failed to write GitHub Actions outputs", err)
+		}
+	}
+	exit(ExitOk)
+}
+
+// printVersion prints the version of goxver, the commit and the time it is built.
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "goxver %s (commit %s, built %s)\n", goxverVersion, goxverCommit, goxverBuildTime)
+}
+
+// printGenerators prints the list of valid generators with their descriptions
+// and options they accept.
+func printGenerators(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, gen := range ValidGens {
+		desc := GenDescriptions[gen]
+		if opts := GenOptionNames[gen]; len(opts) > 0 {
+			desc += ", options " + strings.Join(opts, ", ")
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\n", gen, desc)
+	}
+	_ = tw.Flush()
+	fmt.Fprintf(w, "All generators accept options %s of stamped values\n", strings.Join(commonOptions, ", "))
+}
+
+// warnDuplicateTargets warns about target variables with the same name
+// found in multiple packages, which is fine but may be a mistake.
+func warnDuplicateTargets(targets []Target) {
+	pkgs := make(map[string][]string)
+	for _, t := range targets {
+		// Variables matched by qualified mappings are told apart deliberately
+		if pkg, _ := splitNameKey(t.Key); len(pkg) > 0 {
+			continue
+		}
+		pkgs[t.Var] = append(pkgs[t.Var], t.Pkg)
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for name, p := range pkgs {
+		if len(p) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sort.Strings(pkgs[name])
+		warn(Fields{"target": name}, "%s is found in multiple packages: %s\n", name, strings.Join(pkgs[name], ", "))
+	}
+}
+
+// warnNonStringTargets warns about variables with target names
+// which are not strings or integers for numeric generators, so they are silently not stamped otherwise.
+func warnNonStringTargets(skipped []Skipped) {
+	for _, s := range skipped {
+		switch s.Reason {
+		case reasonNotString:
+			warn(Fields{"file": s.File, "target": s.Pkg + "." + s.Var}, "%s is not a string; cannot stamp %s.%s in %s\n", s.Var, s.Pkg, s.Var, stripHeadPath(s.File, rootDir))
+		case reasonNotNumericGen:
+			warn(Fields{"file": s.File, "target": s.Pkg + "." + s.Var, "generator": s.Gen}, "%s is %s but %s is not numeric; cannot stamp %s.%s in %s\n", s.Var, s.Type, s.Gen, s.Pkg, s.Var, stripHeadPath(s.File, rootDir))
+		}
+	}
+}
+
+// printList prints the table of targets and the list of mapped names
+// which were not found in any source file.
+func printList(w io.Writer, targets []Target) {
+	if len(targets) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "PACKAGE\tVARIABLE\tGENERATOR\tFILE")
+		for _, t := range sortedTargets(targets) {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.Pkg, t.Var, t.GenSpec(), stripHeadPath(t.File, rootDir))
+		}
+		_ = tw.Flush()
+	} else {
+		fmt.Fprintln(w, "No targets found")
+	}
+
+	var notFound []string
+	for name, gen := range targetDict {
+		found := false
+		for _, t := range targets {
+			if t.Key == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			notFound = append(notFound, name+" = "+gen)
+		}
+	}
+	if len(notFound) > 0 {
+		sort.Strings(notFound)
+		fmt.Fprintln(w, "Not found:")
+		for _, s := range notFound {
+			fmt.Fprintf(w, "  - %s\n", s)
+		}
+	}
+
+	if useDefaults {
+		names := make([]string, 0, len(DefaultMappings))
+		for name := range DefaultMappings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(w, "Defaults:")
+		for _, name := range names {
+			fmt.Fprintf(w, "  - %s = %s\n", name, DefaultMappings[name])
+		}
+	}
+}
+
+// normalGenSpec returns the spec of the mapping the way Target.GenSpec formats it.
+func normalGenSpec(spec string) string {
+	gen, opts, fallback, err := parseTargetSpec(spec)
+	if err != nil {
+		return spec
+	}
+	return Target{Gen: gen, Opts: opts, Fallback: fallback}.GenSpec()
+}
+
+// printCheck prints which variables each mapping matched and problems found.
+// It returns ExitNotStamped if nothing would be stamped and ExitFail if there is any other problem:
+// the mapping matched nothing, the variable cannot be used as a target, or scanning failed.
+func printCheck(w io.Writer, targets []Target, skipped []Skipped, scanErr error) int {
+	ok := true
+
+	names := make([]string, 0, len(targetDict))
+	for name := range targetDict {
+		names = append(names, name)
+	}
+	for _, t := range targets {
+		if !containsString(names, t.Key) {
+			names = append(names, t.Key)
+		}
+	}
+	for _, s := range skipped {
+		if isAnnotation(s.Key) && !containsString(names, s.Key) {
+			names = append(names, s.Key)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Fprintln(w, "Problem: no mappings configured")
+	}
+	for _, name := range names {
+		gen, found := targetDict[name]
+		if found {
+			fmt.Fprintf(w, "%s = %s:\n", name, gen)
+		} else {
+			fmt.Fprintf(w, "%s:\n", name)
+		}
+		var matched int
+		for _, t := range targets {
+			if t.Key != name {
+				continue
+			}
+			// Mappings of nested configuration files can map the name differently
+			if found && !isAnnotation(name) && t.GenSpec() != normalGenSpec(gen) {
+				fmt.Fprintf(w, "  - %s.%s (%s) with %s\n", t.Pkg, t.Var, stripHeadPath(t.File, rootDir), t.GenSpec())
+			} else {
+				fmt.Fprintf(w, "  - %s.%s (%s)\n", t.Pkg, t.Var, stripHeadPath(t.File, rootDir))
+			}
+			matched++
+		}
+		for _, s := range skipped {
+			if s.Key == name {
+				fmt.Fprintf(w, "  - problem: %s.%s (%s) is %s\n", s.Pkg, s.Var, stripHeadPath(s.File, rootDir), s.Reason)
+				ok = false
+			}
+		}
+		if matched == 0 {
+			fmt.Fprintln(w, "  - problem: no variables found")
+			ok = false
+		}
+	}
+
+	if scanErr != nil {
+		fmt.Fprintf(w, "Problem: %s\n", scanErr.Error())
+		ok = false
+	}
+
+	if !checkStamped(w, targets) {
+		return ExitNotStamped
+	}
+	if !ok {
+		return ExitFail
+	}
+	fmt.Fprintln(w, "OK")
+	return ExitOk
+}
+
+// checkStamped reports why nothing would be stamped, that is when no targets
+// are found, the git repository cannot be opened or every generator produces the empty value.
+func checkStamped(w io.Writer, targets []Target) bool {
+	if len(targets) == 0 {
+		fmt.Fprintln(w, "Problem: no targets found, nothing would be stamped")
+		return false
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		fmt.Fprintf(w, "Problem: failed to open git repository: %s\n", err.Error())
+		return false
+	}
+
+	for _, t := range targets {
+		value, err := generateValue(repo, t)
+		if err != nil {
+			fmt.Fprintf(w, "Problem: %s.%s: %s\n", t.Pkg, t.Var, err.Error())
+			continue
+		}
+		if len(value) > 0 {
+			return true
+		}
+	}
+	fmt.Fprintln(w, "Problem: all generators produced empty values, nothing would be stamped")
+	return false
+}
+
+// printDryRun prints the table of targets with the source file, the import path,
+// the variable, the generator and the value which would be injected, followed by
+// the reason of each skipped variable.
+func printDryRun(w io.Writer, repo *git.Repository, targets []Target, skipped []Skipped) {
+	if len(targets) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "FILE\tPACKAGE\tVARIABLE\tGENERATOR\tVALUE")
+		for _, t := range sortedTargets(targets) {
+			value, err := generateValue(repo, t)
+			if err == nil && !isIntType(t.Type) {
+				value, err = finishValue(t, value)
+			}
+			if err != nil {
+				value = "<error: " + err.Error() + ">"
+			} else if len(value) == 0 {
+				value = "<empty, flag skipped>"
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", stripHeadPath(t.File, rootDir), t.Pkg, t.Var, t.GenSpec(), value)
+		}
+		_ = tw.Flush()
+	} else {
+		fmt.Fprintln(w, "No targets found")
+	}
+
+	if len(skipped) > 0 {
+		fmt.Fprintln(w, "Skipped:")
+		for _, s := range skipped {
+			fmt.Fprintf(w, "  - %s.%s (%s): %s\n", s.Pkg, s.Var, stripHeadPath(s.File, rootDir), s.Reason)
+		}
+	}
 }
 
-// msg formats and prints message to STDERR if verbose mode is enabled
-func msg(s string, args ...interface{}) {
-	if verbose {
-		_, _ = fmt.Fprintf(os.Stderr, s, args...)
+// importPath converts the package directory found while scanning into the import path
+// based on the root directory and the root package. The main package is left as is.
+func importPath(pkgDir, rootDir, rootPkg string) string {
+	if pkgDir == mainPkgName {
+		return pkgDir
 	}
+	rel, err := filepath.Rel(rootDir, pkgDir)
+	if err != nil || rel == currentDir {
+		return rootPkg
+	}
+	return rootPkg + "/" + filepath.ToSlash(rel)
 }
 
 // rootPkg finds the root package of the project in the order
 // 1. try to read it from go.mod file
 // 2. extract it from the path given
+// 3. use the name of the directory
 func rootPkg(path string) (pkg string, err error) {
 	pkg, err = readPkgFromMod(path)
 	if err == nil && len(pkg) == 0 {
 		pkg = makePkgFromPath(path)
 	}
+	if err == nil && len(pkg) == 0 {
+		pkg = filepath.Base(path)
+		warn(Fields{"file": path}, "no %s found and %s is outside of GOPATH, use %s as the root package\n", goModName, path, pkg)
+	}
 	return
 }
 
@@ -275,7 +1113,7 @@ func readPkgFromMod(path string) (string, error) {
 	var pkg string
 	err = iterTextLines(file, func(line []byte) error {
 		if matches := reGoModPackage.FindSubmatch(line); len(matches) > 0 {
-			pkg = string(matches[len(matches)-1])
+			pkg = cleanModulePath(string(matches[len(matches)-1]))
 			return StopReading
 		}
 		return nil
@@ -284,10 +1122,35 @@ func readPkgFromMod(path string) (string, error) {
 	return pkg, err
 }
 
+// cleanModulePath removes the trailing comment, surrounding whitespaces and quotes from
+// the module path captured from the module directive, e.g. module "example.com/x" // comment.
+func cleanModulePath(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "`") {
+		// The quoted path may contain // so the closing quote is searched first
+		if end := strings.Index(s[1:], s[:1]); end >= 0 {
+			if unquoted, err := strconv.Unquote(s[:end+2]); err == nil {
+				return unquoted
+			}
+		}
+	}
+	if index := strings.Index(s, goModComment); index >= 0 {
+		s = s[:index]
+	}
+	return strings.TrimSpace(s)
+}
+
 // makePkgFromPath makes package from the path given and based on GOPATH env.
+// The empty string is returned if the path is not inside of any GOPATH source directory.
 func makePkgFromPath(path string) string {
-	srcPath := filepath.Join(os.Getenv(goPathEnv), "src")
-	return stripHeadPath(path, srcPath)
+	for _, goPath := range filepath.SplitList(build.Default.GOPATH) {
+		rel, err := filepath.Rel(filepath.Join(goPath, srcDirName), path)
+		if err != nil || rel == currentDir || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return filepath.ToSlash(rel)
+	}
+	return ""
 }
 
 // StopReading is the special case for text stream iterator which means stop further reading.
@@ -325,18 +1188,94 @@ func iterTextLines(reader io.ReadCloser, processor func([]byte) error) error {
 	return nil
 }
 
-// findAllTargets scans the file tree and finds locations of variables to push version info into.
-func findAllTargets(dir string) ([]Target, error) {
+// readTargetList reads targets from the file or STDIN if the path is -, one per line
+// in the form pkg.Var=gen, e.g. example.com/app/internal/info.BuildTime=time(utc=true).
+// The package is the import path or main. Empty lines and lines starting with # are ignored.
+func readTargetList(path string) ([]Target, error) {
 	var (
-		mut     sync.Mutex
-		targets []Target
-		errs    []string
-		wg      sync.WaitGroup
+		data []byte
+		err  error
 	)
-
-	pushTargets := func(t []Target) {
+	if path == stdinName {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		targets []Target
+		lineNo  int
+	)
+	err = iterTextLines(ioutil.NopCloser(bytes.NewReader(data)), func(line []byte) error {
+		lineNo++
+		s := strings.TrimSpace(string(line))
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
+			return nil
+		}
+		target, err := parseTargetLine(s)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNo, err.Error())
+		}
+		target.File = path
+		targets = append(targets, target)
+		return nil
+	})
+	return targets, err
+}
+
+// parseTargetLine parses the target in the form pkg.Var=gen.
+func parseTargetLine(s string) (Target, error) {
+	parts, err := splitOutsideParens(s, mapAssignment)
+	if err != nil {
+		return Target{}, err
+	}
+	if len(parts) != 2 {
+		return Target{}, fmt.Errorf("invalid target %s, must be pkg.Var=gen", s)
+	}
+	key := strings.TrimSpace(parts[0])
+	pkg, name := splitNameKey(key)
+	if len(pkg) == 0 || !reIdentifier.MatchString(name) {
+		return Target{}, fmt.Errorf("invalid target %s, must be pkg.Var=gen", s)
+	}
+	gen, opts, fallback, err := parseTargetSpec(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid target %s: %s", s, err.Error())
+	}
+	return Target{Var: name, Pkg: pkg, Gen: gen, Type: typeString, Key: key, Opts: opts, Fallback: fallback}, nil
+}
+
+// findAllTargets scans the file tree and finds locations of variables to push version info into.
+// Variables matching target names which cannot be used as targets are returned as skipped.
+// Test files and directories starting with dot are not scanned unless in dry-run mode
+// where they are scanned only to report variables found there as skipped.
+// Symlinks to directories outside of the tree are followed but every real directory
+// is scanned once, so links into the tree, to directories scanned already and link cycles are skipped.
+// Mappings of configuration files found in subdirectories apply to targets under the directory
+// on top of mappings of the parent directory, see nestedMappings.
+func findAllTargets(dir string) ([]Target, []Skipped, error) {
+	var (
+		mut     sync.Mutex
+		targets []Target
+		skipped []Skipped
+		errs    []string
+		wg      sync.WaitGroup
+		root    = dir
+		ctx     = buildContext()
+		start   = time.Now()
+		files   int
+		dirs    = 1
+		visited = make(map[string]bool)
+		realDir = realPath(dir)
+		dicts   = map[string]TargetMap{dir: targetDict} // Mappings of directories scanned
+	)
+
+	pushTargets := func(t []Target, s []Skipped) {
 		mut.Lock()
 		targets = append(targets, t...)
+		skipped = append(skipped, s...)
 		mut.Unlock()
 	}
 	pushErr := func(info os.FileInfo, err error) {
@@ -348,16 +1287,64 @@ func findAllTargets(dir string) ([]Target, error) {
 		}
 		mut.Unlock()
 	}
+	// visitDir marks the real path of the directory as visited and tests if it is the first visit.
+	visitDir := func(path string) bool {
+		path = realPath(path)
+		mut.Lock()
+		defer mut.Unlock()
+		if visited[path] {
+			return false
+		}
+		visited[path] = true
+		return true
+	}
+	visitDir(dir)
+	// dirMappings returns mappings of the directory, the directory must be entered already.
+	dirMappings := func(path string) TargetMap {
+		mut.Lock()
+		defer mut.Unlock()
+		return dicts[path]
+	}
 
 	var processor func(dir string, info os.FileInfo) error
 	processor = func(dir string, info os.FileInfo) error {
 		fullPath := filepath.Join(dir, info.Name())
 
+		// Resolve symlinks, dangling ones and ones to directories in the tree are skipped
+		// because the tree is scanned by real paths anyway
+		if info.Mode()&os.ModeSymlink != 0 {
+			linked, err := os.Stat(fullPath)
+			if err != nil {
+				warn(Fields{"file": fullPath}, "Skip dangling symlink %s\n", fullPath)
+				return nil
+			}
+			if linkedPath := realPath(fullPath); linked.IsDir() && isSubPath(linkedPath, realDir) {
+				msgWith(Fields{"file": fullPath}, "Skip symlink %s to %s in the tree\n", fullPath, linkedPath)
+				return nil
+			}
+			info = renamedFileInfo{FileInfo: linked, name: info.Name()}
+		}
+
 		// Launch a new directory scanner if the file is of dir type or
 		// scan for target variables if that is a *.go file.
 		if info.IsDir() {
 			// Skip parsing directories starting from dot
-			if !strings.HasPrefix(info.Name(), ".") {
+			if isExcludedDir(info.Name()) && !(dryRun && info.Name() != gitDirName) {
+				debug(Fields{"file": fullPath, "decision": "skip"}, "Skip directory %s\n", fullPath)
+			} else {
+				if !visitDir(fullPath) {
+					msgWith(Fields{"file": fullPath}, "Skip %s visited already\n", fullPath)
+					return nil
+				}
+				dict, err := nestedMappings(fullPath, dirMappings(dir))
+				if err != nil {
+					pushErr(info, err)
+					return nil
+				}
+				mut.Lock()
+				dirs++
+				dicts[fullPath] = dict
+				mut.Unlock()
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
@@ -366,11 +1353,40 @@ func findAllTargets(dir string) ([]Target, error) {
 					}
 				}()
 			}
-		} else if filepath.Ext(info.Name()) == goSourceSuffix && !strings.HasSuffix(info.Name(), goTestSuffix) {
-			if targets, err := scanTargets(fullPath); err != nil {
+		} else if filepath.Ext(info.Name()) == goSourceSuffix {
+			var reason string
+			if hasExcludedDir(fullPath, root) {
+				reason = reasonExcludedDir
+			} else if strings.HasSuffix(info.Name(), goTestSuffix) {
+				reason = reasonTestFile
+			} else if match, err := ctx.MatchFile(dir, info.Name()); err != nil {
+				pushErr(info, err)
+				return nil
+			} else if !match {
+				reason = reasonConstraints
+			}
+			if len(reason) > 0 && !dryRun {
+				debug(Fields{"file": fullPath, "decision": "skip", "reason": reason}, "Skip %s: %s\n", fullPath, reason)
+				return nil
+			}
+			debug(Fields{"file": fullPath, "decision": "scan"}, "Scan %s\n", fullPath)
+
+			mut.Lock()
+			files++
+			mut.Unlock()
+
+			if targets, skipped, err := scanTargets(fullPath, dirMappings(dir)); err != nil {
 				pushErr(info, err)
-			} else if len(targets) > 0 {
-				pushTargets(targets)
+			} else if len(reason) > 0 {
+				for i := range skipped {
+					skipped[i].Reason = reason
+				}
+				for _, t := range targets {
+					skipped = append(skipped, Skipped{Target: t, Reason: reason})
+				}
+				pushTargets(nil, skipped)
+			} else if len(targets) > 0 || len(skipped) > 0 {
+				pushTargets(targets, skipped)
 			}
 		}
 
@@ -384,12 +1400,71 @@ func findAllTargets(dir string) ([]Target, error) {
 	}
 	wg.Done()
 	wg.Wait()
+	recordStat("target scan", start, fmt.Sprintf("%d files, %d directories", files, dirs))
+
+	// Sort what is collected concurrently, so results do not depend on the order files are scanned in
+	sort.Strings(errs)
+	sort.Slice(targets, func(i, j int) bool {
+		return lessTarget(targets[i], targets[j])
+	})
+	sort.Slice(skipped, func(i, j int) bool {
+		return lessTarget(skipped[i].Target, skipped[j].Target)
+	})
 
 	// Return what we have
 	if len(errs) > 0 {
-		return nil, fmt.Errorf("failed to scan file tree\n%s", strings.Join(errs, "\n"))
+		return nil, nil, fmt.Errorf("failed to scan file tree\n%s", strings.Join(errs, "\n"))
+	}
+	return targets, skipped, nil
+}
+
+// realPath returns the path with symlinks resolved or the path itself if it cannot be resolved.
+func realPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// isSubPath tests if the path is the directory given or is inside it.
+func isSubPath(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// renamedFileInfo is the info of the file a symlink points to with the name of the symlink.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name returns the name of the symlink.
+func (fi renamedFileInfo) Name() string {
+	return fi.name
+}
+
+// buildContext returns the build context of the target platform given with -goos and -goarch
+// which is used to evaluate build constraints of source files.
+func buildContext() build.Context {
+	ctx := build.Default
+	ctx.GOOS = targetOS
+	ctx.GOARCH = targetArch
+	return ctx
+}
+
+// isExcludedDir tests if the directory with the name given should not be scanned.
+func isExcludedDir(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// hasExcludedDir tests if any directory in the path below the root is excluded.
+func hasExcludedDir(path, root string) bool {
+	for _, name := range strings.Split(stripHeadPath(filepath.Dir(path), root), string(filepath.Separator)) {
+		if isExcludedDir(name) {
+			return true
+		}
 	}
-	return targets, nil
+	return false
 }
 
 // scanDir iterates over all files in the directory and runs the processor on the each.
@@ -419,35 +1494,167 @@ func scanDir(path string, processor func(string, os.FileInfo) error) error {
 	return nil
 }
 
-// scanTargets scans the file for target variables.
-func scanTargets(path string) ([]Target, error) {
-	var targets []Target
-
-	// Build the AST of the file
-	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.DeclarationErrors)
+// nestedMappings returns mappings of the directory which are ones of the parent directory
+// with mappings of the configuration file in the directory on top, so the deepest mapping
+// of the variable wins. Overrides are reported in verbose mode. Only mappings of the nested
+// configuration file are used, directives are ignored. With -no-config the parent ones are returned.
+func nestedMappings(dir string, parent TargetMap) (TargetMap, error) {
+	if noConfig {
+		return parent, nil
+	}
+	path, err := findDirConfigFile(dir)
+	if err != nil || len(path) == 0 {
+		return parent, err
+	}
+	conf, err := readConfigData(path)
 	if err != nil {
 		return nil, err
 	}
+	msgWith(Fields{"file": path}, "Apply mappings of %s under %s\n", path, dir)
+
+	names := make([]string, 0, len(conf.Targets))
+	for name := range conf.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := make(TargetMap, len(parent)+len(conf.Targets))
+	m.CopyFrom(parent)
+	for _, name := range names {
+		gen := conf.Targets[name]
+		if prev, ok := m[name]; ok && prev != gen {
+			msgWith(Fields{"target": name, "generator": gen, "file": path},
+				"Mapping %s = %s of %s overrides %s under %s\n", name, gen, path, prev, dir)
+		}
+		m[name] = gen
+	}
+	return m, nil
+}
+
+// scanTargets scans the file for target variables with mappings given.
+// Variables with known names which cannot be targets are returned as skipped.
+func scanTargets(path string, dict TargetMap) ([]Target, []Skipped, error) {
+	var (
+		targets []Target
+		skipped []Skipped
+	)
+
+	// Read the source and skip files which cannot contain targets at all
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !mayContainTargets(src, dict) {
+		debug(Fields{"file": path, "decision": "skip"}, "Skip %s: no mapped names or annotations\n", path)
+		return nil, nil, nil
+	}
+
+	// Build the AST of the file with comments which can annotate targets
+	file, err := parser.ParseFile(token.NewFileSet(), path, src, parser.DeclarationErrors|parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The package is located by the directory of the file, except the main package which
+	// the linker always names main. The directory is converted into the import path later.
+	// Qualified mappings match either the import path of the directory or the main package.
+	pkg := filepath.Dir(path)
+	dirPkg := importPath(pkg, rootDir, rootPackage)
+	if file.Name.Name == mainPkgName {
+		pkg = mainPkgName
+	}
 
 	// Find the targets through the top-level declarations and
-	// add to found targets all variables with known names.
-	for _, val := range onlyStringValues(onlyVarDecls(file.Decls)) {
-		for _, name := range val.Names {
-			if gen := findNameGen(name.Name); len(gen) > 0 {
-				pkg := filepath.Join(
-					filepath.Dir(filepath.Dir(path)), // remove the 2nd last dir name
-					file.Name.Name,                   // and replace it with the package name
-				)
-				targets = append(targets, Target{
-					Var: name.Name,
-					Pkg: pkg,
-					Gen: gen,
-				})
+	// add to found targets all variables with known names or annotated with //goxver:gen.
+	// Each name of the spec like var A, B string is matched independently and
+	// variables with known names of types which cannot be stamped are remembered as skipped.
+	for _, val := range onlyValues(onlyVarDecls(file.Decls)) {
+		annotation, err := findAnnotation(val)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, name := range val.Names {
+			typ := valueType(val, i)
+			key, spec := findNameGen(dict, name.Name, pkg, dirPkg)
+			if len(annotation) > 0 {
+				key, spec = annotationPrefix+annotation, annotation
+			}
+			if len(spec) == 0 {
+				continue
+			}
+			debug(Fields{"file": path, "target": name.Name, "rule": key, "decision": "match"}, "Match %s in %s by %s\n", name.Name, path, key)
+			gen, opts, fallback, err := parseTargetSpec(spec)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			target := Target{
+				Var:      name.Name,
+				Pkg:      pkg,
+				Gen:      gen,
+				File:     path,
+				Type:     typ,
+				Key:      key,
+				Opts:     opts,
+				Fallback: fallback,
+			}
+			if typ == typeString || (isIntType(typ) && isNumericGen(gen)) {
+				targets = append(targets, target)
+			} else if isIntType(typ) {
+				skipped = append(skipped, Skipped{Target: target, Reason: reasonNotNumericGen})
+			} else {
+				skipped = append(skipped, Skipped{Target: target, Reason: reasonNotString})
+			}
+		}
+	}
+
+	return targets, skipped, nil
+}
+
+// findAnnotation returns the generator the variable spec is annotated with in the doc comment
+// or the line comment, e.g. var Revision string //goxver:hash_long, or the empty string.
+func findAnnotation(val *ast.ValueSpec) (string, error) {
+	for _, group := range []*ast.CommentGroup{val.Doc, val.Comment} {
+		if group == nil {
+			continue
+		}
+		for _, c := range group.List {
+			if !strings.HasPrefix(c.Text, annotationPrefix) {
+				continue
 			}
+			gen := strings.TrimSpace(c.Text[len(annotationPrefix):])
+			if _, _, _, err := parseTargetSpec(gen); err != nil {
+				return "", fmt.Errorf("invalid annotation %s: %s", c.Text, err.Error())
+			}
+			return gen, nil
 		}
 	}
+	return "", nil
+}
+
+// isAnnotation tests if the target key is the annotation rather than the mapping key.
+func isAnnotation(key string) bool {
+	return strings.HasPrefix(key, annotationPrefix)
+}
 
-	return targets, nil
+// mayContainTargets does the cheap test if the source mentions any of known target names
+// or annotations. The test is case insensitive as well as findNameGen is, so false positives
+// are possible but false negatives are not.
+func mayContainTargets(src []byte, dict TargetMap) bool {
+	if bytes.Contains(src, []byte(annotationPrefix)) {
+		return true
+	}
+	lowerSrc := bytes.ToLower(src)
+	for key := range dict {
+		_, name := splitNameKey(key)
+		if index := strings.IndexAny(name, globSpecials); index >= 0 {
+			name = name[:index]
+		}
+		if bytes.Contains(lowerSrc, []byte(strings.ToLower(name))) {
+			return true
+		}
+	}
+	return false
 }
 
 // onlyVarDecls filters the list of declarations leaving only GenDecl of VAR type.
@@ -462,36 +1669,141 @@ func onlyVarDecls(decls []ast.Decl) (vars []*ast.GenDecl) {
 	return
 }
 
-// onlyStringValues flatten the list of variable declarations leaving only string variables.
-func onlyStringValues(decls []*ast.GenDecl) (values []*ast.ValueSpec) {
+// onlyValues flatten the list of variable declarations leaving only value specs.
+// The doc comment of the declaration without parentheses is the doc comment of its only spec.
+func onlyValues(decls []*ast.GenDecl) (values []*ast.ValueSpec) {
 	for _, decl := range decls {
 		for _, spec := range decl.Specs {
 			// Ignore non-value specs
-			val, ok := spec.(*ast.ValueSpec)
-			if !ok {
-				continue
-			}
-			// Leave only string variables
-			if ident, ok := val.Type.(*ast.Ident); ok {
-				if ident.Name == typeString {
-					values = append(values, val)
+			if val, ok := spec.(*ast.ValueSpec); ok {
+				if val.Doc == nil && !decl.Lparen.IsValid() {
+					val.Doc = decl.Doc
 				}
+				values = append(values, val)
 			}
 		}
 	}
 	return
 }
 
-// findNameGen returns the generator class for the name if it's known.
-func findNameGen(name string) string {
-	for key, value := range targetDict {
-		if strings.EqualFold(key, name) {
-			return value
+// valueType returns the name of the type of the variable with the index in the spec if the type
+// is the plain identifier like string or int. If the type is omitted it is inferred from
+// the basic literal initializer, e.g. var Version = "dev". Otherwise it returns the empty string.
+func valueType(val *ast.ValueSpec, index int) string {
+	if val.Type != nil {
+		if ident, ok := val.Type.(*ast.Ident); ok {
+			return ident.Name
+		}
+		return ""
+	}
+
+	if index < len(val.Values) {
+		if lit, ok := val.Values[index].(*ast.BasicLit); ok {
+			switch lit.Kind {
+			case token.STRING:
+				return typeString
+			case token.INT:
+				return typeInt
+			}
 		}
 	}
 	return ""
 }
 
+// isIntType tests if the type name is the integer type which numeric generators can stamp.
+func isIntType(typ string) bool {
+	return typ == typeInt || typ == typeInt64
+}
+
+// findNameGen returns the key of mappings matching the name of the variable declared in
+// any of the packages given and the generator class for it if it's known.
+func findNameGen(dict TargetMap, name string, pkgs ...string) (key, gen string) {
+	if key = findNameKey(dict, name, pkgs...); len(key) > 0 {
+		return key, dict[key]
+	}
+	return "", ""
+}
+
+// findNameKey returns the key of mappings matching the name of the variable declared in
+// any of the packages given or the empty string.
+// The key matches the name exactly or, if it contains * or ?, as the glob with path.Match
+// semantics, e.g. Build*. Matching is case insensitive unless -case-sensitive is given.
+// The qualified key pkg.Var matches only variables of the package and takes precedence
+// over bare names, then the exact match takes precedence and the longest pattern wins among globs.
+func findNameKey(dict TargetMap, name string, pkgs ...string) string {
+	var (
+		found      string
+		foundRank  int
+		foundWidth int
+	)
+	for key := range dict {
+		pkg, pattern := splitNameKey(key)
+		rank := 1
+		if len(pkg) > 0 {
+			if !containsString(pkgs, resolveKeyPkg(pkg)) {
+				continue
+			}
+			rank += 2
+		}
+
+		var width int
+		if !isGlobName(pattern) {
+			if !equalNames(pattern, name) {
+				continue
+			}
+			rank++
+		} else {
+			subject := name
+			if !caseSensitive {
+				pattern, subject = strings.ToLower(pattern), strings.ToLower(name)
+			}
+			if ok, _ := path.Match(pattern, subject); !ok {
+				continue
+			}
+			width = len(pattern)
+		}
+
+		if rank > foundRank || (rank == foundRank && (width > foundWidth || (width == foundWidth && key < found))) {
+			found, foundRank, foundWidth = key, rank, width
+		}
+	}
+	return found
+}
+
+// equalNames tests if names are equal, case insensitive unless -case-sensitive is given.
+func equalNames(a, b string) bool {
+	if caseSensitive {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+// isGlobName tests if the name in the mapping key is the glob pattern.
+func isGlobName(name string) bool {
+	return strings.ContainsAny(name, nameWildcards)
+}
+
+// splitNameKey splits the mapping key into the package and the name of the variable.
+// The package is empty if the key is not qualified, e.g. Version.
+func splitNameKey(key string) (pkg, name string) {
+	if index := strings.LastIndex(key, pkgVarSeparator); index >= 0 {
+		return key[:index], key[index+len(pkgVarSeparator):]
+	}
+	return "", key
+}
+
+// resolveKeyPkg makes the import path of the package in the qualified mapping key.
+// The package relative to the root package starts with ./, e.g. ./internal/info.
+func resolveKeyPkg(pkg string) string {
+	if pkg == currentDir {
+		return rootPackage
+	}
+	if strings.HasPrefix(pkg, relativePkgPrefix) {
+		return rootPackage + "/" + path.Clean(pkg[len(relativePkgPrefix):])
+	}
+	return pkg
+}
+
 // stripHeadPath removes from the path the same heading path.
 func stripHeadPath(path, heading string) string {
 	if index := strings.Index(path, heading); index >= 0 {
@@ -507,40 +1819,311 @@ func stripHeadPath(path, heading string) string {
 	return path
 }
 
-// generateLDFlags generates LDFLAGS for targets found with the git repository info.
-func generateLDFlags(repo *git.Repository, targets []Target) (string, error) {
-	flags := make([]string, 0, len(targets))
-	for _, target := range targets {
-		var (
-			value string
-			err   error
-		)
-		switch target.Gen {
-		case GenVersion:
-			value, err = readGitLatestVersion(repo)
-		case GenTag:
-			value, err = readGitLatestTag(repo)
-		case GenHashShort, GenHashLong:
-			if value, err = readGitHEAD(repo); err == nil {
-				if target.Gen == GenHashShort {
-					value = value[:7]
-				}
+// TargetValue is the target with the value stamped into it.
+type TargetValue struct {
+	Target
+	Value string
+}
+
+// generateTargetValues generates values of targets once for all outputs of the run, so -X flags,
+// the manifest and other outputs always have the same values. Targets are sorted by package and variable
+// first, so values are in the same order on every run whatever order targets were found in. The variable
+// found more than once gets the value of the first target in that order. Targets with the same generator,
+// options and fallback share the value, so e.g. two time targets never differ. Every value is finished
+// with finishValue except values of integer targets, which are numbers stamped as is.
+func generateTargetValues(repo *git.Repository, targets []Target) ([]TargetValue, error) {
+	values := make([]TargetValue, 0, len(targets))
+	generated := make(map[string]string)
+	seen := make(map[string]bool, len(targets))
+	for _, target := range sortedTargets(targets) {
+		name := target.Pkg + "." + target.Var
+		if seen[name] {
+			msgWith(Fields{"file": target.File, "target": name}, "Skip duplicate %s in %s\n", name, target.File)
+			continue
+		}
+		seen[name] = true
+
+		value, ok := generated[target.GenSpec()]
+		if !ok {
+			var err error
+			if value, err = generateValue(repo, target); err != nil {
+				return nil, err
 			}
-		case GenTime:
-			value = generateTime()
+			generated[target.GenSpec()] = value
 		}
-		if err != nil {
-			return "", err
+		if !isIntType(target.Type) {
+			var err error
+			if value, err = finishValue(target, value); err != nil {
+				return nil, err
+			}
 		}
-		if len(value) > 0 {
-			flags = append(flags, fmt.Sprintf("-X %s.%s=%s", target.Pkg, target.Var, value))
+		values = append(values, TargetValue{Target: target, Value: value})
+	}
+	return values, nil
+}
+
+// finishValue makes the value stamped from the generated one. Affixes are put around the non-empty value,
+// the empty one is replaced with the placeholder given with -empty, and then the value is sanitized.
+func finishValue(target Target, value string) (string, error) {
+	name := target.Pkg + "." + target.Var
+	if len(target.Var) == 0 {
+		name = target.Gen
+	}
+
+	value = affixValue(target, value)
+	if len(value) == 0 && len(emptyPlaceholder) > 0 {
+		msgWith(Fields{"target": name, "generator": target.GenSpec()}, "Use placeholder %s for empty %s\n", emptyPlaceholder, name)
+		value = emptyPlaceholder
+	}
+	if clean, modified := sanitizeValue(value); modified {
+		if failOnSanitize {
+			return "", fmt.Errorf("value %q of %s contains control characters or invalid UTF-8", value, name)
+		}
+		warn(Fields{"target": name, "generator": target.GenSpec()}, "value %q of %s is sanitized to %q\n", value, name, clean)
+		value = clean
+	}
+	return value, nil
+}
+
+// linkerValues drops values of integer targets, which the linker cannot set, with the warning
+// pointing to -emit-go. The integer variable mapped explicitly with -m is the usage error instead,
+// see intTargetError.
+func linkerValues(values []TargetValue) ([]TargetValue, error) {
+	kept := make([]TargetValue, 0, len(values))
+	for _, v := range values {
+		if !isIntType(v.Type) {
+			kept = append(kept, v)
+			continue
+		}
+		if targetSources[v.Key] == SourceFlag {
+			return nil, intTargetError(v.Target)
+		}
+		warn(Fields{"file": v.File, "target": v.Pkg + "." + v.Var}, "%s.%s in %s is %s and skipped; the linker sets only string variables, stamp it with -emit-go\n",
+			v.Pkg, v.Var, stripHeadPath(v.File, rootDir), v.Type)
+	}
+	return kept, nil
+}
+
+// generateLDFlags makes assignments of linker -X flags in the form pkg.Var=value from values
+// of targets. Targets with empty values are omitted, so are integer targets the linker cannot set.
+func generateLDFlags(values []TargetValue) []string {
+	assigns := make([]string, 0, len(values))
+	for _, v := range values {
+		if len(v.Value) > 0 && !isIntType(v.Type) {
+			assigns = append(assigns, fmt.Sprintf("%s.%s=%s", v.Pkg, v.Var, v.Value))
+		}
+	}
+	return assigns
+}
+
+// intTargetError is the usage error of the integer target mapped explicitly with -m for the output of -X flags.
+// The linker sets only string variables, so integer targets can be stamped only with the Go source -emit-go generates.
+func intTargetError(target Target) error {
+	return withCode(ExitUsage, fmt.Errorf("%s.%s in %s is %s; the linker sets only string variables, stamp it with -emit-go",
+		target.Pkg, target.Var, stripHeadPath(target.File, rootDir), target.Type))
+}
+
+// sanitizeValue strips control characters, e.g. line breaks, tabs and NULs, and bytes which
+// are not valid UTF-8 from the value. It reports whether the value was modified.
+func sanitizeValue(s string) (string, bool) {
+	var sb strings.Builder
+	modified := false
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || unicode.IsControl(r) {
+			modified = true
+		} else {
+			sb.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	if !modified {
+		return s, false
+	}
+	return sb.String(), true
+}
+
+// generateValue generates the value for the target with its generator.
+// The value is never quoted, quoting is up to the output format.
+func generateValue(repo *git.Repository, target Target) (string, error) {
+	start := time.Now()
+	value, err := generateRawValue(repo, target.Gen, target.Opts)
+	err = withCode(ExitGit, err)
+	if err == nil && len(value) == 0 && len(target.Fallback) > 0 {
+		msgWith(Fields{"target": target.Pkg + "." + target.Var, "generator": target.GenSpec(), "fallback": target.Fallback},
+			"Use fallback %s of %s generator for %s.%s\n", target.Fallback, target.Gen, target.Pkg, target.Var)
+		value = target.Fallback
+	}
+	if len(target.Var) == 0 {
+		recordStat("generator "+target.GenSpec(), start, "")
+	} else {
+		recordStat("generator "+target.GenSpec(), start, target.Pkg+"."+target.Var)
+	}
+	if err == nil && len(target.Var) > 0 {
+		msgWith(Fields{"target": target.Pkg + "." + target.Var, "generator": target.GenSpec(), "duration": time.Since(start).String()},
+			"Generated %s.%s with %s generator\n", target.Pkg, target.Var, target.GenSpec())
+	}
+	return value, err
+}
+
+// generateRawValue generates the value with the generator and options given. The value is never quoted.
+func generateRawValue(repo *git.Repository, gen string, opts GenOptions) (value string, err error) {
+	defer func() {
+		if err == nil {
+			value = applyGenOptions(value, opts)
+		}
+	}()
+
+	name, param := splitGen(gen)
+	switch name {
+	case GenVersion:
+		value, err = readGitLatestVersion(repo)
+	case GenTag:
+		value, err = readGitLatestTag(repo)
+	case GenHashShort, GenHashLong, GenHash:
+		if value, err = readGitHEAD(repo); err == nil {
+			if name == GenHashShort {
+				value = value[:shortHashLength]
+			} else if name == GenHash && len(param) > 0 {
+				n, _ := strconv.Atoi(param)
+				value = value[:n]
+			}
+		}
+	case GenTime:
+		value = generateTime(opts)
+	case GenCommitCount:
+		value, err = readGitCommitCount(repo)
+	case GenTimestamp:
+		value = strconv.FormatInt(time.Now().Unix(), 10)
+	case GenGOOS:
+		value = targetOS
+	case GenGOARCH:
+		value = targetArch
+	case GenHost:
+		value = readHostname()
+	case GenUser:
+		value = readUsername()
+	case GenAheadBehind:
+		value, err = readGitAheadBehind(repo)
+	case GenNextPatch, GenNextMinor, GenNextMajor:
+		value, err = readGitNextVersion(repo, name)
+	case GenExec:
+		// The command failure is not the git failure
+		value, err = runCommand(param)
+		err = withCode(ExitFail, err)
+	case GenEnv:
+		value = readEnv(param)
+	case GenCommitter, GenCommitterEmail:
+		var commit *object.Commit
+		if commit, err = readGitHEADCommit(repo); err == nil {
+			if name == GenCommitter {
+				value = commit.Committer.Name
+			} else {
+				value = commit.Committer.Email
+			}
+		}
+	case GenRootHash:
+		value, err = readGitRootHash(repo)
+	case GenSigned:
+		var commit *object.Commit
+		if commit, err = readGitHEADCommit(repo); err == nil {
+			value = strconv.FormatBool(len(commit.PGPSignature) > 0)
+		}
+	case GenPseudo:
+		value, err = readGitPseudoVersion(repo)
+	case GenTreeHash:
+		value, err = readGitTreeHash(repo)
+	case GenOnTag:
+		var onTag bool
+		if onTag, err = readGitOnVersionTag(repo); err == nil {
+			value = strconv.FormatBool(onTag)
+		}
+	}
+	return
+}
+
+// execTimeout is the time commands of exec generators may run, tests shorten it.
+var execTimeout = 10 * time.Second
+
+// runCommand runs the command in the repository directory and returns its output with
+// surrounding whitespaces trimmed. Arguments are split by whitespaces and can be quoted.
+// The command which exits with non-zero code or runs longer than execTimeout fails.
+func runCommand(command string) (string, error) {
+	args, err := splitLDFlags(command)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = repoDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("command %s timed out after %s", command, execTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return "", fmt.Errorf("command %s failed: %s: %s", command, err.Error(), msg)
 		}
+		return "", fmt.Errorf("command %s failed: %s", command, err.Error())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// readEnv returns the value of the environment variable or the empty string with the warning
+// if it is not set.
+func readEnv(name string) string {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		warn(Fields{"generator": GenEnv, "env": name}, "environment variable %s is not set\n", name)
+	}
+	return value
+}
+
+// Lookups of the build host and the current user, tests replace them
+var (
+	lookupHostname = os.Hostname
+	lookupUser     = user.Current
+)
+
+// readHostname returns the name of the build host or the empty string if it is
+// suppressed for reproducible builds or cannot be found.
+func readHostname() string {
+	if reproducible {
+		return ""
+	}
+	name, err := lookupHostname()
+	if err != nil {
+		warn(Fields{"generator": GenHost}, "failed to get host name: %s\n", err.Error())
+		return ""
 	}
+	return name
+}
 
-	return strings.Join(flags, " "), nil
+// readUsername returns the name of the current user or the empty string if it is
+// suppressed for reproducible builds or cannot be found.
+func readUsername() string {
+	if reproducible {
+		return ""
+	}
+	u, err := lookupUser()
+	if err != nil {
+		warn(Fields{"generator": GenUser}, "failed to get current user: %s\n", err.Error())
+		return ""
+	}
+	return u.Username
 }
 
 // readGitLatestVersion returns the newest version tag from the git repository.
+// The repository without version tags is not an error, the value is the one given with
+// -default-version then, which is empty by default, so targets of the version are omitted from the output.
 func readGitLatestVersion(repo *git.Repository) (string, error) {
 	tags, err := repo.Tags()
 	if err != nil {
@@ -554,59 +2137,448 @@ func readGitLatestVersion(repo *git.Repository) (string, error) {
 		return "", err
 	}
 	if len(versions) > 0 {
+		if calver {
+			return versions[0].Tag, nil
+		}
 		return versions[0].String(), nil
 	}
-	return "", nil
+	return defaultVersion, nil
 }
 
-// readGitLatestTag returns the latest tag from the git repository.
-func readGitLatestTag(repo *git.Repository) (string, error) {
+// readGitNextVersion returns the newest version tag from the git repository with the number
+// the generator given increments. Lower numbers are reset and anything after the number, e.g.
+// pre-release and build metadata, is dropped. The empty string is returned if no version is tagged.
+func readGitNextVersion(repo *git.Repository, gen string) (string, error) {
 	tags, err := repo.Tags()
 	if err != nil {
 		return "", err
 	}
 	defer tags.Close()
 
-	ref, err := tags.Next()
-	if err != nil {
-		if err == io.EOF {
-			err = nil
-		}
+	versions, err := versionsFromTags(tags)
+	if err != nil || len(versions) == 0 {
 		return "", err
 	}
-	if ref != nil {
-		return quoteValue(ref.Name().Short()), nil
-	}
 
-	return "", nil
+	next := versions[0]
+	switch gen {
+	case GenNextPatch:
+		next.Build++
+	case GenNextMinor:
+		next.Minor++
+		next.Build = 0
+	case GenNextMajor:
+		next.Major++
+		next.Minor, next.Build = 0, 0
+	}
+	return next.String(), nil
 }
 
-// readGitHEAD returns the hash of the HEAD of the git repository.
-func readGitHEAD(repo *git.Repository) (string, error) {
+// readGitPseudoVersion returns the Go module pseudo-version of the HEAD commit following the rules
+// of the go command. The base is the newest vX.Y.Z[-pre] tag of HEAD's history, so the version is
+// - vX.Y.(Z+1)-0.TIME-HASH after the release tag vX.Y.Z,
+// - vX.Y.Z-pre.0.TIME-HASH after the pre-release tag vX.Y.Z-pre,
+// - v0.0.0-TIME-HASH without tags,
+// where TIME is the UTC commit time and HASH is 12 characters of the commit hash.
+// The tag itself is returned when HEAD is exactly at the newest tag.
+func readGitPseudoVersion(repo *git.Repository) (string, error) {
 	head, err := repo.Head()
 	if err != nil {
 		return "", err
 	}
-	return head.Hash().String(), nil
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	reachable, err := readGitReachable(repo, head.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", err
+	}
+	defer tags.Close()
+
+	// Find the newest semantic version tag of commits HEAD descends from, pre-releases
+	// are ordered by semantic versioning rules, see comparePreRelease
+	var (
+		base     string
+		baseVer  Version
+		basePre  string
+		baseHash plumbing.Hash
+	)
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		name, ok := tagName(ref)
+		if !ok {
+			return nil
+		}
+		m := reSemver.FindStringSubmatch(name)
+		if m == nil {
+			return nil
+		}
+
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				return err
+			}
+			hash = commit.Hash
+		} else if err != plumbing.ErrObjectNotFound {
+			return err
+		}
+		if !reachable[hash] {
+			return nil
+		}
+
+		v := parseVersion(m[1] + versionSeparator + m[2] + versionSeparator + m[3])
+		newer := len(base) == 0 || baseVer.Less(v)
+		if !newer && v == baseVer {
+			newer = comparePreRelease(m[4], basePre) > 0
+		}
+		if newer {
+			base, baseVer, basePre, baseHash = name, v, m[4], hash
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	suffix := commit.Committer.When.UTC().Format(pseudoTimeFormat) + "-" + head.Hash().String()[:pseudoHashLength]
+	if len(base) == 0 {
+		return "v0.0.0-" + suffix, nil
+	}
+	if baseHash == head.Hash() {
+		return base, nil
+	}
+
+	if len(basePre) > 0 {
+		return fmt.Sprintf("v%d.%d.%d-%s.0.%s", baseVer.Major, baseVer.Minor, baseVer.Build, basePre, suffix), nil
+	}
+	return fmt.Sprintf("v%d.%d.%d-0.%s", baseVer.Major, baseVer.Minor, baseVer.Build+1, suffix), nil
+}
+
+// comparePreRelease compares pre-release parts of versions of the same number by semantic versioning
+// rules and returns -1, 0 or 1. The release, that is the empty pre-release, goes after any pre-release.
+// Dot separated identifiers are compared one by one, numeric ones numerically and lower than
+// alphanumeric ones, and the shorter list of equal identifiers goes first, so rc.9 < rc.10 < rc.10.1.
+func comparePreRelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case len(a) == 0:
+		return 1
+	case len(b) == 0:
+		return -1
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		if x == y {
+			continue
+		}
+		xNum, yNum := isNumericIdentifier(x), isNumericIdentifier(y)
+		switch {
+		case xNum && yNum:
+			// Numbers without leading zeros are ordered by length first, so no overflow is possible
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return compareInts(len(x), len(y))
+			}
+			return strings.Compare(x, y)
+		case xNum:
+			return -1
+		case yNum:
+			return 1
+		default:
+			return strings.Compare(x, y)
+		}
+	}
+	return compareInts(len(as), len(bs))
+}
+
+// isNumericIdentifier tests if the pre-release identifier consists of digits only.
+func isNumericIdentifier(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// compareInts returns -1, 0 or 1 as a is less than, equal to or greater than b.
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// readGitLatestTag returns the latest tag from the git repository
+// or the empty string without error if there are no tags.
+// With -tag-prefix only tags with the prefix are considered and the prefix is stripped.
+func readGitLatestTag(repo *git.Repository) (string, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", err
+	}
+	defer tags.Close()
+
+	for {
+		ref, err := tags.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return "", err
+		}
+		if name, ok := tagName(ref); ok {
+			return name, nil
+		}
+	}
+}
+
+// tagName returns the short name of the tag with the prefix given with -tag-prefix stripped.
+// Tags without the prefix or which full short names do not match -tag-filter are not accepted.
+func tagName(ref *plumbing.Reference) (string, bool) {
+	name := ref.Name().Short()
+	if !strings.HasPrefix(name, tagPrefix) {
+		return "", false
+	}
+	if reTagFilter != nil && !reTagFilter.MatchString(name) {
+		return "", false
+	}
+	return name[len(tagPrefix):], true
+}
+
+// readGitOnVersionTag tests if HEAD is exactly at any version tag of the git repository.
+// Both lightweight and annotated tags are understood.
+func readGitOnVersionTag(repo *git.Repository) (bool, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return false, err
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return false, err
+	}
+	defer tags.Close()
+
+	var onTag bool
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		if name, ok := tagName(ref); !ok || !reVersion.MatchString(name) {
+			return nil
+		}
+
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				return err
+			}
+			hash = commit.Hash
+		} else if err != plumbing.ErrObjectNotFound {
+			return err
+		}
+
+		if hash == head.Hash() {
+			onTag = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return onTag, err
+}
+
+// readGitTreeHash returns the hash of the tree of the HEAD commit of the git repository.
+func readGitTreeHash(repo *git.Repository) (string, error) {
+	commit, err := readGitHEADCommit(repo)
+	if err != nil {
+		return "", err
+	}
+	return commit.TreeHash.String(), nil
+}
+
+// readGitRootHash returns the hash of the initial commit, the one without parents, reachable
+// from the HEAD of the git repository. Merged histories can have several initial commits,
+// then the oldest by the commit time is taken.
+func readGitRootHash(repo *git.Repository) (string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+
+	commits, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return "", err
+	}
+	defer commits.Close()
+
+	var root *object.Commit
+	err = commits.ForEach(func(c *object.Commit) error {
+		if c.NumParents() > 0 {
+			return nil
+		}
+		if root == nil || c.Committer.When.Before(root.Committer.When) ||
+			(c.Committer.When.Equal(root.Committer.When) && c.Hash.String() < root.Hash.String()) {
+			root = c
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if root == nil {
+		return "", fmt.Errorf("no initial commit found")
+	}
+	return root.Hash.String(), nil
+}
+
+// readGitHEADCommit returns the commit object the HEAD of the git repository points to.
+func readGitHEADCommit(repo *git.Repository) (*object.Commit, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(head.Hash())
+}
+
+// readGitHEAD returns the hash of the HEAD of the git repository.
+func readGitHEAD(repo *git.Repository) (string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+// readGitCommitCount returns the number of commits reachable from the HEAD of the git repository.
+func readGitCommitCount(repo *git.Repository) (string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+
+	commits, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return "", err
+	}
+	defer commits.Close()
+
+	var count int
+	err = commits.ForEach(func(*object.Commit) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(count), nil
 }
 
-// generateTime formats the current time.
-func generateTime() string {
-	return time.Now().Format(timeFormat)
+// readGitAheadBehind returns the number of commits the current branch is ahead and behind
+// its upstream tracking branch in the form +A-B. The empty string is returned when
+// HEAD is detached or the branch has no upstream.
+func readGitAheadBehind(repo *git.Repository) (string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	if !head.Name().IsBranch() {
+		return "", nil
+	}
+
+	branch, err := repo.Branch(head.Name().Short())
+	if err == git.ErrBranchNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if len(branch.Remote) == 0 || len(branch.Merge) == 0 {
+		return "", nil
+	}
+
+	upstreamName := branch.Merge
+	if branch.Remote != currentDir {
+		upstreamName = plumbing.NewRemoteReferenceName(branch.Remote, branch.Merge.Short())
+	}
+	upstream, err := repo.Reference(upstreamName, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	local, err := readGitReachable(repo, head.Hash())
+	if err != nil {
+		return "", err
+	}
+	remote, err := readGitReachable(repo, upstream.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	var ahead, behind int
+	for hash := range local {
+		if !remote[hash] {
+			ahead++
+		}
+	}
+	for hash := range remote {
+		if !local[hash] {
+			behind++
+		}
+	}
+	return fmt.Sprintf("+%d-%d", ahead, behind), nil
+}
+
+// readGitReachable returns the set of commits reachable from the commit given.
+func readGitReachable(repo *git.Repository, from plumbing.Hash) (map[plumbing.Hash]bool, error) {
+	commits, err := repo.Log(&git.LogOptions{From: from})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+
+	reachable := make(map[plumbing.Hash]bool)
+	err = commits.ForEach(func(c *object.Commit) error {
+		reachable[c.Hash] = true
+		return nil
+	})
+	return reachable, err
 }
 
-// quoteValue quotes the value with double or single quotes based on the doubleQuote option.
-func quoteValue(s string) string {
-	if doubleQuote {
-		return `"` + s + `"`
+// generateTime formats the current time with the layout of the format option, timeFormat
+// by default, in UTC if the utc option is true.
+func generateTime(opts GenOptions) string {
+	now := time.Now()
+	if opts.Bool(OptUTC) {
+		now = now.UTC()
 	}
-	return "'" + s + "'"
+	layout := timeFormat
+	if format, ok := opts[OptFormat]; ok {
+		layout = format
+	}
+	return now.Format(layout)
 }
 
 // Version is a numeric representation semantic version.
+// With CalVer the major number is the year, the minor number is the month or the week.
 type Version struct {
 	Prefix              string
 	Major, Minor, Build int
+	PreRelease          string // The pre-release part after the hyphen, e.g. rc.1
+	Tag                 string // The tag the version is parsed from
 }
 
 // String composes a string representation of the version in symver format.
@@ -616,23 +2588,31 @@ func (v Version) String() string {
 
 // Less tests if the version is less than the other.
 func (v Version) Less(other Version) bool {
-	if v.Major < other.Major {
-		return true
-	} else if v.Minor < other.Minor {
-		return true
-	} else if v.Build < other.Build {
-		return true
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	} else if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	} else if v.Build != other.Build {
+		return v.Build < other.Build
 	}
-	return false
+	// The pre-release precedes the release of the same numbers
+	return len(v.PreRelease) > 0 && len(other.PreRelease) == 0
 }
 
 // parseVersion parses the strings and makes a Version instance from it.
 // The function assumes the input value is in valid symver format w/ or w/o heading v.
+// The pre-release and the build metadata are cut off before numbers are parsed.
 func parseVersion(s string) (v Version) {
 	if strings.HasPrefix(s, versionPrefix) {
 		s = s[len(versionPrefix):]
 		v.Prefix = versionPrefix
 	}
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, v.PreRelease = s[:i], s[i+1:]
+	}
 
 	parts := strings.Split(s, versionSeparator)
 	v.Major, _ = strconv.Atoi(parts[0])
@@ -646,11 +2626,19 @@ func parseVersion(s string) (v Version) {
 }
 
 // versionsFromTags makes the list of versions from the repository tags.
+// In CalVer mode only tags in the form YYYY.MM[.MICRO] or YY.MM[.MICRO] are versions,
+// they are compared as integer tuples the same way, so 2024.1.0 is newer than 2023.12.0.
 // The list returned is sorted descending.
 func versionsFromTags(tags storer.ReferenceIter) (versions []Version, err error) {
+	re := reVersion
+	if calver {
+		re = reCalVer
+	}
 	err = tags.ForEach(func(ref *plumbing.Reference) error {
-		if reVersion.MatchString(ref.Name().Short()) {
-			versions = append(versions, parseVersion(ref.Name().Short()))
+		if name, ok := tagName(ref); ok && re.MatchString(name) {
+			v := parseVersion(name)
+			v.Tag = name
+			versions = append(versions, v)
 		}
 		return nil
 	})
@@ -668,31 +2656,225 @@ func fileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// openRepo opens the git repository recording the time it takes.
+// The repository is located with $GIT_DIR and $GIT_WORK_TREE if they are set, see repoGitDirs.
+func openRepo() (*git.Repository, error) {
+	start := time.Now()
+	var (
+		repo *git.Repository
+		err  error
+	)
+	if gitDir, workTree, ok := repoGitDirs(); ok {
+		msgWith(Fields{"dir": gitDir, "worktree": workTree}, "Open git directory %s with work tree %s\n", gitDir, workTree)
+		storage := filesystem.NewStorage(osfs.New(gitDir), cache.NewObjectLRUDefault())
+		repo, err = git.Open(storage, osfs.New(workTree))
+	} else {
+		repo, err = git.PlainOpen(repoDir)
+	}
+	recordStat("repository open", start, repoDir)
+	return repo, err
+}
+
+// repoGitDirs returns the git directory and the work tree given with $GIT_DIR and $GIT_WORK_TREE,
+// relative paths are relative to the current directory as git does. If only one of them is set
+// the git directory defaults to .git and the work tree to the repository directory.
+// It returns false if neither is set, so the repository is opened the usual way.
+func repoGitDirs() (gitDir, workTree string, ok bool) {
+	gitDir, workTree = os.Getenv(gitDirEnv), os.Getenv(gitWorkTreeEnv)
+	if len(gitDir) == 0 && len(workTree) == 0 {
+		return "", "", false
+	}
+	if len(workTree) == 0 {
+		workTree = repoDir
+	} else if dir, err := filepath.Abs(workTree); err == nil {
+		workTree = dir
+	}
+	if len(gitDir) == 0 {
+		gitDir = filepath.Join(workTree, gitDirName)
+	} else if dir, err := filepath.Abs(gitDir); err == nil {
+		gitDir = dir
+	}
+	return gitDir, workTree, true
+}
+
+// repoGitDir returns the git directory of the repository, see repoGitDirs.
+func repoGitDir() string {
+	if gitDir, _, ok := repoGitDirs(); ok {
+		return gitDir
+	}
+	return filepath.Join(repoDir, gitDirName)
+}
+
 // parseTargetMapping parses the line with target to generator mapping.
-// Mapping must be in the format var=gen[,var=gen]* where
-// - var is the name of variable
+// Mapping must be in the format var[|var]*=gen[,var[|var]*=gen]* where
+// - var is the name of variable, multiple names separated by pipe get the same generator
+// - var can be qualified with the package as importpath.Var or ./relative/path.Var
+// - var containing * or ? is the case insensitive glob pattern, e.g. Build*
 // - gen is the valid name of value generator (one of ValidGens)
-// - the string can contain multiple maps separated by comma
+// - gen can be followed by options in parentheses, e.g. time(format=2006-01-02,utc=true)
+// - values can be double quoted with backslash escapes, commas and equal signs inside are literal,
+// e.g. exec:sh -c "echo a=b,c" or time(format="Jan 2, 2006")
+// - the string can contain multiple maps separated by comma outside of parentheses and quotes
+// - ${ENV} and $ENV are replaced with values of environment variables
+// Errors tell the column of the problem in the string with environment variables expanded.
 func parseTargetMapping(s string) (m TargetMap, err error) {
-	items := strings.Split(s, mapSeparator)
+	items, err := splitMapping(expandEnv(s), mapSeparator, 1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping %s: %s", s, err.Error())
+	}
 	m = make(TargetMap, len(items))
 	for _, item := range items {
-		parts := strings.Split(item, mapAssignment)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid mapping %s", item)
+		parts, err := splitMapping(item.Text, mapAssignment, item.Col)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mapping %s: %s", item.Text, err.Error())
+		}
+		switch {
+		case len(parts) < 2:
+			return nil, fmt.Errorf("invalid mapping %s: missing %s at column %d", item.Text, mapAssignment, item.Col+len(item.Text))
+		case len(parts) > 2:
+			return nil, fmt.Errorf("invalid mapping %s: unexpected %s at column %d", item.Text, mapAssignment, parts[2].Col-len(mapAssignment))
 		}
-		if !isValidGen(parts[1]) {
-			return nil, fmt.Errorf("invalid generator %s", item)
+		key, spec := parts[0], parts[1]
+		if _, _, _, err = parseTargetSpec(spec.Text); err != nil {
+			return nil, fmt.Errorf("invalid mapping %s: %s at column %d", item.Text, err.Error(), spec.Col)
+		}
+		col := key.Col
+		for _, name := range strings.Split(key.Text, mapNameSeparator) {
+			pkg, v := splitNameKey(name)
+			if len(v) == 0 || (len(pkg) == 0 && strings.Contains(name, pkgVarSeparator)) {
+				return nil, fmt.Errorf("invalid mapping %s: invalid name %s at column %d", item.Text, name, col)
+			}
+			if isGlobName(v) {
+				if _, err := path.Match(v, ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern %s in mapping %s at column %d", v, item.Text, col)
+				}
+			}
+			if prev, ok := m[name]; ok && len(pkg) > 0 && prev != spec.Text {
+				return nil, fmt.Errorf("conflicting generators %s and %s for %s", prev, spec.Text, name)
+			}
+			m[name] = spec.Text
+			col += len(name) + len(mapNameSeparator)
 		}
-		m[parts[0]] = parts[1]
 	}
 	return m, nil
 }
 
-// isValidGen tests if the name of the generator is in valid set.
+// expandEnv replaces ${ENV} and $ENV in the string with values of environment variables.
+// Variables which are not set are replaced with the empty string.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			warn(Fields{"env": name}, "environment variable %s is not set\n", name)
+		}
+		return value
+	})
+}
+
+// isValidGen tests if the name of the generator is in valid set and
+// the parameter is acceptable by the generator.
 func isValidGen(s string) bool {
+	name, param := splitGen(s)
 	for _, gen := range ValidGens {
-		if s == gen {
+		if name == gen {
+			return isValidGenParam(name, param)
+		}
+	}
+	return false
+}
+
+// isValidGenParam tests if the parameter is acceptable by the generator.
+// Generators which take no parameters accept only the empty one.
+func isValidGenParam(name, param string) bool {
+	switch name {
+	case GenHash:
+		if len(param) == 0 {
+			return true
+		}
+		n, err := strconv.Atoi(param)
+		return err == nil && n > 0 && n <= hashLength
+	case GenExec:
+		return len(strings.TrimSpace(param)) > 0
+	case GenEnv:
+		return len(param) > 0 && !strings.ContainsAny(param, mapAssignment+" \t")
+	default:
+		return len(param) == 0
+	}
+}
+
+// isNumericGen tests if the generator produces integer values.
+func isNumericGen(s string) bool {
+	name, _ := splitGen(s)
+	for _, gen := range NumericGens {
+		if name == gen {
+			return true
+		}
+	}
+	return false
+}
+
+// splitGen splits the generator into the name and the parameter, e.g. hash:12.
+func splitGen(s string) (name, param string) {
+	if index := strings.Index(s, genParamSeparator); index >= 0 {
+		return s[:index], s[index+len(genParamSeparator):]
+	}
+	return s, ""
+}
+
+// findConfigFiles returns configuration files in the order they are loaded, later ones
+// override earlier ones:
+// 1. The user configuration, see userConfigFile.
+// 2. The project configuration given with -c or found with findConfigFile.
+func findConfigFiles(projectDir, projectConfig string) ([]string, error) {
+	var paths []string
+	if path := userConfigFile(); len(path) > 0 {
+		paths = append(paths, path)
+	}
+
+	if len(projectConfig) == 0 {
+		var err error
+		if projectConfig, err = findConfigFile(projectDir); err != nil {
+			return nil, err
+		}
+	}
+	if len(projectConfig) > 0 && !sameFile(projectConfig, paths) {
+		paths = append(paths, projectConfig)
+	}
+	return paths, nil
+}
+
+// userConfigFile returns the path to the user configuration file if it exists, that is
+// $XDG_CONFIG_HOME/goxver/config, where $XDG_CONFIG_HOME is ~/.config by default, or ~/.goxver.
+func userConfigFile() string {
+	home, _ := os.UserHomeDir()
+	configHome := os.Getenv(xdgConfigHomeEnv)
+	if len(configHome) == 0 && len(home) > 0 {
+		configHome = filepath.Join(home, xdgConfigHomeDefault)
+	}
+
+	var candidates []string
+	if len(configHome) > 0 {
+		candidates = append(candidates, filepath.Join(configHome, userConfigDirName, userConfigName))
+	}
+	if len(home) > 0 {
+		candidates = append(candidates, filepath.Join(home, defaultConfigName))
+	}
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// sameFile tests if the file at the path is any of files in the list.
+func sameFile(path string, list []string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for _, other := range list {
+		if otherInfo, err := os.Stat(other); err == nil && os.SameFile(info, otherInfo) {
 			return true
 		}
 	}
@@ -700,41 +2882,120 @@ func isValidGen(s string) bool {
 }
 
 // findConfigFile searches for the config file in the directories in the follow order
-// 1. In the current directory.
-// 2. In the project directory.
+// 1. In the project directory (-d).
+// 2. In the current directory.
 // 3. In the source directory under $GOPATH.
-func findConfigFile(projectDir string) string {
+// The project directory goes first, so a stray config file in the current directory
+// does not override the project's own config when goxver is invoked from elsewhere.
+// The config file is either .goxver or .goxver.toml, having both in the same directory is an error.
+func findConfigFile(projectDir string) (string, error) {
 	dirs := []string{
-		currentDir,
 		projectDir,
+		currentDir,
 		filepath.Join(os.Getenv(goPathEnv), srcDirName),
 	}
 	for _, dir := range dirs {
-		path := filepath.Join(dir, defaultConfigName)
-		if info, err := os.Stat(path); err == nil {
-			if !info.IsDir() {
-				return path
+		if path, err := findDirConfigFile(dir); err != nil || len(path) > 0 {
+			return path, err
+		}
+	}
+	return "", nil
+}
+
+// findDirConfigFile returns the config file in the directory, either .goxver or .goxver.toml,
+// or the empty string if there is none. Having both in the same directory is an error.
+func findDirConfigFile(dir string) (string, error) {
+	var found []string
+	for _, name := range []string{defaultConfigName, tomlConfigName} {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			found = append(found, path)
+		}
+	}
+	if len(found) > 1 {
+		return "", fmt.Errorf("conflicting configuration files %s", strings.Join(found, " and "))
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	return "", nil
+}
+
+// readConfigFile reads and parses the configuration file merging mappings from the source given.
+// It returns the absolute root directory of the project if the configuration declares it.
+// The root directory is relative to the directory of the configuration file.
+func readConfigFile(path, source string) (string, error) {
+	conf, err := readConfigData(path)
+	if err != nil {
+		return "", err
+	}
+	if conf.Defaults {
+		// Defaults never override mappings of configurations loaded before
+		useDefaults = true
+		missing := make(TargetMap)
+		for name, gen := range DefaultMappings {
+			if _, ok := targetDict[name]; !ok {
+				missing[name] = gen
 			}
 		}
+		mergeMapping(missing, SourceBuiltin)
 	}
-	return ""
+	mergeMapping(conf.Targets, source)
+
+	if len(conf.TagPrefix) > 0 && !isFlagSet("tag-prefix") {
+		tagPrefix = conf.TagPrefix
+	}
+	if len(conf.TagFilter) > 0 && !isFlagSet("tag-filter") {
+		tagFilter = conf.TagFilter
+	}
+	if len(conf.Format) > 0 {
+		configFormat = conf.Format
+	}
+	if len(conf.Quote) > 0 && !isFlagSet("quote") {
+		quoteStyle = conf.Quote
+	}
+	if len(conf.ValuePrefix) > 0 && !isFlagSet("value-prefix") {
+		valuePrefix = conf.ValuePrefix
+	}
+	if len(conf.ValueSuffix) > 0 && !isFlagSet("value-suffix") {
+		valueSuffix = conf.ValueSuffix
+	}
+	if len(conf.ValueGens) > 0 && !isFlagSet("value-gens") {
+		valueGens = strings.Join(conf.ValueGens, optionSeparator)
+	}
+
+	if len(conf.Root) == 0 {
+		return "", nil
+	}
+	return resolveConfigRoot(path, conf.Root)
 }
 
-// readConfigFile reads and parses the configuration file.
-func readConfigFile(path string) error {
-	file, err := os.Open(path)
+// resolveConfigRoot makes the absolute path of the root directory declared in the configuration
+// file relative to the directory of the file. The root directory must exist.
+func resolveConfigRoot(path, root string) (string, error) {
+	dir := root
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(path), dir)
+	}
+	dir, err := filepath.Abs(dir)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer file.Close()
+	if info, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("invalid root %s: %s", root, err.Error())
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("invalid root %s: not a directory", root)
+	}
+	return dir, nil
+}
 
-	return iterTextLines(file, func(line []byte) error {
-		m, err := parseTargetMapping(string(line))
-		if err != nil {
-			return err
+// isFlagSet tests if the flag with the name is given in the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		targetDict.CopyFrom(m)
-
-		return nil
 	})
+	return set
 }
@@ -0,0 +1,2255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// mainEnv makes the test binary run main instead of tests, see runMain.
+const mainEnv = "GOXVER_TEST_MAIN"
+
+// Environment variables which change how goxver behaves and are cleared for runMain
+var testClearedEnv = []string{
+	mapEnv,
+	gitDirEnv,
+	gitWorkTreeEnv,
+	githubOutputEnv,
+	xdgConfigHomeEnv,
+	"HOME",
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs goxver with arguments in the directory and returns its STDOUT, STDERR and the exit code.
+// The environment is cleared of variables goxver reads, so no user configuration is loaded,
+// and variables given in the form NAME=value are added.
+func runMain(t *testing.T, dir string, env []string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	home, cleanup := tempDir(t)
+	defer cleanup()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	for _, kv := range os.Environ() {
+		if !containsString(testClearedEnv, strings.SplitN(kv, "=", 2)[0]) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, mainEnv+"=1", "HOME="+home)
+	cmd.Env = append(cmd.Env, env...)
+
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outBuf, &errBuf
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatalf("failed to run goxver: %s", err.Error())
+		}
+	}
+	return outBuf.String(), errBuf.String(), cmd.ProcessState.ExitCode()
+}
+
+// tempDir creates the temporary directory and returns it with the function removing it.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "goxver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks of the temporary directory, e.g. on macOS, would differ from paths goxver reports
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	return dir, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// writeFiles writes files with contents given by paths relative to the directory.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), filePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testRepo creates the git repository in the temporary directory with files committed in one commit
+// and lightweight tags pointing to it. It returns the directory, the hash of the commit and
+// the function removing the directory.
+func testRepo(t *testing.T, files map[string]string, tags ...string) (dir, hash string, cleanup func()) {
+	t.Helper()
+	dir, cleanup = tempDir(t)
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	hash = testCommit(t, repo, dir, files)
+	for _, tag := range tags {
+		testTag(t, repo, tag)
+	}
+	return dir, hash, cleanup
+}
+
+// testCommit writes files into the work tree and commits them. It returns the hash of the commit.
+func testCommit(t *testing.T, repo *git.Repository, dir string, files map[string]string) string {
+	t.Helper()
+	writeFiles(t, dir, files)
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := &object.Signature{Name: "Tester", Email: "tester@example.com", When: time.Unix(1600000000, 0)}
+	hash, err := wt.Commit("commit", &git.CommitOptions{Author: sig, Committer: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+// testTag creates the lightweight tag pointing to HEAD.
+func testTag(t *testing.T, repo *git.Repository, name string) {
+	t.Helper()
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag(name, head.Hash(), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testReset moves the current branch of the repository to the commit resetting the work tree.
+func testReset(t *testing.T, repo *git.Repository, hash string) {
+	t.Helper()
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: plumbing.NewHash(hash), Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runPrint runs goxver with -print of the generator and arguments given in the directory and returns
+// the value printed without the line break. The test fails if goxver fails.
+func runPrint(t *testing.T, dir, gen string, args ...string) string {
+	t.Helper()
+	stdout, stderr, code := runMain(t, dir, nil, append([]string{"-print", gen}, args...)...)
+	if code != ExitOk {
+		t.Fatalf("-print %s: exit code %d, STDERR %s", gen, code, stderr)
+	}
+	return strings.TrimSuffix(stdout, "\n")
+}
+
+// buildAndRun builds the main package in the directory with the go command and arguments given,
+// e.g. -ldflags, runs the binary and returns its output. The test is skipped without the go command.
+func buildAndRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command is not found")
+	}
+	bin := filepath.Join(dir, "app.bin")
+	build := exec.Command(goCmd, append(append([]string{"build", "-o", bin}, args...), ".")...)
+	build.Dir = dir
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build %v failed: %s\n%s", args, err.Error(), out)
+	}
+	out, err := exec.Command(bin).Output()
+	if err != nil {
+		t.Fatalf("%s failed: %s", bin, err.Error())
+	}
+	return string(out)
+}
+
+// testProject is the minimal module with the main package declaring Version and Commit.
+var testProject = map[string]string{
+	"go.mod":  "module example.com/app\n",
+	"main.go": "package main\n\nvar (\n\tVersion string\n\tCommit  string\n)\n\nfunc main() {}\n",
+}
+
+func TestMayContainTargets(t *testing.T) {
+	dict := TargetMap{"Version": GenVersion, "example.com/app/info.Build*": GenTime}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"package main\n\nvar Version string\n", true},
+		{"package main\n\nvar VERSION string\n", true},
+		{"package info\n\nvar BuildTime string\n", true},
+		{"package main\n\nvar Revision string //goxver:hash_long\n", true},
+		{"package main\n\nvar Commit string\n", false},
+		{"package main\n\nfunc main() {}\n", false},
+	}
+	for _, tt := range tests {
+		if got := mayContainTargets([]byte(tt.src), dict); got != tt.want {
+			t.Errorf("mayContainTargets(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestScanTargetsPrefiltered(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		"version.go": "package main\n\nvar (\n\tversion string\n\tCommit  string\n)\n",
+		"other.go":   "package main\n\nvar Other string\n",
+		"broken.go":  "package main\n\nvar Other string =\n",
+	})
+	defer func(dir, pkg string) { rootDir, rootPackage = dir, pkg }(rootDir, rootPackage)
+	rootDir, rootPackage = dir, "example.com/app"
+	dict := TargetMap{"Version": GenVersion}
+
+	targets, skipped, err := scanTargets(filepath.Join(dir, "version.go"), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Var != "version" || targets[0].Gen != GenVersion || targets[0].Pkg != mainPkgName || len(skipped) > 0 {
+		t.Errorf("targets %+v, skipped %+v", targets, skipped)
+	}
+
+	// Files without mapped names are not parsed at all, so broken ones are not errors
+	for _, name := range []string{"other.go", "broken.go"} {
+		targets, skipped, err := scanTargets(filepath.Join(dir, name), dict)
+		if err != nil || len(targets) > 0 || len(skipped) > 0 {
+			t.Errorf("%s: targets %+v, skipped %+v, error %v", name, targets, skipped, err)
+		}
+	}
+}
+
+// BenchmarkScanTargets compares scanning the file which mentions no mapped names,
+// which is only searched, with the file which is parsed.
+func BenchmarkScanTargets(b *testing.B) {
+	dir, err := ioutil.TempDir("", "goxver-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	defer func(dir, pkg string) { rootDir, rootPackage = dir, pkg }(rootDir, rootPackage)
+	rootDir, rootPackage = dir, "example.com/app"
+
+	var src strings.Builder
+	src.WriteString("package main\n\n")
+	for i := 0; i < 1000; i++ {
+		src.WriteString("func f" + strconv.Itoa(i) + "() int { return 1 + 2 }\n\nvar _ = 1\n")
+	}
+	for name, content := range map[string]string{
+		"none.go":   src.String(),
+		"target.go": src.String() + "\nvar Version string\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), filePerm); err != nil {
+			b.Fatal(err)
+		}
+	}
+	dict := TargetMap{"Version": GenVersion}
+
+	for _, name := range []string{"none.go", "target.go"} {
+		path := filepath.Join(dir, name)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := scanTargets(path, dict); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintGenerators(t *testing.T) {
+	var buf bytes.Buffer
+	printGenerators(&buf)
+	lines := strings.Split(buf.String(), "\n")
+	for _, gen := range ValidGens {
+		desc := GenDescriptions[gen]
+		if len(desc) == 0 {
+			t.Errorf("%s has no description", gen)
+			continue
+		}
+		found := false
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[0] == gen && strings.Contains(line, desc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s is not listed with its description", gen)
+		}
+	}
+	if len(GenDescriptions) != len(ValidGens) {
+		t.Errorf("%d descriptions for %d generators", len(GenDescriptions), len(ValidGens))
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	want := "goxver " + goxverVersion + " (commit " + goxverCommit + ", built " + goxverBuildTime + ")\n"
+
+	// Neither the project directory, the mapping nor the repository are processed
+	for _, args := range [][]string{
+		{"-version", "-d", filepath.Join(dir, "missing"), "-m", "Version=unknown"},
+		{cmdVersion},
+	} {
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if code != ExitOk || stdout != want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", args, code, stdout, want, stderr)
+		}
+	}
+}
+
+func TestScanTargetsMultipleNames(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		"info/info.go": "package info\n\nvar Version, Build string\n\nvar Commit, Count = \"\", 0\n",
+	})
+	defer func(dir, pkg string) { rootDir, rootPackage = dir, pkg }(rootDir, rootPackage)
+	rootDir, rootPackage = dir, "example.com/app"
+	path := filepath.Join(dir, "info", "info.go")
+	pkg := filepath.Join(dir, "info")
+
+	tests := []struct {
+		name    string
+		dict    TargetMap
+		want    []string
+		skipped []string
+	}{
+		{"both", TargetMap{"Version": GenVersion, "Build": GenHashShort}, []string{"Version=version", "Build=hash_short"}, nil},
+		{"first", TargetMap{"Version": GenVersion}, []string{"Version=version"}, nil},
+		{"second", TargetMap{"Build": GenHashShort}, []string{"Build=hash_short"}, nil},
+		{"types", TargetMap{"Commit": GenHashLong, "Count": GenHashShort}, []string{"Commit=hash_long"}, []string{"Count=hash_short"}},
+	}
+	for _, tt := range tests {
+		targets, skipped, err := scanTargets(path, tt.dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, gotSkipped []string
+		for _, target := range targets {
+			if target.Pkg != pkg || target.File != path {
+				t.Errorf("%s: %s is in %s of %s", tt.name, target.Var, target.Pkg, target.File)
+			}
+			got = append(got, target.Var+mapAssignment+target.Gen)
+		}
+		for _, s := range skipped {
+			gotSkipped = append(gotSkipped, s.Var+mapAssignment+s.Gen)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") || strings.Join(gotSkipped, ",") != strings.Join(tt.skipped, ",") {
+			t.Errorf("%s: targets %v, skipped %v, want %v and %v", tt.name, got, gotSkipped, tt.want, tt.skipped)
+		}
+	}
+}
+
+func TestFindAllTargetsSymlinks(t *testing.T) {
+	base, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, base, map[string]string{
+		"app/go.mod":          "module example.com/app\n",
+		"app/main.go":         "package main\n\nvar Version string\n\nfunc main() {}\n",
+		"app/info/info.go":    "package info\n\nvar Build string\n",
+		"shared/shared.go":    "package shared\n\nvar Build string\n",
+		"shared/sub/empty.go": "package sub\n",
+	})
+	dir := filepath.Join(base, "app")
+
+	// Cycles into the tree, cycles outside of it and several links to the same directory
+	links := map[string]string{
+		"app/loop":        "..",
+		"app/info/back":   "..",
+		"app/alias":       "info",
+		"app/shared":      filepath.Join("..", "shared"),
+		"app/info/shared": filepath.Join("..", "..", "shared"),
+		"shared/sub/up":   "..",
+		"shared/self":     ".",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symlinks are not supported: %s", err.Error())
+		}
+	}
+	defer func(dir, pkg string, dict TargetMap) { rootDir, rootPackage, targetDict = dir, pkg, dict }(rootDir, rootPackage, targetDict)
+	rootDir, rootPackage, targetDict = dir, "example.com/app", TargetMap{"Version": GenVersion, "Build": GenHashShort}
+
+	type result struct {
+		targets []Target
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		targets, _, err := findAllTargets(dir)
+		done <- result{targets, err}
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("scan does not terminate")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// Every variable is found once, the directory outside of the tree through one of links
+	var got []string
+	for _, target := range res.targets {
+		got = append(got, realPath(target.File)+":"+target.Var)
+	}
+	sort.Strings(got)
+	want := []string{
+		realPath(filepath.Join(dir, "info", "info.go")) + ":Build",
+		realPath(filepath.Join(dir, "main.go")) + ":Version",
+		realPath(filepath.Join(base, "shared", "shared.go")) + ":Build",
+	}
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("targets\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFindAllTargetsOrder(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	files := map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nvar Version string\n\nfunc main() {}\n",
+	}
+	for i := 0; i < 10; i++ {
+		pkg := fmt.Sprintf("p%d", 9-i)
+		files[pkg+"/b.go"] = "package " + pkg + "\n\nvar (\n\tVersion string\n\tBuild   string\n)\n"
+		files[pkg+"/a.go"] = "package " + pkg + "\n\nvar Build string\n"
+	}
+	writeFiles(t, dir, files)
+	defer func(dir, pkg string, dict TargetMap) { rootDir, rootPackage, targetDict = dir, pkg, dict }(rootDir, rootPackage, targetDict)
+	rootDir, rootPackage, targetDict = dir, "example.com/app", TargetMap{"Version": GenVersion, "Build": GenHashShort}
+
+	// Targets are ordered by package, variable and file however files are scanned
+	var want []string
+	for i := 0; i < 10; i++ {
+		pkg := filepath.Join(dir, fmt.Sprintf("p%d", i))
+		want = append(want, pkg+".Build "+filepath.Join(pkg, "a.go"), pkg+".Build "+filepath.Join(pkg, "b.go"), pkg+".Version "+filepath.Join(pkg, "b.go"))
+	}
+	want = append(want, "main.Version "+filepath.Join(dir, "main.go"))
+	for run := 0; run < 10; run++ {
+		targets, _, err := findAllTargets(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, target := range targets {
+			got = append(got, target.Pkg+"."+target.Var+" "+target.File)
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("run %d: targets\n%s\nwant\n%s", run, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	// Errors of all broken files are reported in the same order too
+	broken := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		broken[fmt.Sprintf("p%d/broken%d.go", 4-i, 4-i)] = "package broken\n\nvar Version string =\n"
+	}
+	writeFiles(t, dir, broken)
+	_, _, err := findAllTargets(dir)
+	if err == nil {
+		t.Fatal("broken files are not reported")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 6 || !sort.StringsAreSorted(lines[1:]) {
+		t.Fatalf("errors are not sorted:\n%s", err.Error())
+	}
+	for i, line := range lines[1:] {
+		if name := fmt.Sprintf("broken%d.go", i); !strings.Contains(line, name) {
+			t.Errorf("error %d %q is not of %s", i, line, name)
+		}
+	}
+	for run := 0; run < 10; run++ {
+		if _, _, again := findAllTargets(dir); again == nil || again.Error() != err.Error() {
+			t.Fatalf("run %d: error\n%v\nwant\n%s", run, again, err.Error())
+		}
+	}
+}
+
+func TestScanTargetsInitializers(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	const src = "package main\n\nimport \"fmt\"\n\nvar Version = \"dev\"\n\nvar Commit string = \"none\"\n\nvar Build = `raw`\n\nvar Tag, Branch = \"a\", \"b\"\n\nvar Plain string\n\nvar Count = 1\n\nvar Host = fmt.Sprint(\"h\")\n"
+	writeFiles(t, dir, map[string]string{"main.go": src})
+	defer func(dir, pkg string) { rootDir, rootPackage = dir, pkg }(rootDir, rootPackage)
+	rootDir, rootPackage = dir, "example.com/app"
+	dict := TargetMap{"Version": GenVersion, "Commit": GenHashLong, "Build": GenTag, "Tag": GenTag, "Branch": GenTag, "Plain": GenTag, "Count": GenTag, "Host": GenHost}
+
+	// Initializers do not disqualify variables, the type is inferred from string literals
+	// and variables of types which cannot be inferred are skipped
+	targets, skipped, err := scanTargets(filepath.Join(dir, "main.go"), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, gotSkipped []string
+	for _, target := range targets {
+		got = append(got, target.Var+":"+target.Type)
+	}
+	for _, s := range skipped {
+		gotSkipped = append(gotSkipped, s.Var+":"+s.Type)
+	}
+	if want := "Version:string Commit:string Build:string Tag:string Branch:string Plain:string"; strings.Join(got, " ") != want {
+		t.Errorf("targets %v, want %s", got, want)
+	}
+	if want := "Count:int Host:"; strings.Join(gotSkipped, " ") != want {
+		t.Errorf("skipped %v, want %s", gotSkipped, want)
+	}
+}
+
+func TestInitializerGoBuild(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nimport \"fmt\"\n\nvar (\n\tVersion        = \"dev\"\n\tRelease string = \"none\"\n\tCommit  string\n)\n\nfunc main() { fmt.Println(Version, Release, Commit) }\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// The linker overrides initial values and they stay if nothing is stamped
+	if out := buildAndRun(t, dir); out != "dev none \n" {
+		t.Errorf("without -ldflags: %q", out)
+	}
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version,Release=tag")
+	if code != ExitOk || stdout != "-X main.Release=v1.2.3 -X main.Version=v1.2.3" {
+		t.Fatalf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	if out := buildAndRun(t, dir, "-ldflags", stdout); out != "v1.2.3 v1.2.3 \n" {
+		t.Errorf("with -ldflags: %q", out)
+	}
+}
+
+func TestImportPath(t *testing.T) {
+	root := filepath.Join("src", "app")
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{mainPkgName, mainPkgName},
+		{root, "example.com/app"},
+		{filepath.Join(root, "info"), "example.com/app/info"},
+		{filepath.Join(root, "internal", "buildinfo"), "example.com/app/internal/buildinfo"},
+	}
+	for _, tt := range tests {
+		if got := importPath(tt.dir, root, "example.com/app"); got != tt.want {
+			t.Errorf("importPath(%s) = %s, want %s", tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestPackagePaths(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":                     "module example.com/app\n",
+		"app.go":                     "package app\n\nvar Version string\n",
+		"internal/buildinfo/info.go": "package info\n\nvar Version string\n",
+		"cmd/tool/main.go":           "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/app\"\n\tinfo \"example.com/app/internal/buildinfo\"\n)\n\nvar Version string\n\nfunc main() { fmt.Println(app.Version, info.Version, Version) }\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// Packages are identified by directories rather than package clauses,
+	// the package at the root is the module itself and main packages are always main
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version")
+	want := "-X example.com/app.Version=v1.2.3 -X example.com/app/internal/buildinfo.Version=v1.2.3 -X main.Version=v1.2.3"
+	if code != ExitOk || stdout != want {
+		t.Fatalf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+	if out := buildAndRun(t, filepath.Join(dir, "cmd", "tool"), "-ldflags", stdout); out != "v1.2.3 v1.2.3 v1.2.3\n" {
+		t.Errorf("go build: %q", out)
+	}
+
+	// Qualified mappings name packages by import paths too
+	stdout, stderr, code = runMain(t, dir, nil, "-m", "example.com/app/internal/buildinfo.Version=tag")
+	if want := "-X example.com/app/internal/buildinfo.Version=v1.2.3"; code != ExitOk || stdout != want {
+		t.Errorf("qualified: exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+}
+
+func TestCrossBuild(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":         "module example.com/app\n",
+		"main.go":        "package main\n\nfunc main() {}\n",
+		"os_linux.go":    "package main\n\nvar Linux string\n",
+		"os_windows.go":  "package main\n\nvar Windows string\n",
+		"arch_amd64.go":  "package main\n\nvar AMD64 string\n",
+		"arch_arm64.go":  "package main\n\nvar ARM64 string\n",
+		"darwin.go":      "// +build darwin\n\npackage main\n\nvar Darwin string\n",
+		"constrained.go": "// +build linux,arm64\n\npackage main\n\nvar LinuxARM64 string\n",
+	})
+	defer cleanup()
+	mapping := []string{"-m", "Linux=goos,Windows=goos,Darwin=goos,AMD64=goarch,ARM64=goarch,LinuxARM64=goarch"}
+
+	// File name suffixes and build constraints are evaluated for the target platform,
+	// which is the one of $GOOS and $GOARCH unless flags override it
+	tests := []struct {
+		env  []string
+		args []string
+		want string
+	}{
+		{nil, []string{"-goos", "linux", "-goarch", "amd64"}, "-X main.AMD64=amd64 -X main.Linux=linux"},
+		{nil, []string{"-goos", "linux", "-goarch", "arm64"}, "-X main.ARM64=arm64 -X main.Linux=linux -X main.LinuxARM64=arm64"},
+		{nil, []string{"-goos", "windows", "-goarch", "arm64"}, "-X main.ARM64=arm64 -X main.Windows=windows"},
+		{nil, []string{"-goos", "darwin", "-goarch", "amd64"}, "-X main.AMD64=amd64 -X main.Darwin=darwin"},
+		{[]string{"GOOS=windows", "GOARCH=amd64"}, nil, "-X main.AMD64=amd64 -X main.Windows=windows"},
+		{[]string{"GOOS=windows", "GOARCH=amd64"}, []string{"-goos", "linux"}, "-X main.AMD64=amd64 -X main.Linux=linux"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, tt.env, append(mapping, tt.args...)...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v %v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.env, tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// Platform generators give the target platform too
+	if got := runPrint(t, dir, GenGOOS, "-goos", "plan9"); got != "plan9" {
+		t.Errorf("goos %q, want plan9", got)
+	}
+	if got := runPrint(t, dir, GenGOARCH, "-goarch", "riscv64"); got != "riscv64" {
+		t.Errorf("goarch %q, want riscv64", got)
+	}
+}
+
+func TestPlatformGenerators(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	mapping := []string{"-m", "Version=goos,Commit=goarch"}
+
+	// Values are of the host platform by default, then of $GOOS and $GOARCH and flags override both
+	tests := []struct {
+		env  []string
+		args []string
+		want string
+	}{
+		{[]string{"GOOS=", "GOARCH="}, nil, "-X main.Commit=" + runtime.GOARCH + " -X main.Version=" + runtime.GOOS},
+		{[]string{"GOOS=windows", "GOARCH=386"}, nil, "-X main.Commit=386 -X main.Version=windows"},
+		{[]string{"GOOS=windows", "GOARCH=386"}, []string{"-goos", "freebsd"}, "-X main.Commit=386 -X main.Version=freebsd"},
+		{[]string{"GOOS=windows", "GOARCH=386"}, []string{"-goarch", "arm"}, "-X main.Commit=arm -X main.Version=windows"},
+		{nil, []string{"-goos", "linux", "-goarch", "amd64", "-format", FormatEnv}, "GOXVER_GOARCH=amd64\nGOXVER_GOOS=linux\n"},
+		{nil, []string{"-goos", "linux", "-goarch", "amd64", "-m", "Version=goos(prefix=os-)"}, "-X main.Commit=amd64 -X main.Version=os-linux"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, tt.env, append(mapping, tt.args...)...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v %v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.env, tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+	if got := runPrint(t, dir, GenGOOS, "-goos", "js"); got != "js" {
+		t.Errorf("-print goos %q, want js", got)
+	}
+}
+
+func TestRepoFlag(t *testing.T) {
+	repoDir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/repo\n",
+		"main.go": "package main\n\nvar Other string\n\nfunc main() {}\n",
+	}, "v1.2.3")
+	defer cleanup()
+	base, cleanupBase := tempDir(t)
+	defer cleanupBase()
+	writeFiles(t, base, map[string]string{
+		"src/go.mod":       "module example.com/app\n",
+		"src/main.go":      "package main\n\nvar Version string\n\nfunc main() {}\n",
+		"src/info/info.go": "package info\n\nvar Commit string\n",
+	})
+	src := filepath.Join(base, "src")
+	rel, err := filepath.Rel(src, repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := []string{"-m", "Version=version,Commit=hash_short,Other=tag"}
+	want := "-X example.com/app/info.Commit=" + hash[:7] + " -X main.Version=v1.2.3"
+
+	// Targets are found under -d only and values are of the repository given with -repo,
+	// the relative path is relative to the current directory. Without -repo the repository
+	// is looked for in -d, where there is none, so nothing is stamped.
+	tests := []struct {
+		cwd  string
+		args []string
+		want string
+	}{
+		{base, []string{"-d", src, "-repo", repoDir}, want},
+		{src, []string{"-repo", rel}, want},
+		{repoDir, []string{"-d", src}, ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, tt.cwd, nil, append(mapping, tt.args...)...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v in %s: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, tt.cwd, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// The git repository is used by -print too
+	if got := runPrint(t, src, GenVersion, "-repo", repoDir); got != "v1.2.3" {
+		t.Errorf("-print version %q, want v1.2.3", got)
+	}
+}
+
+func TestReadPkgFromMod(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		mod  string
+		want string
+	}{
+		{"module example.com/x\n", "example.com/x"},
+		{"module example.com/x // indirect note\n", "example.com/x"},
+		{"module example.com/x// note\n", "example.com/x"},
+		{"  module \t example.com/x \t\n", "example.com/x"},
+		{"module example.com/x\r\n\r\ngo 1.12\r\n", "example.com/x"},
+		{"// Deprecated: use example.com/y\n\nmodule example.com/x\n\ngo 1.12\n", "example.com/x"},
+		{"module \"example.com/x\" // note\n", "example.com/x"},
+		{"module \"example.com//x\"\n", "example.com//x"},
+		{"module `example.com/x`\n", "example.com/x"},
+		{"module \"example.com/\\x78\"\n", "example.com/x"},
+		{"go 1.12\n", ""},
+	}
+	for _, tt := range tests {
+		writeFiles(t, dir, map[string]string{goModName: tt.mod})
+		if got, err := readPkgFromMod(dir); err != nil || got != tt.want {
+			t.Errorf("readPkgFromMod(%q) = %q, %v, want %q", tt.mod, got, err, tt.want)
+		}
+	}
+
+	// The missing go.mod is not an error
+	if err := os.Remove(filepath.Join(dir, goModName)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPkgFromMod(dir); err != nil || len(got) > 0 {
+		t.Errorf("no go.mod: %q, %v", got, err)
+	}
+}
+
+func TestCommentedModulePath(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":       "module example.com/app // the application\n",
+		"info/info.go": "package info\n\nvar Version string\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version")
+	if want := "-X example.com/app/info.Version=v1.2.3"; code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+}
+
+func TestQuotedModulePath(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":       "module \"example.com/app\"\n",
+		"info/info.go": "package info\n\nvar Version string\n",
+		"main.go":      "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/app/info\"\n)\n\nfunc main() { fmt.Println(info.Version) }\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// The quoted path gives the same flags as the unquoted one and the linker accepts them
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version")
+	if want := "-X example.com/app/info.Version=v1.2.3"; code != ExitOk || stdout != want {
+		t.Fatalf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+	if out := buildAndRun(t, dir, "-ldflags", stdout); out != "v1.2.3\n" {
+		t.Errorf("go build: %q", out)
+	}
+}
+
+func TestRootPackageWithoutModule(t *testing.T) {
+	files := map[string]string{
+		"main.go":      "package main\n\nvar Version string\n\nfunc main() {}\n",
+		"info/info.go": "package info\n\nvar Build string\n",
+	}
+	dir, _, cleanup := testRepo(t, files, "v1.2.3")
+	defer cleanup()
+	gopath, cleanupGOPATH := tempDir(t)
+	defer cleanupGOPATH()
+	env := []string{"GOPATH=" + gopath}
+
+	// Outside of GOPATH the name of the directory is the root package and it is warned about
+	stdout, stderr, code := runMain(t, dir, env, "-m", "Version=version,Build=tag")
+	base := filepath.Base(dir)
+	if want := "-X " + base + "/info.Build=v1.2.3 -X main.Version=v1.2.3"; code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+	if want := warnPrefix + "no go.mod found and " + dir + " is outside of GOPATH, use " + base + " as the root package\n"; stderr != want {
+		t.Errorf("STDERR %q, want %q", stderr, want)
+	}
+
+	// Inside of GOPATH the path under src is the root package
+	legacy := filepath.Join(gopath, "src", "example.com", "legacy")
+	repo, err := git.PlainInit(legacy, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommit(t, repo, legacy, files)
+	testTag(t, repo, "v1.2.3")
+	stdout, stderr, code = runMain(t, legacy, env, "-m", "Version=version,Build=tag")
+	if want := "-X example.com/legacy/info.Build=v1.2.3 -X main.Version=v1.2.3"; code != ExitOk || stdout != want || len(stderr) > 0 {
+		t.Errorf("GOPATH: exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+}
+
+func TestScanTargetsAnnotations(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	const src = `package main
+
+var Revision string //goxver:hash_long
+
+// Built is the build time.
+//goxver:time(utc=true)
+var Built string
+
+var Version string //goxver:tag
+
+var (
+	//goxver:hash_short
+	Commit string
+	Tagged string //goxver:on_tag
+	Plain  string // goxver:version
+	A, B   string //goxver:hash_short
+	Count  int    //goxver:commit_count
+	Size   int    //goxver:tag
+)
+`
+	writeFiles(t, dir, map[string]string{"main.go": src, "broken/broken.go": "package broken\n\nvar Version string //goxver:unknown\n"})
+	defer func(dir, pkg string) { rootDir, rootPackage = dir, pkg }(rootDir, rootPackage)
+	rootDir, rootPackage = dir, "example.com/app"
+
+	// Annotated variables are targets without mappings and annotations override mappings,
+	// the comment must start with //goxver: exactly
+	targets, skipped, err := scanTargets(filepath.Join(dir, "main.go"), TargetMap{"Version": GenVersion, "Plain": GenVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, gotSkipped []string
+	for _, target := range targets {
+		got = append(got, target.Var+mapAssignment+target.Gen+" "+target.Key)
+	}
+	for _, s := range skipped {
+		gotSkipped = append(gotSkipped, s.Var+mapAssignment+s.Gen)
+	}
+	want := []string{
+		"Revision=hash_long //goxver:hash_long",
+		"Built=time //goxver:time(utc=true)",
+		"Version=tag //goxver:tag",
+		"Commit=hash_short //goxver:hash_short",
+		"Tagged=on_tag //goxver:on_tag",
+		"Plain=version Plain",
+		"A=hash_short //goxver:hash_short",
+		"B=hash_short //goxver:hash_short",
+		"Count=commit_count //goxver:commit_count",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("targets\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if strings.Join(gotSkipped, ",") != "Size=tag" {
+		t.Errorf("skipped %v, want Size=tag", gotSkipped)
+	}
+	if targets[1].Opts[OptUTC] != "true" {
+		t.Errorf("options of the annotation %v", targets[1].Opts)
+	}
+
+	// Invalid annotations are errors even if the name is not mapped
+	if _, _, err := scanTargets(filepath.Join(dir, "broken", "broken.go"), nil); err == nil || !strings.Contains(err.Error(), "invalid annotation //goxver:unknown") {
+		t.Errorf("invalid annotation: error %v", err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nvar (\n\tVersion  string //goxver:tag\n\tRevision string //goxver:hash_long\n)\n\nfunc main() {}\n",
+	}, "v1.2.3", "release")
+	defer cleanup()
+
+	// The annotation wins over the default mapping of the name
+	stdout, stderr, code := runMain(t, dir, nil, "-defaults")
+	if want := "-X main.Revision=" + hash + " -X main.Version=release"; code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+}
+
+func TestFindNameKey(t *testing.T) {
+	defer func(pkg string) { rootPackage = pkg }(rootPackage)
+	rootPackage = "example.com/app"
+	dict := TargetMap{
+		"Build*":                        GenTime,
+		"BuildTime":                     GenTag,
+		"Build?ate":                     GenHashShort,
+		"BuildDa*":                      GenHashLong,
+		"Git*":                          GenHashShort,
+		"Gi*":                           GenHashLong,
+		"*":                             GenVersion,
+		"example.com/app/info.Build*":   GenHashLong,
+		"example.com/app/info.BuildTag": GenVersion,
+		"./internal.Commit":             GenHashShort,
+	}
+
+	// The qualified key wins over the bare one, then the exact name wins over globs,
+	// then the longest glob wins and the first key in order of keys is taken among equal globs
+	tests := []struct {
+		name string
+		pkgs []string
+		want string
+	}{
+		{"BuildTime", []string{mainPkgName}, "BuildTime"},
+		{"BuildStamp", []string{mainPkgName}, "Build*"},
+		{"buildstamp", []string{mainPkgName}, "Build*"},
+		{"BuildDate", []string{mainPkgName}, "Build?ate"},
+		{"BuildDay", []string{mainPkgName}, "BuildDa*"},
+		{"GitSHA", []string{mainPkgName}, "Git*"},
+		{"Other", []string{mainPkgName}, "*"},
+		{"BuildTime", []string{mainPkgName, "example.com/app/info"}, "example.com/app/info.Build*"},
+		{"BuildTag", []string{mainPkgName, "example.com/app/info"}, "example.com/app/info.BuildTag"},
+		{"Commit", []string{"example.com/app/internal"}, "./internal.Commit"},
+		{"Commit", []string{"example.com/app/other"}, "*"},
+	}
+	for _, tt := range tests {
+		if got := findNameKey(dict, tt.name, tt.pkgs...); got != tt.want {
+			t.Errorf("findNameKey(%s in %v) = %q, want %q", tt.name, tt.pkgs, got, tt.want)
+		}
+	}
+
+	// Names match nothing without the catch-all glob
+	delete(dict, "*")
+	if got := findNameKey(dict, "Other", mainPkgName); len(got) > 0 {
+		t.Errorf("findNameKey(Other) = %q, want nothing", got)
+	}
+}
+
+func TestWildcardMappings(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nvar (\n\tBuildTime  string\n\tBuildStamp string\n\tBuilder    string\n\tVersion    string\n)\n\nfunc main() {}\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// Exact mappings override globs whatever order they are given in
+	for _, args := range [][]string{
+		{"-m", "Build*=hash_short,BuildTime=tag"},
+		{"-m", "BuildTime=tag", "-m", "Build*=hash_short"},
+	} {
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if want := "-X main.BuildStamp=" + hash[:7] + " -X main.BuildTime=v1.2.3 -X main.Builder=" + hash[:7]; code != ExitOk || stdout != want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", args, code, stdout, want, stderr)
+		}
+	}
+
+	// The glob matches the whole name, so Build? does not match BuildTime
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Build?r=tag,Build?=hash_short")
+	if code != ExitOk || stdout != "-X main.Builder=v1.2.3" {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nvar (\n\tversion   string\n\tVersion   string\n\tbuildTime string\n\tBuildTime string\n)\n\nfunc main() {}\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// Names differing only by case match the same mapping by default, exact names and
+	// globs match only the case given with -case-sensitive, qualified keys included
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-m", "Version=version,Build*=hash_short"}, "-X main.BuildTime=" + hash[:7] + " -X main.Version=v1.2.3 -X main.buildTime=" + hash[:7] + " -X main.version=v1.2.3"},
+		{[]string{"-m", "Version=version,Build*=hash_short", "-case-sensitive"}, "-X main.BuildTime=" + hash[:7] + " -X main.Version=v1.2.3"},
+		{[]string{"-m", "version=version,build*=hash_short", "-case-sensitive"}, "-X main.buildTime=" + hash[:7] + " -X main.version=v1.2.3"},
+		{[]string{"-m", "main.VERSION=version", "-case-sensitive"}, ""},
+		{[]string{"-m", "main.VERSION=version"}, "-X main.Version=v1.2.3 -X main.version=v1.2.3"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, nil, tt.args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+}
+
+func TestSanitizeValue(t *testing.T) {
+	tests := []struct {
+		s, want  string
+		modified bool
+	}{
+		{"", "", false},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2.3 beta", "v1.2.3 beta", false},
+		{"Café ☕ 版本 👍", "Café ☕ 版本 👍", false},
+		{"v1.2.3\n", "v1.2.3", true},
+		{"line\r\nbreak", "linebreak", true},
+		{"tab\there", "tabhere", true},
+		{"nul\x00byte", "nulbyte", true},
+		{"\x00\x01\x1f\x7f", "", true},
+		{"bell\a and escape\x1b[0m", "bell and escape[0m", true},
+		{"c1\u0085\u009f controls", "c1 controls", true},
+		{"bad\xffbyte", "badbyte", true},
+		{"truncated \xe2\x82", "truncated ", true},
+		{"overlong \xc0\xaf", "overlong ", true},
+		{"surrogate \xed\xa0\x80", "surrogate ", true},
+		{"\xef\xbf\xbd replacement", "\xef\xbf\xbd replacement", false},
+		{"zero​width", "zero​width", false},
+	}
+	for _, tt := range tests {
+		got, modified := sanitizeValue(tt.s)
+		if got != tt.want || modified != tt.modified {
+			t.Errorf("sanitizeValue(%q) = %q, %v, want %q, %v", tt.s, got, modified, tt.want, tt.modified)
+		}
+	}
+}
+
+func TestGenerateLDFlagsSanitize(t *testing.T) {
+	defer func(fail bool) { failOnSanitize = fail }(failOnSanitize)
+	targets := []Target{{Pkg: mainPkgName, Var: "Commit", Gen: "env:APP_VALUE"}}
+	defer func(value string, ok bool) {
+		if ok {
+			_ = os.Setenv("APP_VALUE", value)
+		} else {
+			_ = os.Unsetenv("APP_VALUE")
+		}
+	}(os.LookupEnv("APP_VALUE"))
+	_ = os.Setenv("APP_VALUE", "a\tb\xff")
+
+	failOnSanitize = false
+	values, err := generateTargetValues(nil, targets)
+	if assigns := generateLDFlags(values); err != nil || strings.Join(assigns, " ") != "main.Commit=ab" {
+		t.Errorf("assigns %v, error %v", assigns, err)
+	}
+
+	failOnSanitize = true
+	if _, err := generateTargetValues(nil, targets); err == nil {
+		t.Error("-fail-on-sanitize does not fail")
+	}
+}
+
+// parseLogLines parses every line of STDERR as the JSON log entry.
+func parseLogLines(t *testing.T, stderr string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q is not JSON: %s", line, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogLevels(t *testing.T) {
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":   "module example.com/app\n",
+		"main.go":  "package main\n\nvar Version string\n\nfunc main() {}\n",
+		"other.go": "package main\n\nvar Other string\n",
+	}, "v1.2.3")
+	defer cleanup()
+	mainPath, otherPath := filepath.Join(dir, "main.go"), filepath.Join(dir, "other.go")
+	match := "Match Version in " + mainPath + " by Version"
+
+	// Decisions are printed only with -vv, -v prints the progress only and nothing is printed by default
+	tests := []struct {
+		args      []string
+		want      string
+		wantDebug bool
+	}{
+		{nil, "", false},
+		{[]string{"-v"}, "Target mappings:", false},
+		{[]string{"-vv"}, match, true},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, nil, append([]string{"-m", "Version=version"}, tt.args...)...)
+		if code != ExitOk || stdout != "-X main.Version=v1.2.3" {
+			t.Fatalf("%v: exit code %d, STDOUT %q, STDERR %s", tt.args, code, stdout, stderr)
+		}
+		if (len(tt.want) == 0 && len(stderr) > 0) || !strings.Contains(stderr, tt.want) {
+			t.Errorf("%v: STDERR %q, want %q", tt.args, stderr, tt.want)
+		}
+		if strings.Contains(stderr, match) != tt.wantDebug {
+			t.Errorf("%v: decisions in STDERR %q", tt.args, stderr)
+		}
+	}
+
+	// In JSON log format decisions are records with the level and fields
+	_, stderr, code := runMain(t, dir, nil, "-m", "Version=version", "-vv", "-log-format", LogFormatJSON)
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+	var matched, skipped bool
+	for _, entry := range parseLogLines(t, stderr) {
+		if entry["level"] != levelDebug {
+			continue
+		}
+		switch {
+		case entry["decision"] == "match" && entry["target"] == "Version" && entry["rule"] == "Version" && entry["file"] == mainPath:
+			matched = true
+		case entry["decision"] == "skip" && entry["file"] == otherPath:
+			skipped = true
+		}
+	}
+	if !matched || !skipped {
+		t.Errorf("match %v, skip %v in\n%s", matched, skipped, stderr)
+	}
+	_, stderr, _ = runMain(t, dir, nil, "-m", "Version=version", "-v", "-log-format", LogFormatJSON)
+	for _, entry := range parseLogLines(t, stderr) {
+		if entry["level"] != levelInfo {
+			t.Errorf("-v: %v", entry)
+		}
+	}
+
+	if _, stderr, code := runMain(t, dir, nil, "-v", "-log-format", "xml"); code != ExitUsage || !strings.Contains(stderr, "invalid log format xml") {
+		t.Errorf("invalid log format: exit code %d, STDERR %s", code, stderr)
+	}
+}
+
+func TestDuplicateTargetWarning(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":       "module example.com/app\n",
+		"main.go":      "package main\n\nvar (\n\tVersion string\n\tCommit  string\n)\n\nfunc main() {}\n",
+		"info/info.go": "package info\n\nvar Version, Commit string\n",
+	}, "v1.2.3")
+	defer cleanup()
+	flags := "-X example.com/app/info.Commit=" + hash[:4] + " -X example.com/app/info.Version=v1.2.3 -X main.Commit=" + hash[:4] + " -X main.Version=v1.2.3"
+
+	// The warning lists packages of every name found more than once and flags are not changed
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version,Commit=hash:4")
+	want := warnPrefix + "Commit is found in multiple packages: example.com/app/info, main\n" +
+		warnPrefix + "Version is found in multiple packages: example.com/app/info, main\n"
+	if code != ExitOk || stdout != flags || stderr != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %q, want %q", code, stdout, flags, stderr, want)
+	}
+
+	// Variables matched by qualified mappings are told apart deliberately, so they are not warned about
+	stdout, stderr, code = runMain(t, dir, nil, "-m", "Version=version,Commit=hash:4,example.com/app/info.Commit=hash:4")
+	want = warnPrefix + "Version is found in multiple packages: example.com/app/info, main\n"
+	if code != ExitOk || stdout != flags || stderr != want {
+		t.Errorf("qualified: exit code %d, STDOUT %q, STDERR %q, want %q", code, stdout, stderr, want)
+	}
+
+	// Names found in one package are not warned about
+	if _, stderr, _ := runMain(t, dir, nil, "-m", "main.Version=version,main.Commit=hash"); len(stderr) > 0 {
+		t.Errorf("single package: STDERR %q", stderr)
+	}
+}
+
+func TestNonStringTargetWarning(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\ntype Name string\n\nvar (\n\tVersion   int\n\tCommit    string\n\tBuildTime float64\n\tRelease   Name\n\tTags      []string\n\tBranch    *string\n\tOther     int\n)\n\nfunc main() {}\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// Every mapped variable which cannot be stamped is warned about with the reason and
+	// the rest is stamped as usual, unmapped variables are not warned about whatever their types are
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version,Commit=hash_short,BuildTime=time,Release=tag,Tags=tag,Branch=tag")
+	if code != ExitOk || stdout != "-X main.Commit="+hash[:7] {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	want := []string{
+		"Branch is not a string; cannot stamp main.Branch in main.go",
+		"BuildTime is not a string; cannot stamp main.BuildTime in main.go",
+		"Release is not a string; cannot stamp main.Release in main.go",
+		"Tags is not a string; cannot stamp main.Tags in main.go",
+		"Version is int but version is not numeric; cannot stamp main.Version in main.go",
+	}
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	sort.Strings(lines)
+	for i := range want {
+		want[i] = warnPrefix + want[i]
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("STDERR\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSanitizeWarning(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject)
+	defer cleanup()
+	env := []string{"APP_VALUE=a\tb"}
+
+	// The warning is printed without verbose mode too
+	stdout, stderr, code := runMain(t, dir, env, "-m", "Commit=env:APP_VALUE")
+	if code != ExitOk || stdout != "-X main.Commit=ab" || stderr != warnPrefix+"value \"a\\tb\" of main.Commit is sanitized to \"ab\"\n" {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %q", code, stdout, stderr)
+	}
+
+	// Every line is the JSON object in JSON log format including the warning
+	_, stderr, code = runMain(t, dir, env, "-m", "Commit=env:APP_VALUE", "-v", "-log-format", LogFormatJSON)
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+	var warned bool
+	for _, entry := range parseLogLines(t, stderr) {
+		if entry["level"] == levelWarn && entry["target"] == "main.Commit" && strings.Contains(entry["msg"].(string), "is sanitized to \"ab\"") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("no sanitize warning in %s", stderr)
+	}
+
+	if _, stderr, code := runMain(t, dir, env, "-m", "Commit=env:APP_VALUE", "-fail-on-sanitize"); code != ExitOutput {
+		t.Errorf("-fail-on-sanitize: exit code %d, STDERR %s", code, stderr)
+	}
+}
+
+func TestReadHostnameAndUsername(t *testing.T) {
+	defer func(hostname func() (string, error), current func() (*user.User, error), r bool) {
+		lookupHostname, lookupUser, reproducible = hostname, current, r
+	}(lookupHostname, lookupUser, reproducible)
+
+	lookupHostname = func() (string, error) { return "builder", nil }
+	lookupUser = func() (*user.User, error) { return &user.User{Username: "ci"}, nil }
+	reproducible = false
+	if host, name := readHostname(), readUsername(); host != "builder" || name != "ci" {
+		t.Errorf("host %q, user %q", host, name)
+	}
+
+	reproducible = true
+	if host, name := readHostname(), readUsername(); host != "" || name != "" {
+		t.Errorf("reproducible: host %q, user %q", host, name)
+	}
+
+	lookupHostname = func() (string, error) { return "", errors.New("no host") }
+	lookupUser = func() (*user.User, error) { return nil, errors.New("no user") }
+	reproducible = false
+	if host, name := readHostname(), readUsername(); host != "" || name != "" {
+		t.Errorf("lookup errors: host %q, user %q", host, name)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Version
+	}{
+		{"v1.2.3", Version{Prefix: "v", Major: 1, Minor: 2, Build: 3}},
+		{"1.2.3", Version{Major: 1, Minor: 2, Build: 3}},
+		{"v1.2", Version{Prefix: "v", Major: 1, Minor: 2}},
+		{"v1", Version{Prefix: "v", Major: 1}},
+		{"v1.2.5-rc.1", Version{Prefix: "v", Major: 1, Minor: 2, Build: 5, PreRelease: "rc.1"}},
+		{"v1.2.5-beta-2", Version{Prefix: "v", Major: 1, Minor: 2, Build: 5, PreRelease: "beta-2"}},
+		{"v1.2.5+build.7", Version{Prefix: "v", Major: 1, Minor: 2, Build: 5}},
+		{"v1.2.5-rc.1+build-7", Version{Prefix: "v", Major: 1, Minor: 2, Build: 5, PreRelease: "rc.1"}},
+		{"v1.2-rc", Version{Prefix: "v", Major: 1, Minor: 2, PreRelease: "rc"}},
+	}
+	for _, tt := range tests {
+		if got := parseVersion(tt.s); got != tt.want {
+			t.Errorf("parseVersion(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	tests := []struct {
+		tags                         []string
+		version, patch, minor, major string
+	}{
+		{[]string{"v1.2.3"}, "v1.2.3", "v1.2.4", "v1.3.0", "v2.0.0"},
+		{[]string{"v1.2.3", "v1.2.5-rc.1"}, "v1.2.5", "v1.2.6", "v1.3.0", "v2.0.0"},
+		{[]string{"v1.2.3", "v1.2.5+build.7"}, "v1.2.5", "v1.2.6", "v1.3.0", "v2.0.0"},
+		{[]string{"v1.2.5", "v1.2.5-rc.1"}, "v1.2.5", "v1.2.6", "v1.3.0", "v2.0.0"},
+		{[]string{"v1.10.0-beta", "v1.9.9"}, "v1.10.0", "v1.10.1", "v1.11.0", "v2.0.0"},
+	}
+	for _, tt := range tests {
+		dir, _, cleanup := testRepo(t, testProject, tt.tags...)
+		for gen, want := range map[string]string{GenVersion: tt.version, GenNextPatch: tt.patch, GenNextMinor: tt.minor, GenNextMajor: tt.major} {
+			stdout, stderr, code := runMain(t, dir, nil, "-print", gen)
+			if code != ExitOk || stdout != want+"\n" {
+				t.Errorf("%v: %s = %q, exit code %d, want %q, STDERR %s", tt.tags, gen, stdout, code, want, stderr)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestPseudoVersion(t *testing.T) {
+	// Test commits are made at the same time, pseudo-versions are made of it and the hash of HEAD
+	const stamp = "20200913122640"
+	tests := []struct {
+		name    string
+		tags    []string // Tags of the first commit
+		ahead   bool     // HEAD is the commit after the first one
+		branch  []string // Tags of the commit after the first one which HEAD does not descend from
+		want    string   // The pseudo-version with %s for the hash of HEAD
+		exactly bool     // The tag is returned as is
+	}{
+		{name: "tagged HEAD", tags: []string{"v1.2.3"}, want: "v1.2.3", exactly: true},
+		{name: "newest tag at HEAD", tags: []string{"v1.2.3", "v1.10.0", "v1.9.0"}, want: "v1.10.0", exactly: true},
+		{name: "after tag", tags: []string{"v1.2.3"}, ahead: true, want: "v1.2.4-0." + stamp + "-%s"},
+		{name: "no tags", ahead: true, want: "v0.0.0-" + stamp + "-%s"},
+		{name: "no tags at HEAD", want: "v0.0.0-" + stamp + "-%s"},
+		{name: "not semantic tags", tags: []string{"v1.2", "release"}, ahead: true, want: "v0.0.0-" + stamp + "-%s"},
+		{name: "pre-release", tags: []string{"v1.3.0-rc.9", "v1.3.0-rc.10", "v1.2.9"}, ahead: true, want: "v1.3.0-rc.10.0." + stamp + "-%s"},
+		{name: "release after pre-release", tags: []string{"v1.3.0-rc.2", "v1.3.0"}, ahead: true, want: "v1.3.1-0." + stamp + "-%s"},
+		{name: "numeric pre-release first", tags: []string{"v1.3.0-alpha", "v1.3.0-1"}, ahead: true, want: "v1.3.0-alpha.0." + stamp + "-%s"},
+		{name: "unreachable tag", tags: []string{"v1.2.3"}, ahead: true, branch: []string{"v2.0.0"}, want: "v1.2.4-0." + stamp + "-%s"},
+		{name: "only unreachable tags", ahead: true, branch: []string{"v2.0.0"}, want: "v0.0.0-" + stamp + "-%s"},
+	}
+	for _, tt := range tests {
+		dir, hash, cleanup := testRepo(t, testProject, tt.tags...)
+		repo, err := git.PlainOpen(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.branch) > 0 {
+			testCommit(t, repo, dir, map[string]string{"BRANCH": "other\n"})
+			for _, tag := range tt.branch {
+				testTag(t, repo, tag)
+			}
+			testReset(t, repo, hash)
+		}
+		if tt.ahead {
+			hash = testCommit(t, repo, dir, map[string]string{"README": "app\n"})
+		}
+
+		want := tt.want
+		if !tt.exactly {
+			want = fmt.Sprintf(tt.want, hash[:pseudoHashLength])
+		}
+		stdout, stderr, code := runMain(t, dir, nil, "-print", GenPseudo)
+		if code != ExitOk || stdout != want+"\n" {
+			t.Errorf("%s: exit code %d, STDOUT %q, want %q, STDERR %s", tt.name, code, stdout, want, stderr)
+		}
+		cleanup()
+	}
+}
+
+func TestComparePreRelease(t *testing.T) {
+	// Each pre-release goes before the next one, the release goes last
+	ordered := []string{"1", "2", "10", "alpha", "alpha.1", "alpha.beta", "beta", "beta.2", "beta.11", "rc.1", "rc.9", "rc.10", "rc.10.1", ""}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := compareInts(i, j)
+			if got := comparePreRelease(a, b); got != want {
+				t.Errorf("comparePreRelease(%q, %q) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestCalVer(t *testing.T) {
+	tests := []struct {
+		tags []string
+		want string
+	}{
+		{[]string{"2023.12.0", "2024.1.0", "2023.10.1"}, "2024.1.0"},
+		{[]string{"2023.9.5", "2023.10.1"}, "2023.10.1"},
+		{[]string{"2024.1.0", "2024.01.1"}, "2024.01.1"},
+		{[]string{"2024.04.3", "2024.05"}, "2024.05"},
+		{[]string{"23.10", "24.04"}, "24.04"},
+		{[]string{"2024.12.0", "v2025.2.0"}, "v2025.2.0"},
+		// Tags of other schemes are not calendar versions
+		{[]string{"2023.1.0", "v1.2.3", "2024.1.2-rc", "12345.1.0", "2024.100.0"}, "2023.1.0"},
+		{[]string{"v1.2.3"}, ""},
+	}
+	for _, tt := range tests {
+		dir, _, cleanup := testRepo(t, testProject, tt.tags...)
+		if got := runPrint(t, dir, GenVersion, "-calver"); got != tt.want {
+			t.Errorf("%v: version %q, want %q", tt.tags, got, tt.want)
+		}
+		cleanup()
+	}
+
+	// The default version is used without calendar versions
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	if got := runPrint(t, dir, GenVersion, "-calver", "-default-version", "2000.1.0"); got != "2000.1.0" {
+		t.Errorf("default version %q", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+
+	// Statistics are printed on success and on failure
+	for _, args := range [][]string{
+		{"-stats"},
+		{"-stats", "-m", "Version=version,Commit=hash"},
+		{"-stats", "-m", "Version=unknown"},
+	} {
+		_, stderr, code := runMain(t, dir, nil, args...)
+		phases := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+			if !strings.HasPrefix(line, statsPrefix) {
+				continue
+			}
+			fields := strings.SplitN(line[len(statsPrefix):], ": ", 2)
+			if len(fields) != 2 {
+				t.Fatalf("%v: invalid line %q", args, line)
+			}
+			if _, err := time.ParseDuration(strings.SplitN(fields[1], " ", 2)[0]); err != nil {
+				t.Errorf("%v: invalid duration in %q: %s", args, line, err.Error())
+			}
+			phases[fields[0]] = true
+		}
+
+		want := []string{"total"}
+		if code == ExitOk {
+			want = append(want, "config load", "target scan")
+		}
+		if len(args) > 1 && code == ExitOk {
+			want = append(want, "repository open", "generator version", "generator hash")
+		}
+		for _, phase := range want {
+			if !phases[phase] {
+				t.Errorf("%v: exit code %d, phase %q is not in\n%s", args, code, phase, stderr)
+			}
+		}
+	}
+
+	if _, stderr, _ := runMain(t, dir, nil); strings.Contains(stderr, statsPrefix) {
+		t.Errorf("statistics without -stats: %s", stderr)
+	}
+}
+
+func TestGitDirEnv(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	other, cleanupOther := tempDir(t)
+	defer cleanupOther()
+
+	// The git directory is relocated out of the work tree, so the repository is found
+	// only with $GIT_DIR, and as usual nothing is printed if the repository is not found
+	gitDir := filepath.Join(other, "app.git")
+	if err := os.Rename(filepath.Join(dir, gitDirName), gitDir); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(dir, gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const mapping = "Version=version,Commit=hash"
+	want := "-X main.Commit=" + hash + " -X main.Version=v1.2.3"
+	tests := []struct {
+		name string
+		cwd  string
+		env  []string
+		want string
+	}{
+		{"absolute", dir, []string{gitDirEnv + "=" + gitDir, gitWorkTreeEnv + "=" + dir}, want},
+		{"relative", dir, []string{gitDirEnv + "=" + rel, gitWorkTreeEnv + "=."}, want},
+		{"git dir only", dir, []string{gitDirEnv + "=" + gitDir}, want},
+		{"not set", dir, nil, ""},
+		{"missing", dir, []string{gitDirEnv + "=" + filepath.Join(other, "missing.git"), gitWorkTreeEnv + "=" + dir}, ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, tt.cwd, tt.env, "-m", mapping)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%s: exit code %d, STDOUT %q, want %q, STDERR %s", tt.name, code, stdout, tt.want, stderr)
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   string
+		code   int
+	}{
+		{"valid", "", []string{"-m", "Version=version"}, "OK: 1 mappings from 1 sources", ExitOk},
+		{"invalid generator", "", []string{"-m", "Version=unknown"}, "1 problems found", ExitUsage},
+		{"invalid config", "Version = version\nCommit\n", nil, "1 problems found", ExitUsage},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, defaultConfigName)
+		if len(tt.config) > 0 {
+			writeFiles(t, dir, map[string]string{defaultConfigName: tt.config})
+		}
+
+		// The check exits with the same code as the run does on the same problem, problems go to STDERR
+		stdout, stderr, code := runMain(t, dir, nil, append([]string{cmdConfig, cmdConfigCheck}, tt.args...)...)
+		report := stdout
+		if tt.code != ExitOk {
+			report = stderr
+		}
+		if code != tt.code || !strings.Contains(report, tt.want) {
+			t.Errorf("%s: check exit code %d, want %d, STDOUT %q, want %q, STDERR %s", tt.name, code, tt.code, stdout, tt.want, stderr)
+		}
+		if _, stderr, code := runMain(t, dir, nil, tt.args...); code != tt.code {
+			t.Errorf("%s: run exit code %d, want %d, STDERR %s", tt.name, code, tt.code, stderr)
+		}
+		_ = os.Remove(path)
+	}
+
+	stdout, stderr, code := runMain(t, dir, nil, cmdConfig, cmdConfigCheck, "-m", "example.com/app/missing.Version=version")
+	if code != ExitUsage || len(stdout) > 0 || !strings.Contains(stderr, "1 problems found") {
+		t.Errorf("missing package: exit code %d, STDOUT %q, STDERR %q", code, stdout, stderr)
+	}
+
+	// Every bad mapping of the configuration is reported with the file and the line
+	path := filepath.Join(dir, defaultConfigName)
+	writeFiles(t, dir, map[string]string{defaultConfigName: "Version=version\nCommit=unknown\nBuild=time(zone=UTC)\n"})
+	stdout, stderr, code = runMain(t, dir, nil, cmdConfig, cmdConfigCheck)
+	for _, want := range []string{
+		path + ":2: invalid mapping Commit=unknown: invalid generator unknown",
+		path + ":3: invalid mapping Build=time(zone=UTC): generator time does not accept option zone",
+		"\n2 problems found\n",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("bad mapping: STDERR %q does not contain %q", stderr, want)
+		}
+	}
+	if code != ExitUsage || len(stdout) > 0 {
+		t.Errorf("bad mapping: exit code %d, STDOUT %q", code, stdout)
+	}
+
+	// The summary is written into the output file
+	writeFiles(t, dir, map[string]string{defaultConfigName: "Version=version\n"})
+	out := filepath.Join(dir, "out", "check.txt")
+	stdout, stderr, code = runMain(t, dir, nil, cmdConfig, cmdConfigCheck, "-o", out)
+	if code != ExitOk || len(stdout) > 0 {
+		t.Errorf("-o: exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	if data, err := ioutil.ReadFile(out); err != nil || string(data) != "OK: 1 mappings from 1 sources\n" {
+		t.Errorf("-o: output %q, %v", data, err)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	broken, cleanupBroken := tempDir(t)
+	defer cleanupBroken()
+	writeFiles(t, broken, testProject)
+	if err := os.Mkdir(filepath.Join(broken, gitDirName), dirPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		dir    string
+		config string
+		files  map[string]string
+		args   []string
+		code   int
+	}{
+		{"ok", dir, "", nil, []string{"-m", "Version=version"}, ExitOk},
+		{"no repository", broken, "", nil, []string{"-m", "Version=version", "-repo", filepath.Join(broken, "sub")}, ExitOk},
+		{"unknown flag", dir, "", nil, []string{"-unknown"}, ExitUsage},
+		{"invalid mapping", dir, "", nil, []string{"-m", "Version=unknown"}, ExitUsage},
+		{"invalid option", dir, "", nil, []string{"-m", "Version=version(unknown=1)"}, ExitUsage},
+		{"invalid config", dir, "Version = version\nCommit\n", nil, nil, ExitUsage},
+		{"invalid format", dir, "", nil, []string{"-format", "unknown"}, ExitUsage},
+		{"broken file", dir, "", map[string]string{"broken.go": "package main\n\nvar Version {"}, []string{"-m", "Version=version"}, ExitOk},
+		{"broken file strict", dir, "", map[string]string{"broken.go": "package main\n\nvar Version {"}, []string{"-strict", "-m", "Version=version"}, ExitScan},
+		{"broken repository", broken, "", nil, []string{"-m", "Version=version"}, ExitGit},
+		{"unwritable output", dir, "", nil, []string{"-m", "Version=version", "-o", filepath.Join(dir, "main.go", "out")}, ExitOutput},
+		{"checked", dir, "", nil, []string{"-check", "-m", "Version=version"}, ExitOk},
+		{"not stamped", dir, "", nil, []string{"-check", "-m", "Other=version"}, ExitNotStamped},
+	}
+	for _, tt := range tests {
+		files := make(map[string]string)
+		for name, data := range tt.files {
+			files[name] = data
+		}
+		if len(tt.config) > 0 {
+			files[defaultConfigName] = tt.config
+		}
+		writeFiles(t, tt.dir, files)
+
+		if _, stderr, code := runMain(t, tt.dir, nil, tt.args...); code != tt.code {
+			t.Errorf("%s: exit code %d, want %d, STDERR %s", tt.name, code, tt.code, stderr)
+		}
+		for name := range files {
+			_ = os.Remove(filepath.Join(tt.dir, name))
+		}
+	}
+}
+
+func TestUntaggedRepository(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject)
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := testCommit(t, repo, dir, map[string]string{"README": "app\n"})
+
+	// The version gives no -X flag and no error, so the rest is stamped as usual
+	tests := []struct {
+		args []string
+		want string
+		code int
+	}{
+		{[]string{"-m", "Version=version"}, "", ExitOk},
+		{[]string{"-m", "Version=version,Commit=hash"}, "-X main.Commit=" + hash, ExitOk},
+		{[]string{"-m", "Version=tag,Commit=hash"}, "-X main.Commit=" + hash, ExitOk},
+		{[]string{"-m", "Version=version", "-wrap"}, ldflagsPrefix, ExitOk},
+		{[]string{"-m", "Version=version", "-format", FormatEnv}, "", ExitOk},
+		{[]string{"-print", GenVersion}, "", ExitOk},
+		{[]string{"-m", "Version=version", "-check"}, "", ExitNotStamped},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, nil, tt.args...)
+		if code != tt.code || len(stderr) > 0 {
+			t.Errorf("%v: exit code %d, want %d, STDERR %s", tt.args, code, tt.code, stderr)
+		}
+		if tt.code == ExitOk && stdout != tt.want {
+			t.Errorf("%v: STDOUT %q, want %q", tt.args, stdout, tt.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, map[string]string{
+		"go.mod":       "module example.com/app\n",
+		"main.go":      "package main\n\nvar (\n\tVersion string\n\tCommit  string\n\tCount   int\n\tRatio   float64\n\tMissing string\n\tFail    string\n)\n\nfunc main() {}\n",
+		"main_test.go": "package main\n\nvar BuildTime string\n",
+		".hidden/x.go": "package hidden\n\nvar Version string\n",
+		"ignored.go":   "// +build ignore\n\npackage main\n\nvar GitCommit string\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// Every target is listed with the value it would get, including empty values and errors,
+	// and every skipped candidate with the reason, while no flags are printed
+	stdout, stderr, code := runMain(t, dir, nil, "-dry-run",
+		"-m", "Version=version,Commit=hash_short,Count=tag,Ratio=tag,Missing=env:APP_MISSING,BuildTime=tag,GitCommit=hash_long,Fail=exec:false")
+	want := "FILE     PACKAGE  VARIABLE  GENERATOR        VALUE\n" +
+		"main.go  main     Commit    hash_short       " + hash[:7] + "\n" +
+		"main.go  main     Fail      exec:false       <error: command false failed: exit status 1>\n" +
+		"main.go  main     Missing   env:APP_MISSING  <empty, flag skipped>\n" +
+		"main.go  main     Version   version          v1.2.3\n" +
+		"Skipped:\n" +
+		"  - example.com/app/.hidden.Version (.hidden/x.go): declared in excluded directory\n" +
+		"  - main.BuildTime (main_test.go): declared in test file\n" +
+		"  - main.Count (main.go): integer variable with non-numeric generator\n" +
+		"  - main.GitCommit (ignored.go): excluded by build constraints\n" +
+		"  - main.Ratio (main.go): not a string variable\n"
+	if code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT\n%s\nwant\n%s\nSTDERR %s", code, stdout, want, stderr)
+	}
+
+	// Nothing found is told too
+	stdout, _, code = runMain(t, dir, nil, "-dry-run", "-m", "Unknown=version")
+	if code != ExitOk || stdout != "No targets found\n" {
+		t.Errorf("no targets: exit code %d, STDOUT %q", code, stdout)
+	}
+}
+
+func TestDefaultVersion(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "release", "backend/v2.0.0")
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fallback applies only when no tag is the version, e.g. tags which are not versions
+	// or are filtered out by the prefix
+	if got := runPrint(t, dir, GenVersion, "-default-version", "v0.0.0-dev"); got != "v0.0.0-dev" {
+		t.Errorf("no version tags: %q, want v0.0.0-dev", got)
+	}
+	if got := runPrint(t, dir, GenVersion, "-tag-prefix", "backend/", "-default-version", "v0.0.0-dev"); got != "v2.0.0" {
+		t.Errorf("version tag with the prefix: %q, want v2.0.0", got)
+	}
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version", "-default-version", "v0.0.0-dev")
+	if code != ExitOk || stdout != "-X main.Version=v0.0.0-dev" {
+		t.Errorf("mapping: exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+
+	// Without the fallback the version is empty and not stamped
+	if got := runPrint(t, dir, GenVersion); got != "" {
+		t.Errorf("no fallback: %q, want nothing", got)
+	}
+
+	// Once the version is tagged, the fallback is ignored
+	testTag(t, repo, "v1.2.3")
+	if got := runPrint(t, dir, GenVersion, "-default-version", "v0.0.0-dev"); got != "v1.2.3" {
+		t.Errorf("tagged: %q, want v1.2.3", got)
+	}
+}
+
+func TestEmptyPlaceholder(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject)
+	defer cleanup()
+
+	// Every output stamps the placeholder instead of the empty version of the untagged repository
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "-X main.Version=dev"},
+		{[]string{"-format", FormatLines}, "-X main.Version=dev\n"},
+		{[]string{"-format", FormatBazel}, "{\n  \"main.Version\": \"dev\"\n}\n"},
+		{[]string{"-format", FormatDocker}, "--build-arg VERSION=dev"},
+		{[]string{"-format", FormatEnv}, defaultEnvPrefix + "VERSION=dev\n"},
+		{[]string{"-format", FormatMake}, defaultEnvPrefix + "LDFLAGS := -X main.Version=dev\n" + defaultEnvPrefix + "VERSION := dev\n"},
+		// GoReleaser resolves the template of the version when it releases the tag
+		{[]string{"-format", FormatGoReleaser}, "ldflags:\n  - -X main.Version={{.Tag}}\n"},
+		{[]string{"-github"}, "Version=dev\n"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-m", "Version=version", "-empty", "dev"}, tt.args...)
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+}
+
+func TestValueAffixes(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	short := hash[:shortHashLength]
+
+	// Affixes apply only to the version, so are the same in every output
+	affixes := []string{"-value-prefix", "build-", "-value-suffix", "-rc", "-value-gens", GenVersion}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "-X main.Commit=" + short + " -X main.Version=build-v1.2.3-rc"},
+		{[]string{"-format", FormatBazel}, "{\n  \"main.Commit\": \"" + short + "\",\n  \"main.Version\": \"build-v1.2.3-rc\"\n}\n"},
+		{[]string{"-format", FormatDocker}, "--build-arg COMMIT=" + short + " --build-arg VERSION=build-v1.2.3-rc"},
+		{[]string{"-format", FormatEnv}, defaultEnvPrefix + "HASH_SHORT=" + short + "\n" + defaultEnvPrefix + "VERSION=build-v1.2.3-rc\n"},
+		{[]string{"-format", FormatMake}, defaultEnvPrefix + "LDFLAGS := -X main.Commit=" + short + " -X main.Version=build-v1.2.3-rc\n" +
+			defaultEnvPrefix + "HASH_SHORT := " + short + "\n" + defaultEnvPrefix + "VERSION := build-v1.2.3-rc\n"},
+		{[]string{"-format", FormatGoReleaser}, "ldflags:\n  - -X main.Commit={{.ShortCommit}}\n  - -X main.Version=build-{{.Tag}}-rc\n"},
+		{[]string{"-github"}, "Commit=" + short + "\nVersion=build-v1.2.3-rc\n"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{"-m", "Version=version,Commit=hash_short"}, affixes...), tt.args...)
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// The generated Go source has affixed values too
+	if _, stderr, code := runMain(t, dir, nil, append([]string{"-m", "Version=version", "-emit-go", "version_gen.go"}, affixes...)...); code != ExitOk {
+		t.Fatalf("-emit-go: exit code %d, STDERR %s", code, stderr)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "version_gen.go")); err != nil || !strings.Contains(string(data), `Version = "build-v1.2.3-rc"`) {
+		t.Errorf("generated source %s, %v", data, err)
+	}
+
+	// The empty value stays empty, so the variable is not stamped in any output
+	empty := []struct {
+		format string
+		want   string
+	}{
+		{FormatLDFlags, "-X main.Version=build-v1.2.3"},
+		{FormatEnv, defaultEnvPrefix + "VERSION=build-v1.2.3\n"},
+		{FormatDocker, "--build-arg VERSION=build-v1.2.3"},
+	}
+	for _, tt := range empty {
+		stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=version,Commit=env:APP_MISSING", "-value-prefix", "build-", "-format", tt.format)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%s: exit code %d, STDOUT %q, want %q, STDERR %s", tt.format, code, stdout, tt.want, stderr)
+		}
+	}
+}
+
+func TestMultipleMappings(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{defaultConfigName: "Version=tag\n"})
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-m", "Version=version", "-m", "Commit=hash"}, "-X main.Commit=" + hash + " -X main.Version=v1.2.3"},
+		{[]string{"-m", "Commit=hash_short", "-m", "Commit=hash:4"}, "-X main.Commit=" + hash[:4] + " -X main.Version=v1.2.3"},
+		{[]string{"-m", "Version=version(suffix=-a),Commit=hash:4", "-m", "Version=version(suffix=-b)"}, "-X main.Commit=" + hash[:4] + " -X main.Version=v1.2.3-b"},
+		{[]string{"-m", "Version=commit_count", "-m", "Commit=hash:4"}, "-X main.Commit=" + hash[:4] + " -X main.Version=1"},
+		{[]string{"-m", "Version|Commit=hash:4"}, "-X main.Commit=" + hash[:4] + " -X main.Version=" + hash[:4]},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, nil, tt.args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// The invalid mapping fails whichever -m gives it
+	if _, _, code := runMain(t, dir, nil, "-m", "Version=version", "-m", "Commit=unknown"); code != ExitUsage {
+		t.Errorf("invalid second mapping: exit code %d, want %d", code, ExitUsage)
+	}
+}
+
+func TestStringsFlag(t *testing.T) {
+	var f stringsFlag
+	for _, s := range []string{"A=version", "B=tag", "A=hash"} {
+		if err := f.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f) != 3 || f[0] != "A=version" || f[2] != "A=hash" {
+		t.Errorf("values %q", []string(f))
+	}
+}
+
+func TestAheadBehind(t *testing.T) {
+	dir, base, cleanup := testRepo(t, testProject)
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := head.Name().Short()
+
+	// The upstream has one commit the branch does not have, and the branch has three the upstream does not
+	remote := testCommit(t, repo, dir, map[string]string{"REMOTE": "remote\n"})
+	testReset(t, repo, base)
+	var local string
+	for i := 0; i < 3; i++ {
+		local = testCommit(t, repo, dir, map[string]string{"LOCAL": strconv.Itoa(i) + "\n"})
+	}
+
+	// Without the tracking branch the value is empty
+	if got := runPrint(t, dir, GenAheadBehind); got != "" {
+		t.Errorf("no upstream: %q", got)
+	}
+
+	// The tracking branch which is not fetched yet gives the empty value too
+	if err := repo.CreateBranch(&config.Branch{Name: branch, Remote: "origin", Merge: plumbing.NewBranchReferenceName(branch)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenAheadBehind); got != "" {
+		t.Errorf("upstream not fetched: %q", got)
+	}
+
+	upstream := plumbing.NewHashReference(plumbing.NewRemoteReferenceName("origin", branch), plumbing.NewHash(remote))
+	if err := repo.Storer.SetReference(upstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenAheadBehind); got != "+3-1" {
+		t.Errorf("diverged: %q, want +3-1", got)
+	}
+
+	// The upstream at HEAD is neither ahead nor behind
+	upstream = plumbing.NewHashReference(upstream.Name(), plumbing.NewHash(local))
+	if err := repo.Storer.SetReference(upstream); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenAheadBehind); got != "+0-0" {
+		t.Errorf("up to date: %q, want +0-0", got)
+	}
+
+	// The local branch is tracked with the remote .
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("main"), plumbing.NewHash(remote))); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteBranch(branch); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateBranch(&config.Branch{Name: branch, Remote: currentDir, Merge: plumbing.NewBranchReferenceName("main")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenAheadBehind); got != "+3-1" {
+		t.Errorf("local upstream: %q, want +3-1", got)
+	}
+
+	// The detached HEAD has no upstream
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, plumbing.NewHash(local))); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenAheadBehind); got != "" {
+		t.Errorf("detached HEAD: %q", got)
+	}
+}
+
+func TestOnTag(t *testing.T) {
+	tests := []struct {
+		name  string
+		tags  []string
+		ahead bool
+		args  []string
+		want  string
+	}{
+		{name: "on tag", tags: []string{"v1.2.3"}, want: "true"},
+		{name: "ahead of tag", tags: []string{"v1.2.3"}, ahead: true, want: "false"},
+		{name: "no tags", want: "false"},
+		{name: "one of tags is the version", tags: []string{"latest", "v1.2.3", "stable"}, want: "true"},
+		{name: "no version tags", tags: []string{"latest", "release-1"}, want: "false"},
+		{name: "tag prefix", tags: []string{"backend/v1.2.3"}, args: []string{"-tag-prefix", "backend/"}, want: "true"},
+		{name: "other prefix", tags: []string{"v1.2.3", "frontend/v2.0.0"}, args: []string{"-tag-prefix", "backend/"}, want: "false"},
+	}
+	for _, tt := range tests {
+		dir, _, cleanup := testRepo(t, testProject, tt.tags...)
+		if tt.ahead {
+			repo, err := git.PlainOpen(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testCommit(t, repo, dir, map[string]string{"README": "app\n"})
+		}
+		if got := runPrint(t, dir, GenOnTag, tt.args...); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+		cleanup()
+	}
+
+	// The annotated tag points to the tag object, which points to HEAD
+	dir, hash, cleanup := testRepo(t, testProject)
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "Tester", Email: "tester@example.com", When: time.Unix(1600000000, 0)}
+	if _, err := repo.CreateTag("v1.2.3", plumbing.NewHash(hash), &git.CreateTagOptions{Tagger: sig, Message: "release"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenOnTag); got != "true" {
+		t.Errorf("annotated tag: %q, want true", got)
+	}
+	testCommit(t, repo, dir, map[string]string{"README": "app\n"})
+	if got := runPrint(t, dir, GenOnTag); got != "false" {
+		t.Errorf("ahead of annotated tag: %q, want false", got)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject)
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := commit.TreeHash.String()
+
+	if got := runPrint(t, dir, GenTreeHash); got != tree {
+		t.Errorf("tree hash %q, want %q", got, tree)
+	}
+	if stdout, stderr, code := runMain(t, dir, nil, "-m", "Commit=tree_hash"); code != ExitOk || stdout != "-X main.Commit="+tree {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+
+	// The commit of the same content has the same tree, the commit of other content does not
+	if next := testCommit(t, repo, dir, nil); next == hash {
+		t.Fatal("the empty commit is not made")
+	}
+	if got := runPrint(t, dir, GenTreeHash); got != tree {
+		t.Errorf("tree hash of the empty commit %q, want %q", got, tree)
+	}
+	changed, err := repo.CommitObject(plumbing.NewHash(testCommit(t, repo, dir, map[string]string{"README": "app\n"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenTreeHash); got == tree || got != changed.TreeHash.String() {
+		t.Errorf("tree hash of changed content %q, want %q", got, changed.TreeHash.String())
+	}
+}
+
+func TestExecGenerator(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not found")
+	}
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+
+	// The output is trimmed, arguments can be quoted and the command runs in the repository directory
+	tests := []struct {
+		gen  string
+		want string
+	}{
+		{"exec:echo hello", "hello"},
+		{`exec:printf " a b \n\n"`, "a b"},
+		{"exec:sh -c 'echo $0 $1' x 'y z'", "x y z"},
+		{"exec:pwd", dir},
+		{"exec:true", ""},
+	}
+	for _, tt := range tests {
+		if got := runPrint(t, dir, tt.gen); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.gen, got, tt.want)
+		}
+	}
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=exec:echo custom")
+	if code != ExitOk || stdout != "-X main.Version=custom" {
+		t.Errorf("mapping: exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+
+	// Failed commands are errors with the exit status and STDERR of the command
+	failures := []struct {
+		gen  string
+		want string
+	}{
+		{"exec:sh -c 'echo oops >&2; exit 3'", "command sh -c 'echo oops >&2; exit 3' failed: exit status 3: oops"},
+		{"exec:false", "command false failed: exit status 1"},
+		{"exec:goxver-missing-command", "command goxver-missing-command failed"},
+	}
+	for _, tt := range failures {
+		stdout, stderr, code := runMain(t, dir, nil, "-m", "Version="+tt.gen)
+		if code != ExitFail || len(stdout) > 0 || !strings.Contains(stderr, tt.want) {
+			t.Errorf("%s: exit code %d, STDOUT %q, STDERR %q, want %q", tt.gen, code, stdout, stderr, tt.want)
+		}
+	}
+
+	// The command line is parsed with the mapping, so unbalanced quotes are the usage error
+	_, stderr, code = runMain(t, dir, nil, "-m", `Version=exec:echo "unterminated`)
+	if code != ExitUsage || !strings.Contains(stderr, "unterminated quote") {
+		t.Errorf("unterminated quote: exit code %d, STDERR %q", code, stderr)
+	}
+}
+
+func TestEnvGenerator(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	env := []string{"BUILD_ID=42", "PIPELINE=ci #7", "EMPTY="}
+
+	// Variables set are stamped as they are, the empty one is stamped with nothing
+	// but without the warning, and the fallback replaces both the empty and the missing value
+	tests := []struct {
+		args   []string
+		want   string
+		stderr string
+	}{
+		{[]string{"-m", "Version=env:BUILD_ID"}, "-X main.Version=42", ""},
+		{[]string{"-m", "Version=env:PIPELINE"}, "-X 'main.Version=ci #7'", ""},
+		{[]string{"-m", "Version=env:BUILD_ID,Commit=env:EMPTY"}, "-X main.Version=42", ""},
+		{[]string{"-m", "Version=env:BUILD_ID,Commit=env:MISSING"}, "-X main.Version=42", warnPrefix + "environment variable MISSING is not set\n"},
+		{[]string{"-m", "Version=env:MISSING|local"}, "-X main.Version=local", warnPrefix + "environment variable MISSING is not set\n"},
+		{[]string{"-m", "Version=env:EMPTY|local"}, "-X main.Version=local", ""},
+		{[]string{"-m", "Version=env:BUILD_ID", "-format", FormatEnv}, "GOXVER_ENV_BUILD_ID=42\n", ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, env, tt.args...)
+		if code != ExitOk || stdout != tt.want || stderr != tt.stderr {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %q, want %q", tt.args, code, stdout, tt.want, stderr, tt.stderr)
+		}
+	}
+
+	// The name of the variable is required
+	if _, stderr, code := runMain(t, dir, env, "-m", "Version=env:"); code != ExitUsage || !strings.Contains(stderr, "invalid generator env:") {
+		t.Errorf("no name: exit code %d, STDERR %s", code, stderr)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not found")
+	}
+	defer func(timeout time.Duration) { execTimeout = timeout }(execTimeout)
+	execTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if _, err := runCommand("sleep 5"); err == nil || !strings.Contains(err.Error(), "command sleep 5 timed out after 100ms") {
+		t.Errorf("error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("command is not stopped, it runs %s", elapsed)
+	}
+}
+
+func TestCommitter(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+
+	// The author is the committer without rebase
+	if got := runPrint(t, dir, GenCommitter); got != "Tester" {
+		t.Errorf("committer %q, want Tester", got)
+	}
+	if got := runPrint(t, dir, GenCommitterEmail); got != "tester@example.com" {
+		t.Errorf("committer_email %q, want tester@example.com", got)
+	}
+
+	// The commit rebased or cherry-picked keeps the author and changes the committer
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"README": "picked\n"})
+	if _, err := wt.Add("README"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = wt.Commit("picked", &git.CommitOptions{
+		Author:    &object.Signature{Name: "Author", Email: "author@example.com", When: time.Unix(1500000000, 0)},
+		Committer: &object.Signature{Name: "Release Bot", Email: "bot@example.com", When: time.Unix(1600000000, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runPrint(t, dir, GenCommitter); got != "Release Bot" {
+		t.Errorf("committer %q, want Release Bot", got)
+	}
+	if got := runPrint(t, dir, GenCommitterEmail); got != "bot@example.com" {
+		t.Errorf("committer_email %q, want bot@example.com", got)
+	}
+
+	// Names with spaces are quoted in -X flags
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=committer", "-m", "Commit=committer_email")
+	if want := "-X main.Commit=bot@example.com -X 'main.Version=Release Bot'"; code != ExitOk || stdout != want {
+		t.Errorf("exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, want, stderr)
+	}
+}
+
+// testStoreCommit stores the commit object built by hand in the repository and moves
+// the current branch to it. It returns the hash of the commit.
+func testStoreCommit(t *testing.T, repo *git.Repository, commit *object.Commit) string {
+	t.Helper()
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash)); err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func TestSigned(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := runPrint(t, dir, GenSigned); got != "false" {
+		t.Errorf("unsigned commit: %q, want false", got)
+	}
+
+	// Only the presence of the signature matters, it is not verified
+	head, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &object.Commit{
+		Author:       head.Author,
+		Committer:    head.Committer,
+		Message:      "signed\n",
+		TreeHash:     head.TreeHash,
+		ParentHashes: []plumbing.Hash{head.Hash},
+		PGPSignature: "-----BEGIN PGP SIGNATURE-----\n\nnot verified\n-----END PGP SIGNATURE-----\n",
+	}
+	signedHash := testStoreCommit(t, repo, signed)
+	if got := runPrint(t, dir, GenSigned); got != "true" {
+		t.Errorf("signed commit: %q, want true", got)
+	}
+	stdout, stderr, code := runMain(t, dir, nil, "-m", "Version=signed")
+	if code != ExitOk || stdout != "-X main.Version=true" {
+		t.Errorf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+
+	// The unsigned commit on top of the signed one is reported unsigned
+	unsigned := *signed
+	unsigned.Message, unsigned.PGPSignature = "unsigned\n", ""
+	unsigned.ParentHashes = []plumbing.Hash{plumbing.NewHash(signedHash)}
+	testStoreCommit(t, repo, &unsigned)
+	if got := runPrint(t, dir, GenSigned); got != "false" {
+		t.Errorf("unsigned commit after the signed one: %q, want false", got)
+	}
+}
+
+func TestRootHash(t *testing.T) {
+	dir, root, cleanup := testRepo(t, testProject)
+	defer cleanup()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The initial commit of the linear history
+	if got := runPrint(t, dir, GenRootHash); got != root {
+		t.Errorf("single commit: %s, want %s", got, root)
+	}
+	testCommit(t, repo, dir, map[string]string{"README": "one\n"})
+	head := testCommit(t, repo, dir, map[string]string{"README": "two\n"})
+	if got := runPrint(t, dir, GenRootHash); got != root {
+		t.Errorf("linear history: %s, want %s", got, root)
+	}
+	if got := runPrint(t, dir, GenRootHash+"(upper=true)"); got != strings.ToUpper(root) {
+		t.Errorf("upper: %s, want %s", got, strings.ToUpper(root))
+	}
+
+	// The history merged with the unrelated one has two roots and the oldest one is taken
+	tip, err := repo.CommitObject(plumbing.NewHash(head))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merge := func(when int64) (orphan string) {
+		sig := object.Signature{Name: "Tester", Email: "tester@example.com", When: time.Unix(when, 0)}
+		orphan = testStoreCommit(t, repo, &object.Commit{Author: sig, Committer: sig, Message: "orphan\n", TreeHash: tip.TreeHash})
+		testStoreCommit(t, repo, &object.Commit{
+			Author:       tip.Author,
+			Committer:    tip.Committer,
+			Message:      "merge\n",
+			TreeHash:     tip.TreeHash,
+			ParentHashes: []plumbing.Hash{tip.Hash, plumbing.NewHash(orphan)},
+		})
+		return orphan
+	}
+	merge(1700000000)
+	if got := runPrint(t, dir, GenRootHash); got != root {
+		t.Errorf("merged newer root: %s, want %s", got, root)
+	}
+	older := merge(1500000000)
+	if got := runPrint(t, dir, GenRootHash); got != older {
+		t.Errorf("merged older root: %s, want %s", got, older)
+	}
+
+	// Roots of the same time are ordered by hash to stay stable
+	same := merge(1600000000)
+	want := root
+	if same < root {
+		want = same
+	}
+	if got := runPrint(t, dir, GenRootHash); got != want {
+		t.Errorf("merged root of the same time: %s, want %s", got, want)
+	}
+}
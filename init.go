@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// initConfig scans the project for string variables with conventional names of DefaultMappings,
+// the same ones -defaults maps, and writes the mapping proposed for them into the configuration
+// file of the root directory. The existing configuration file is overwritten only with -f,
+// the TOML one is rewritten in TOML. It returns ExitNotStamped if no variables are found.
+func initConfig() int {
+	root, err := filepath.Abs(rootDir)
+	if err != nil || !fileExists(root) {
+		fail(ExitUsage, "path does not exist", nil)
+	}
+	rootDir = root
+
+	path := filepath.Join(root, defaultConfigName)
+	if tomlPath := filepath.Join(root, tomlConfigName); fileExists(tomlPath) {
+		path = tomlPath
+	}
+	if fileExists(path) && !forceInit {
+		fail(ExitUsage, path+" exists, use -f to overwrite it", nil)
+	}
+
+	pkg, err := rootPkg(root)
+	if err != nil {
+		fail(ExitScan, "failed to find root package", err)
+	}
+	rootPackage = pkg
+
+	// Scan only for conventional names, annotated variables need no mappings
+	targetDict = make(TargetMap)
+	mergeMapping(DefaultMappings, SourceBuiltin)
+	targets, _, err := findAllTargets(root)
+	if err != nil {
+		if strict {
+			fail(ExitScan, "failed to scan targets", err)
+		}
+		warn(nil, "failed to scan targets: %s\n", err.Error())
+	}
+	proposed := make(TargetMap)
+	for _, t := range targets {
+		if t.Type == typeString && !isAnnotation(t.Key) {
+			proposed[t.Key] = t.GenSpec()
+		}
+	}
+	if len(proposed) == 0 {
+		fmt.Println("No variables with conventional names found")
+		return ExitNotStamped
+	}
+
+	content := formatInitConfig(proposed, strings.EqualFold(filepath.Ext(path), extTOML))
+	if err := writeFileAtomic(path, []byte(content)); err != nil {
+		fail(ExitOutput, "failed to write configuration file", err)
+	}
+	fmt.Printf("Written %s:\n%s", path, content)
+	return ExitOk
+}
+
+// formatInitConfig formats mappings sorted by names as the line configuration or as TOML one.
+func formatInitConfig(m TargetMap, isTOML bool) string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	if isTOML {
+		sb.WriteString(tomlTableStart + "targets]\n")
+	}
+	for _, name := range names {
+		if isTOML {
+			sb.WriteString(strconv.Quote(name) + " = " + strconv.Quote(m[name]) + "\n")
+		} else {
+			sb.WriteString(name + mapAssignment + m[name] + "\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFixture reads files of the fixture project under testdata by their slash separated paths.
+func readFixture(t *testing.T, name string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	root := filepath.Join("testdata", name)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestInitConfig(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, readFixture(t, filepath.Join("init", "app")), "v1.2.3")
+	defer cleanup()
+	path := filepath.Join(dir, defaultConfigName)
+
+	// Only string variables with names of DefaultMappings outside of tests are proposed
+	const want = "BuildDate=time\nCommit=hash_short\nGitCommit=hash_long\nVersion=version\n"
+	stdout, stderr, code := runMain(t, dir, nil, cmdInit)
+	if code != ExitOk || stdout != "Written "+path+":\n"+want {
+		t.Fatalf("exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != want {
+		t.Fatalf("configuration %q, %v, want %q", data, err, want)
+	}
+
+	// The configuration written stamps the same variables -defaults does,
+	// the time is mapped to the version to compare outputs
+	configured, stderr, code := runMain(t, dir, nil, "-m", "BuildDate=version")
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+	for _, flag := range []string{"-X main.Version=v1.2.3", "-X main.Commit=" + hash[:7], "-X example.com/app/internal/info.GitCommit=" + hash, "-X main.Revision=" + hash} {
+		if !strings.Contains(configured, flag) {
+			t.Errorf("%s is not in %s", flag, configured)
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	defaults, _, _ := runMain(t, dir, nil, "-defaults", "-m", "BuildDate=version")
+	if defaults != configured {
+		t.Errorf("with -defaults\n%s\nwith the configuration\n%s", defaults, configured)
+	}
+
+	// The existing configuration is overwritten only with -f
+	writeFiles(t, dir, map[string]string{defaultConfigName: "Version=tag\n"})
+	if _, _, code := runMain(t, dir, nil, cmdInit); code != ExitUsage {
+		t.Errorf("existing configuration: exit code %d, want %d", code, ExitUsage)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "Version=tag\n" {
+		t.Errorf("configuration is overwritten without -f: %q", data)
+	}
+	if _, stderr, code := runMain(t, dir, nil, cmdInit, "-f"); code != ExitOk {
+		t.Errorf("-f: exit code %d, STDERR %s", code, stderr)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != want {
+		t.Errorf("-f: configuration %q, want %q", data, want)
+	}
+
+	// The TOML configuration is rewritten in TOML
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{tomlConfigName: "[targets]\n"})
+	if _, stderr, code := runMain(t, dir, nil, cmdInit, "-f"); code != ExitOk {
+		t.Errorf("TOML: exit code %d, STDERR %s", code, stderr)
+	}
+	const wantTOML = "[targets]\n\"BuildDate\" = \"time\"\n\"Commit\" = \"hash_short\"\n\"GitCommit\" = \"hash_long\"\n\"Version\" = \"version\"\n"
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, tomlConfigName)); string(data) != wantTOML {
+		t.Errorf("TOML configuration %q, want %q", data, wantTOML)
+	}
+}
+
+func TestInitConfigNothingFound(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		"go.mod":  "module example.com/app\n",
+		"main.go": "package main\n\nvar Release string\n\nfunc main() {}\n",
+	})
+
+	if _, _, code := runMain(t, dir, nil, cmdInit); code != ExitNotStamped {
+		t.Errorf("exit code %d, want %d", code, ExitNotStamped)
+	}
+	if fileExists(filepath.Join(dir, defaultConfigName)) {
+		t.Error("configuration is written")
+	}
+}
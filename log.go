@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Log formats
+const (
+	LogFormatText = "text" // Free-form messages
+	LogFormatJSON = "json" // One JSON object per message
+)
+
+// Log levels
+const (
+	levelDebug = "debug" // Details of decisions printed only with -vv
+	levelInfo  = "info"
+	levelWarn  = "warn"
+)
+
+// warnPrefix starts warnings in text log format.
+const warnPrefix = "Warning: "
+
+// Fields are contextual fields of the log message, e.g. file, target, generator or duration.
+type Fields map[string]interface{}
+
+// msg formats and prints message to STDERR if verbose mode is enabled
+func msg(s string, args ...interface{}) {
+	logMessage(levelInfo, nil, s, args...)
+}
+
+// msgWith formats and prints message with contextual fields to STDERR if verbose mode is enabled.
+// Fields are printed only in JSON log format.
+func msgWith(fields Fields, s string, args ...interface{}) {
+	logMessage(levelInfo, fields, s, args...)
+}
+
+// debug formats and prints the detailed message with contextual fields to STDERR
+// if very verbose mode is enabled, e.g. why source files are scanned or skipped.
+func debug(fields Fields, s string, args ...interface{}) {
+	logMessage(levelDebug, fields, s, args...)
+}
+
+// warn formats and prints warning with contextual fields to STDERR whatever the verbosity is.
+func warn(fields Fields, s string, args ...interface{}) {
+	logMessage(levelWarn, fields, s, args...)
+}
+
+// logMessage prints the message in the log format selected, warnings always and other messages
+// if verbose mode is enabled. In JSON log format the message is the single line object
+// with level, msg and fields.
+func logMessage(level string, fields Fields, s string, args ...interface{}) {
+	if level != levelWarn && (!verbose || (level == levelDebug && !veryVerbose)) {
+		return
+	}
+
+	text := fmt.Sprintf(s, args...)
+	if logFormat != LogFormatJSON {
+		if level == levelWarn {
+			text = warnPrefix + text
+		}
+		_, _ = fmt.Fprint(os.Stderr, text)
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+2)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["level"] = level
+	entry["msg"] = strings.TrimSpace(text)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"level": level, "msg": strings.TrimSpace(text)})
+	}
+	_, _ = os.Stderr.Write(append(data, '\n'))
+}
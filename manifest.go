@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// Manifest records what is stamped into the binary, so the release can archive it.
+type Manifest struct {
+	Commit    string           `json:"commit"`
+	BuildTime string           `json:"build_time"`
+	Targets   []ManifestTarget `json:"targets"`
+}
+
+// ManifestTarget is the variable stamped with the value of the generator.
+type ManifestTarget struct {
+	Pkg   string `json:"pkg"`
+	Var   string `json:"var"`
+	Gen   string `json:"generator"`
+	Value string `json:"value"`
+}
+
+// writeManifest writes the JSON manifest of variables stamped, that is values of targets which are
+// not empty, with the HEAD commit hash and the time of the build in UTC. Values are the ones the output
+// has since all of them are generated once, see generateTargetValues.
+func writeManifest(repo *git.Repository, values []TargetValue, path string) error {
+	doc := Manifest{
+		BuildTime: time.Now().UTC().Format(time.RFC3339),
+		Targets:   []ManifestTarget{},
+	}
+	var err error
+	if doc.Commit, err = readGitHEAD(repo); err != nil {
+		return err
+	}
+	for _, v := range values {
+		if len(v.Value) > 0 {
+			doc.Targets = append(doc.Targets, ManifestTarget{Pkg: v.Pkg, Var: v.Var, Gen: v.GenSpec(), Value: v.Value})
+		}
+	}
+
+	out, err := json.MarshalIndent(doc, "", strings.Repeat(" ", manifestIndent))
+	if err != nil {
+		return err
+	}
+	msgWith(Fields{"file": path}, "Writing manifest to %s\n", path)
+	return writeFileAtomic(path, append(out, '\n'))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options generators accept given as gen(key=value,...)
+const (
+	OptFormat = "format" // The layout of the time in Go format, e.g. 2006-01-02
+	OptUTC    = "utc"    // Convert the time to UTC, true or false
+	OptUpper  = "upper"  // Convert the value to upper case, true or false
+	OptPrefix = "prefix" // Put the text before the non-empty stamped value, overrides -value-prefix
+	OptSuffix = "suffix" // Put the text after the non-empty stamped value, overrides -value-suffix
+)
+
+// Syntax of generator options
+const (
+	optionsStart       = "("
+	optionsEnd         = ")"
+	optionSeparator    = ","
+	optionAssignment   = "="
+	fallbackSeparator  = "|"
+	quoteChar          = '"'
+	escapeChar         = '\\'
+	openingParenthesis = '('
+	closingParenthesis = ')'
+)
+
+// GenOptionNames lists options each generator accepts.
+var GenOptionNames = map[string][]string{
+	GenTime:      {OptFormat, OptUTC},
+	GenHashShort: {OptUpper},
+	GenHashLong:  {OptUpper},
+	GenHash:      {OptUpper},
+	GenTreeHash:  {OptUpper},
+	GenRootHash:  {OptUpper},
+}
+
+// Options every generator accepts
+var commonOptions = []string{
+	OptPrefix,
+	OptSuffix,
+}
+
+// Boolean options which must be true or false
+var boolOptions = []string{
+	OptUTC,
+	OptUpper,
+}
+
+// GenOptions are options of the generator of the target, e.g. format=2006-01-02.
+type GenOptions map[string]string
+
+// Bool returns the value of the boolean option which is false if it is not given.
+func (opts GenOptions) Bool(name string) bool {
+	value, _ := strconv.ParseBool(opts[name])
+	return value
+}
+
+// String formats options as key=value,... sorted by keys.
+func (opts GenOptions) String() string {
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+optionAssignment+opts[key])
+	}
+	return strings.Join(pairs, optionSeparator)
+}
+
+// GenSpec returns the generator of the target with options and the fallback if any,
+// e.g. time(utc=true) or version|v0.0.0-dev.
+func (t Target) GenSpec() string {
+	spec := t.Gen
+	if len(t.Opts) > 0 {
+		spec += optionsStart + t.Opts.String() + optionsEnd
+	}
+	if len(t.Fallback) > 0 {
+		spec += fallbackSeparator + t.Fallback
+	}
+	return spec
+}
+
+// parseTargetSpec parses the generator with options followed by the optional fallback literal
+// in the format gen[(options)][|fallback], e.g. version|v0.0.0-dev. The fallback is everything
+// after the first | outside of the option list and it is used if the generator gives the empty value.
+func parseTargetSpec(s string) (gen string, opts GenOptions, fallback string, err error) {
+	parts, err := splitOutsideParens(s, fallbackSeparator)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if gen, opts, err = parseGenSpec(strings.TrimSpace(parts[0])); err != nil {
+		return "", nil, "", err
+	}
+	if len(parts) > 1 {
+		fallback = strings.TrimSpace(strings.Join(parts[1:], fallbackSeparator))
+		if fallback, err = unquoteValue(fallback); err != nil {
+			return "", nil, "", err
+		}
+	}
+	return gen, opts, fallback, nil
+}
+
+// parseGenSpec parses the generator with the optional parenthesized option list
+// in the format gen[(key=value[,key=value]*)], e.g. time(format=2006-01-02,utc=true).
+// The generator must be valid and options must be the ones the generator accepts.
+func parseGenSpec(s string) (gen string, opts GenOptions, err error) {
+	gen = s
+	if index := strings.Index(s, optionsStart); index >= 0 && strings.HasSuffix(s, optionsEnd) {
+		gen = s[:index]
+		list := s[index+len(optionsStart) : len(s)-len(optionsEnd)]
+		if opts, err = parseGenOptions(list); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if !isValidGen(gen) {
+		return "", nil, fmt.Errorf("invalid generator %s, valid generators are %s", gen, strings.Join(ValidGens, ", "))
+	}
+
+	name, _ := splitGen(gen)
+	for key, value := range opts {
+		if !containsString(GenOptionNames[name], key) && !containsString(commonOptions, key) {
+			return "", nil, fmt.Errorf("generator %s does not accept option %s", name, key)
+		}
+		if containsString(boolOptions, key) {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return "", nil, fmt.Errorf("invalid value %s of option %s, must be true or false", value, key)
+			}
+		} else if len(value) == 0 {
+			return "", nil, fmt.Errorf("empty value of option %s", key)
+		}
+	}
+	return gen, opts, nil
+}
+
+// parseGenOptions parses the comma separated list of key=value options.
+func parseGenOptions(list string) (GenOptions, error) {
+	opts := make(GenOptions)
+	if len(strings.TrimSpace(list)) == 0 {
+		return opts, nil
+	}
+	items, err := splitOutsideParens(list, optionSeparator)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		parts, err := splitOutsideParens(item, optionAssignment)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(key) == 0 {
+			return nil, fmt.Errorf("invalid option %s", item)
+		}
+		if _, ok := opts[key]; ok {
+			return nil, fmt.Errorf("duplicate option %s", key)
+		}
+		if opts[key], err = unquoteValue(strings.TrimSpace(parts[1])); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// mappingPart is the part of the mapping with the column it starts at.
+type mappingPart struct {
+	Text string
+	Col  int
+}
+
+// splitMapping splits the string by the separator which is neither inside parentheses, so commas
+// of option lists do not break the list of mappings, nor inside double quotes, where separators are
+// literal and the backslash escapes the next character. Parts are kept verbatim with columns they
+// start at counted from col, the column of the string, and errors tell the column of the problem.
+func splitMapping(s, sep string, col int) ([]mappingPart, error) {
+	var (
+		parts  []mappingPart
+		parens []int // Indexes of open parentheses
+		start  int
+		quote  = -1 // The index of the opening quote if inside quotes
+	)
+	for i := 0; i < len(s); i++ {
+		if quote >= 0 {
+			switch s[i] {
+			case escapeChar:
+				i++
+			case quoteChar:
+				quote = -1
+			}
+			continue
+		}
+		switch s[i] {
+		case quoteChar:
+			quote = i
+		case openingParenthesis:
+			parens = append(parens, i)
+		case closingParenthesis:
+			if len(parens) == 0 {
+				return nil, fmt.Errorf("unbalanced parenthesis at column %d", col+i)
+			}
+			parens = parens[:len(parens)-1]
+		default:
+			if len(parens) == 0 && strings.HasPrefix(s[i:], sep) {
+				parts = append(parts, mappingPart{Text: s[start:i], Col: col + start})
+				start = i + len(sep)
+				i += len(sep) - 1
+			}
+		}
+	}
+	if quote >= 0 {
+		return nil, fmt.Errorf("unterminated quote at column %d", col+quote)
+	}
+	if len(parens) > 0 {
+		return nil, fmt.Errorf("unbalanced parenthesis at column %d", col+parens[len(parens)-1])
+	}
+	return append(parts, mappingPart{Text: s[start:], Col: col + start}), nil
+}
+
+// splitOutsideParens splits the string by the separator which is neither inside parentheses
+// nor inside double quotes, see splitMapping.
+func splitOutsideParens(s, sep string) ([]string, error) {
+	parts, err := splitMapping(s, sep, 1)
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		texts = append(texts, part.Text)
+	}
+	return texts, nil
+}
+
+// unquoteValue unquotes the double quoted value with backslash escapes the way Go does,
+// e.g. "Jan 2, 2006". Values which are not quoted are returned as is.
+func unquoteValue(s string) (string, error) {
+	if len(s) < 2 || s[0] != quoteChar || s[len(s)-1] != quoteChar {
+		return s, nil
+	}
+	value, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted value %s", s)
+	}
+	return value, nil
+}
+
+// affixValue puts the prefix and the suffix around the non-empty value stamped into the target.
+// The prefix and the suffix given as options of the target override ones given with -value-prefix
+// and -value-suffix, the latter apply only to generators listed with -value-gens if any.
+func affixValue(target Target, value string) string {
+	if len(value) == 0 {
+		return value
+	}
+	prefix, suffix := valuePrefix, valueSuffix
+	if name, _ := splitGen(target.Gen); len(valueGens) > 0 && !containsString(splitValueGens(valueGens), name) {
+		prefix, suffix = "", ""
+	}
+	if opt, ok := target.Opts[OptPrefix]; ok {
+		prefix = opt
+	}
+	if opt, ok := target.Opts[OptSuffix]; ok {
+		suffix = opt
+	}
+	return prefix + value + suffix
+}
+
+// splitValueGens splits the comma separated list of generator names given with -value-gens.
+func splitValueGens(s string) []string {
+	var gens []string
+	for _, gen := range strings.Split(s, optionSeparator) {
+		if gen = strings.TrimSpace(gen); len(gen) > 0 {
+			gens = append(gens, gen)
+		}
+	}
+	return gens
+}
+
+// applyGenOptions applies options which transform the value generated.
+func applyGenOptions(value string, opts GenOptions) string {
+	if opts.Bool(OptUpper) {
+		value = strings.ToUpper(value)
+	}
+	return value
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTargetSpec(t *testing.T) {
+	tests := []struct {
+		s        string
+		gen      string
+		opts     GenOptions
+		fallback string
+		wantErr  string
+	}{
+		{s: "version", gen: GenVersion},
+		{s: "hash:12", gen: "hash:12"},
+		{s: "time()", gen: GenTime, opts: GenOptions{}},
+		{s: "time(format=2006-01-02,utc=true)", gen: GenTime, opts: GenOptions{OptFormat: "2006-01-02", OptUTC: "true"}},
+		{s: "time( format = 2006 , utc = false )", gen: GenTime, opts: GenOptions{OptFormat: "2006", OptUTC: "false"}},
+		{s: `time(format="Jan 2, 2006 (MST)")`, gen: GenTime, opts: GenOptions{OptFormat: "Jan 2, 2006 (MST)"}},
+		{s: `time(format="a=b\"c")`, gen: GenTime, opts: GenOptions{OptFormat: `a=b"c`}},
+		{s: "hash_long(upper=true)", gen: GenHashLong, opts: GenOptions{OptUpper: "true"}},
+		{s: "hash:8(upper=1,prefix=g)", gen: "hash:8", opts: GenOptions{OptUpper: "1", OptPrefix: "g"}},
+		{s: "version(prefix=v,suffix=-rc)", gen: GenVersion, opts: GenOptions{OptPrefix: "v", OptSuffix: "-rc"}},
+		{s: "version|v0.0.0-dev", gen: GenVersion, fallback: "v0.0.0-dev"},
+		{s: `version(suffix=-rc)|"dev, local"`, gen: GenVersion, opts: GenOptions{OptSuffix: "-rc"}, fallback: "dev, local"},
+		{s: `time(format="a|b")|never`, gen: GenTime, opts: GenOptions{OptFormat: "a|b"}, fallback: "never"},
+		{s: "version|a|b", gen: GenVersion, fallback: "a|b"},
+		{s: "unknown", wantErr: "invalid generator unknown"},
+		{s: "version(upper=true)", wantErr: "generator version does not accept option upper"},
+		{s: "time(zone=UTC)", wantErr: "generator time does not accept option zone"},
+		{s: "time(utc=yes)", wantErr: "invalid value yes of option utc"},
+		{s: "time(format=)", wantErr: "empty value of option format"},
+		{s: "time(utc=true,utc=false)", wantErr: "duplicate option utc"},
+		{s: "time(utc)", wantErr: "invalid option utc"},
+		{s: "time(=true)", wantErr: "invalid option =true"},
+		{s: "time(format=a=b)", wantErr: "invalid option format=a=b"},
+		{s: `time(format="unterminated)`, wantErr: "unterminated quote"},
+		{s: "time(format=2006", wantErr: "unbalanced parenthesis"},
+		{s: `version|"bad\q"`, wantErr: "invalid quoted value"},
+	}
+	for _, tt := range tests {
+		gen, opts, fallback, err := parseTargetSpec(tt.s)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseTargetSpec(%q) error %v, want %q", tt.s, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTargetSpec(%q) error %s", tt.s, err.Error())
+			continue
+		}
+		if gen != tt.gen || opts.String() != tt.opts.String() || fallback != tt.fallback {
+			t.Errorf("parseTargetSpec(%q) = %s, %v, %q, want %s, %v, %q", tt.s, gen, opts, fallback, tt.gen, tt.opts, tt.fallback)
+		}
+	}
+}
+
+func TestParseTargetMappingOptions(t *testing.T) {
+	m, err := parseTargetMapping(`BuildDate=time(format=2006-01-02,utc=true),Commit=hash_long(upper=true),` +
+		`Stamp=time(format="Jan 2, 2006"),Version=version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TargetMap{
+		"BuildDate": "time(format=2006-01-02,utc=true)",
+		"Commit":    "hash_long(upper=true)",
+		"Stamp":     `time(format="Jan 2, 2006")`,
+		"Version":   "version",
+	}
+	if len(m) != len(want) {
+		t.Errorf("mapping %v, want %v", m, want)
+	}
+	for key, spec := range want {
+		if m[key] != spec {
+			t.Errorf("%s = %q, want %q", key, m[key], spec)
+		}
+	}
+}
+
+// randomTarget returns the random target with options of the generator
+// and the mapping of it with option values quoted when they must be.
+func randomTarget(r *rand.Rand, i int) (Target, string) {
+	values := []string{"2006", "2006-01-02", "Jan 2, 2006", "a,b", "x=y", "(z)", `q"q`, `back\slash`, "-rc.1", "a|b"}
+	format := func(value string) string {
+		if strings.ContainsAny(value, ` ,=()"\|`) {
+			return strconv.Quote(value)
+		}
+		return value
+	}
+
+	gens := []string{GenVersion, GenTime, GenHashLong, "hash:" + strconv.Itoa(1+r.Intn(40))}
+	target := Target{Var: "Var" + strconv.Itoa(i), Gen: gens[r.Intn(len(gens))], Opts: make(GenOptions)}
+	name, _ := splitGen(target.Gen)
+	names := append(append([]string(nil), GenOptionNames[name]...), commonOptions...)
+
+	var opts []string
+	for _, key := range names {
+		if r.Intn(2) == 0 {
+			continue
+		}
+		value := values[r.Intn(len(values))]
+		if containsString(boolOptions, key) {
+			value = strconv.FormatBool(r.Intn(2) == 0)
+		}
+		target.Opts[key] = value
+		opts = append(opts, key+optionAssignment+format(value))
+	}
+
+	spec := target.Gen
+	if len(opts) > 0 || r.Intn(4) == 0 {
+		spec += optionsStart + strings.Join(opts, optionSeparator) + optionsEnd
+	}
+	if r.Intn(3) == 0 {
+		target.Fallback = values[r.Intn(len(values))]
+		spec += fallbackSeparator + format(target.Fallback)
+	}
+	return target, target.Var + mapAssignment + spec
+}
+
+func TestParseTargetMappingRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 1000; n++ {
+		var (
+			targets  []Target
+			mappings []string
+		)
+		for i := 0; i < 1+r.Intn(5); i++ {
+			target, mapping := randomTarget(r, i)
+			targets = append(targets, target)
+			mappings = append(mappings, mapping)
+		}
+		s := strings.Join(mappings, mapSeparator)
+
+		m, err := parseTargetMapping(s)
+		if err != nil {
+			t.Fatalf("parseTargetMapping(%s) error %s", s, err.Error())
+		}
+		if len(m) != len(targets) {
+			t.Fatalf("parseTargetMapping(%s) = %v, want %d targets", s, m, len(targets))
+		}
+		for _, target := range targets {
+			gen, opts, fallback, err := parseTargetSpec(m[target.Var])
+			if err != nil || gen != target.Gen || opts.String() != target.Opts.String() || fallback != target.Fallback {
+				t.Fatalf("%s of %s = %s, %v, %q, %v, want %s, %v, %q", target.Var, s, gen, opts, fallback, err, target.Gen, target.Opts, target.Fallback)
+			}
+		}
+	}
+}
+
+func TestSplitMapping(t *testing.T) {
+	tests := []struct {
+		s     string
+		sep   string
+		texts []string
+		cols  []int
+	}{
+		{"A=version,B=tag", mapSeparator, []string{"A=version", "B=tag"}, []int{1, 11}},
+		{"A=time(format=a,utc=true),B=tag", mapSeparator, []string{"A=time(format=a,utc=true)", "B=tag"}, []int{1, 27}},
+		{`A=env:X|"a,b",B=tag`, mapSeparator, []string{`A=env:X|"a,b"`, "B=tag"}, []int{1, 15}},
+		{`A=version|"say \"a,b\""`, mapSeparator, []string{`A=version|"say \"a,b\""`}, []int{1}},
+		{`A=version|"a\\",B=tag`, mapSeparator, []string{`A=version|"a\\"`, "B=tag"}, []int{1, 17}},
+		{`A=version|"x=y"`, mapAssignment, []string{"A", `version|"x=y"`}, []int{1, 3}},
+		{"A=time(format=x=y)", mapAssignment, []string{"A", "time(format=x=y)"}, []int{1, 3}},
+		{"", mapSeparator, []string{""}, []int{1}},
+		{",", mapSeparator, []string{"", ""}, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		parts, err := splitMapping(tt.s, tt.sep, 1)
+		if err != nil {
+			t.Errorf("splitMapping(%q, %q) error %s", tt.s, tt.sep, err.Error())
+			continue
+		}
+		if len(parts) != len(tt.texts) {
+			t.Errorf("splitMapping(%q, %q) = %v, want %q", tt.s, tt.sep, parts, tt.texts)
+			continue
+		}
+		for i, part := range parts {
+			if part.Text != tt.texts[i] || part.Col != tt.cols[i] {
+				t.Errorf("splitMapping(%q, %q) part %d = %q at %d, want %q at %d", tt.s, tt.sep, i, part.Text, part.Col, tt.texts[i], tt.cols[i])
+			}
+		}
+	}
+}
+
+func TestParseTargetMappingErrors(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"A=version,B", "missing = at column 12"},
+		{"A=version,B=tag=x", "unexpected = at column 16"},
+		{`A=version,B="unterminated`, "unterminated quote at column 13"},
+		{`A=version|"a\"`, "unterminated quote at column 11"},
+		{"A=time(format=x,B=tag", "unbalanced parenthesis at column 7"},
+		{"A=version),B=tag", "unbalanced parenthesis at column 10"},
+		{"A=version, B=bad(", "unbalanced parenthesis at column 17"},
+		{"A=unknown", "invalid generator unknown"},
+		{"A=version,B=unknown", "at column 13"},
+		{"A.=version", "invalid name A. at column 1"},
+		{"A|.B=version", "invalid name .B at column 3"},
+		{"=version", "invalid name  at column 1"},
+		{"A=time(zone=1)", "generator time does not accept option zone at column 3"},
+		{`A=version|"\q"`, "invalid quoted value"},
+	}
+	for _, tt := range tests {
+		if _, err := parseTargetMapping(tt.s); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTargetMapping(%q) error %v, want %q", tt.s, err, tt.want)
+		}
+	}
+}
+
+func TestParseTargetMappingNames(t *testing.T) {
+	tests := []struct {
+		s    string
+		want TargetMap
+	}{
+		{"GitCommit|Revision=hash_long", TargetMap{"GitCommit": GenHashLong, "Revision": GenHashLong}},
+		{"A|B|C=tag,D=version", TargetMap{"A": GenTag, "B": GenTag, "C": GenTag, "D": GenVersion}},
+		{"main.Version|Release=tag", TargetMap{"main.Version": GenTag, "Release": GenTag}},
+		{"A|Build*=time(utc=true)|untagged", TargetMap{"A": "time(utc=true)|untagged", "Build*": "time(utc=true)|untagged"}},
+		{"A|A=tag", TargetMap{"A": GenTag}},
+		{"A|B=tag,B=version", TargetMap{"A": GenTag, "B": GenVersion}},
+	}
+	for _, tt := range tests {
+		m, err := parseTargetMapping(tt.s)
+		if err != nil || fmt.Sprint(m) != fmt.Sprint(tt.want) {
+			t.Errorf("parseTargetMapping(%q) = %v, %v, want %v", tt.s, m, err, tt.want)
+		}
+	}
+
+	// Every name is checked on its own with the column it starts at
+	failures := []struct {
+		s    string
+		want string
+	}{
+		{"A||B=tag", "invalid name  at column 3"},
+		{"|A=tag", "invalid name  at column 1"},
+		{"A|=tag", "invalid name  at column 3"},
+		{"main.A|B=tag,main.A=version", "conflicting generators tag and version for main.A"},
+	}
+	for _, tt := range failures {
+		if _, err := parseTargetMapping(tt.s); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTargetMapping(%q) error %v, want %q", tt.s, err, tt.want)
+		}
+	}
+}
+
+func TestParseTargetMappingNoPanic(t *testing.T) {
+	// Inputs are random mixes of characters of the syntax, so most of them are broken
+	// in interesting ways, and valid pieces to get past the first check sometimes
+	pieces := []string{"A", "pkg.B", "=", ",", "|", "(", ")", `"`, `\`, " ", "version", "time", "hash:", "format", "utc", "true", "x", "é", "\x00", "\xff"}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 20000; n++ {
+		var b strings.Builder
+		for i := r.Intn(16); i >= 0; i-- {
+			b.WriteString(pieces[r.Intn(len(pieces))])
+		}
+		s := b.String()
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					t.Fatalf("parseTargetMapping(%q) panics: %v", s, err)
+				}
+			}()
+			_, _ = parseTargetMapping(s)
+			_, _, _, _ = parseTargetSpec(s)
+		}()
+	}
+}
+
+func TestAffixValue(t *testing.T) {
+	defer func(prefix, suffix, gens string) { valuePrefix, valueSuffix, valueGens = prefix, suffix, gens }(valuePrefix, valueSuffix, valueGens)
+
+	tests := []struct {
+		prefix, suffix, gens string
+		target               Target
+		value, want          string
+	}{
+		{"build-", "-rc", "", Target{Gen: GenVersion}, "v1.2.3", "build-v1.2.3-rc"},
+		{"build-", "-rc", "", Target{Gen: GenVersion}, "", ""},
+		{"build-", "", "version, tag", Target{Gen: GenTag}, "v1.2.3", "build-v1.2.3"},
+		{"build-", "", "version", Target{Gen: GenHashShort}, "abcdef1", "abcdef1"},
+		{"build-", "", "hash", Target{Gen: "hash:12"}, "abcdef123456", "build-abcdef123456"},
+		{"build-", "-rc", "", Target{Gen: GenVersion, Opts: GenOptions{OptPrefix: "v="}}, "1.2.3", "v=1.2.3-rc"},
+		{"", "", "hash_short", Target{Gen: GenVersion, Opts: GenOptions{OptSuffix: "-dev"}}, "v1.2.3", "v1.2.3-dev"},
+		{"", "", "", Target{Gen: GenVersion, Opts: GenOptions{OptPrefix: "v="}}, "", ""},
+	}
+	for _, tt := range tests {
+		valuePrefix, valueSuffix, valueGens = tt.prefix, tt.suffix, tt.gens
+		if got := affixValue(tt.target, tt.value); got != tt.want {
+			t.Errorf("affixValue(%s, %q) with %q, %q, %q = %q, want %q", tt.target.GenSpec(), tt.value, tt.prefix, tt.suffix, tt.gens, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,996 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Output format names
+const (
+	FormatLDFlags    = "ldflags"    // The value of -ldflags argument
+	FormatEnv        = "env"        // The dotenv file with one variable per generator
+	FormatLines      = "lines"      // One -X flag per line sorted by package and variable
+	FormatGoReleaser = "goreleaser" // The ldflags list of GoReleaser build configuration
+	FormatBazel      = "bazel"      // The x_defs of rules_go as JSON object or .bzl dict
+	FormatMake       = "make"       // The Makefile include with LDFLAGS and generator values
+	FormatDocker     = "docker"     // The --build-arg arguments of docker build
+	FormatRsp        = "rsp"        // The linker response file referenced as -ldflags=@file
+	FormatNul        = "nul"        // NUL terminated -X flags sorted by package and variable
+	FormatYAML       = "yaml"       // The YAML document with the root package, targets and ldflags
+)
+
+// Constants of response files
+const (
+	rspPrefix  = "@"
+	rspPattern = "goxver-*.rsp"
+)
+
+// dockerBuildArgFlag is the docker build flag which sets build-time variables.
+const dockerBuildArgFlag = "--build-arg"
+
+// stripLinkerFlags omit the symbol table and DWARF debug information, see -strip.
+var stripLinkerFlags = []string{"-s", "-w"}
+
+// makeLDFlagsName is the name of Make variable with linker flags without the prefix.
+const makeLDFlagsName = "LDFLAGS"
+
+var ValidFormats = []string{
+	FormatLDFlags,
+	FormatEnv,
+	FormatLines,
+	FormatGoReleaser,
+	FormatBazel,
+	FormatMake,
+	FormatDocker,
+	FormatRsp,
+	FormatNul,
+	FormatYAML,
+}
+
+// Styles of Bazel output format
+const (
+	BazelStyleJSON = "json" // The JSON object
+	BazelStyleBzl  = "bzl"  // The dict literal assigned to X_DEFS in .bzl file
+)
+
+// Separators between -X flags in ldflags format
+const (
+	SepSpace   = "space"   // All flags on one line, the value of the single -ldflags argument
+	SepNewline = "newline" // One flag per line
+	SepNull    = "null"    // Flags separated by NUL for safe piping
+)
+
+// flagSeparators maps separator names to the separator strings.
+var flagSeparators = map[string]string{
+	SepSpace:   " ",
+	SepNewline: "\n",
+	SepNull:    "\x00",
+}
+
+// Shells the ldflags output can be quoted for
+const (
+	ShellNone       = ""           // No quoting, the output is used as "$(goxver)"
+	ShellPosix      = "posix"      // POSIX shells, e.g. sh and bash
+	ShellPowerShell = "powershell" // Windows PowerShell and PowerShell Core
+	ShellCmd        = "cmd"        // Windows command prompt
+)
+
+// Styles of quoting -X flags. Arguments without whitespaces and quotes are left unquoted in every
+// style, so the default style is none for every argument none can represent. None cannot become
+// the only default since the go command has no escaping, even outside quotes, so quoting is the only
+// way to keep whitespaces in the argument.
+const (
+	QuoteAuto   = ""       // Single quotes, or double ones with -qq, falling back to the other kind
+	QuoteNone   = "none"   // No quoting, values with whitespaces or quotes are rejected
+	QuoteSingle = "single" // Only single quotes, values with single quotes are rejected
+	QuoteDouble = "double" // Only double quotes, values with double quotes are rejected
+)
+
+// ValidQuotes lists quoting styles which can be given explicitly.
+var ValidQuotes = []string{
+	QuoteNone,
+	QuoteSingle,
+	QuoteDouble,
+}
+
+// bazelDictName is the name of the dict variable in .bzl style.
+const bazelDictName = "X_DEFS"
+
+// GoReleaserTemplates maps generators to GoReleaser templates producing the same value, see
+// goReleaserTemplate. Generators not listed here are resolved to literal values. The version is
+// the tag GoReleaser releases, {{.Version}} is not used as it strips the leading v the version keeps.
+var GoReleaserTemplates = map[string]string{
+	GenVersion:   "{{.Tag}}",
+	GenTag:       "{{.Tag}}",
+	GenHashShort: "{{.ShortCommit}}",
+	GenHashLong:  "{{.FullCommit}}",
+	GenTime:      "{{ time %s }}",
+	GenTimestamp: "{{.Timestamp}}",
+	GenGOOS:      "{{.Os}}",
+	GenGOARCH:    "{{.Arch}}",
+}
+
+// OutputOptions are options selecting the output resolved once from flags and configuration.
+type OutputOptions struct {
+	Format string // The output format, one of ValidFormats
+	Path   string // The file to write output into, STDOUT if empty
+	GitHub bool   // Write GitHub Actions outputs instead of the output format
+	EmitGo string // The path to Go source file to generate instead of the output format
+}
+
+// outputOpts are output options resolved after the configuration is loaded.
+var outputOpts OutputOptions
+
+// resolveOutputOptions resolves output options from command line flags and the format
+// declared in the configuration. Flags always override the configuration.
+func resolveOutputOptions(configFormat string) (OutputOptions, error) {
+	opts := OutputOptions{
+		Format: outputFormat,
+		Path:   outputPath,
+		GitHub: githubOutput,
+		EmitGo: emitGoPath,
+	}
+	switch {
+	case print0:
+		opts.Format = FormatNul
+	case len(configFormat) > 0 && !isFlagSet("format"):
+		opts.Format = configFormat
+	}
+	if !isValidFormat(opts.Format) {
+		return opts, fmt.Errorf("invalid output format %s", opts.Format)
+	}
+	return opts, nil
+}
+
+// isValidFormat tests if the name of the output format is in valid set.
+func isValidFormat(s string) bool {
+	for _, format := range ValidFormats {
+		if s == format {
+			return true
+		}
+	}
+	return false
+}
+
+// printResult prints values of targets in the output format selected
+// or generates Go source file with them or GitHub Actions outputs.
+func printResult(repo *git.Repository, values []TargetValue) {
+	if len(outputOpts.EmitGo) > 0 {
+		if err := emitGo(values, outputOpts.EmitGo); err != nil {
+			fail(ExitOutput, "failed to generate Go source", err)
+		}
+		return
+	}
+	if outputOpts.GitHub {
+		if err := printGitHub(values); err != nil {
+			fail(ExitOutput, "failed to write GitHub Actions outputs", err)
+		}
+		return
+	}
+
+	switch outputOpts.Format {
+	case FormatEnv:
+		value, err := formatEnv(repo, values)
+		if err != nil {
+			fail(ExitOutput, "failed to generate environment", err)
+		}
+		printOutput(value)
+	case FormatLines, FormatNul:
+		assigns := generateLDFlags(values)
+		if outputOpts.Format == FormatNul {
+			printOutput(formatTerminated(assigns, "\x00"))
+		} else {
+			printOutput(formatTerminated(assigns, "\n"))
+		}
+	case FormatGoReleaser:
+		value, err := formatGoReleaser(values)
+		if err != nil {
+			fail(ExitOutput, "failed to generate GoReleaser configuration", err)
+		}
+		printOutput(value)
+	case FormatMake:
+		value, err := formatMake(repo, values)
+		if err != nil {
+			fail(ExitOutput, "failed to generate Makefile", err)
+		}
+		printOutput(value)
+	case FormatDocker:
+		value, err := formatDocker(values)
+		if err != nil {
+			fail(ExitOutput, "failed to generate docker build arguments", err)
+		}
+		printOutput(value)
+	case FormatRsp:
+		content, err := formatRsp(generateLDFlags(values))
+		if err != nil {
+			fail(ExitOutput, "failed to generate response file", err)
+		}
+		printRsp(content)
+	case FormatYAML:
+		value, err := formatYAML(values)
+		if err != nil {
+			fail(ExitOutput, "failed to generate YAML", err)
+		}
+		printOutput(value)
+	case FormatBazel:
+		value, err := formatBazel(values)
+		if err != nil {
+			fail(ExitOutput, "failed to generate Bazel x_defs", err)
+		}
+		printOutput(value)
+	default:
+		printLDFlags(generateLDFlags(values))
+	}
+}
+
+// sortedTargets returns the copy of targets sorted by package and then by variable.
+func sortedTargets(targets []Target) []Target {
+	sorted := make([]Target, len(targets))
+	copy(sorted, targets)
+	sort.Slice(sorted, func(i, j int) bool {
+		return lessTarget(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+// lessTarget orders targets by package, then by variable and then by file, the last
+// makes the order stable for main packages in different directories.
+func lessTarget(a, b Target) bool {
+	if a.Pkg != b.Pkg {
+		return a.Pkg < b.Pkg
+	}
+	if a.Var != b.Var {
+		return a.Var < b.Var
+	}
+	return a.File < b.File
+}
+
+// formatTerminated makes -X flags from the assignments in the form pkg.Var=value each
+// followed by the terminator, e.g. one flag per line or NUL terminated flags.
+func formatTerminated(assigns []string, terminator string) string {
+	var sb strings.Builder
+	for _, assign := range assigns {
+		sb.WriteString(linkerSetFlag + " " + assign + terminator)
+	}
+	return sb.String()
+}
+
+// formatGoReleaser makes the YAML ldflags list ready to paste into GoReleaser build configuration.
+// Generators having the GoReleaser equivalent are replaced with templates, others are
+// resolved to literal values.
+func formatGoReleaser(values []TargetValue) (string, error) {
+	var conf struct {
+		LDFlags []string `yaml:"ldflags"`
+	}
+	conf.LDFlags = append(conf.LDFlags, extraFlags...)
+
+	for _, v := range values {
+		value := v.Value
+		if template, ok := goReleaserTemplate(v.Target); ok {
+			value = affixValue(v.Target, template)
+		}
+		if len(value) == 0 {
+			continue
+		}
+		conf.LDFlags = append(conf.LDFlags, fmt.Sprintf("%s %s.%s=%s", linkerSetFlag, v.Pkg, v.Var, value))
+	}
+	strip, err := stripFlags(nil)
+	if err != nil {
+		return "", err
+	}
+	if len(strip) > 0 {
+		conf.LDFlags = append(conf.LDFlags, strings.Join(strip, " "))
+	}
+
+	if len(conf.LDFlags) == 0 {
+		return "", nil
+	}
+
+	var sb strings.Builder
+	enc := yaml.NewEncoder(&sb)
+	enc.SetIndent(manifestIndent)
+	if err := enc.Encode(&conf); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// goReleaserTemplate returns the GoReleaser template producing the value of the target's generator
+// or false if there is none. The time is formatted with the layout of the format option by the time
+// template function, which always uses UTC. Templates apply no other options except affixes,
+// no fallbacks, and no -tag-prefix stripped from tags, so targets having them are resolved to literal values.
+func goReleaserTemplate(target Target) (string, bool) {
+	template, ok := GoReleaserTemplates[target.Gen]
+	if !ok || len(target.Fallback) > 0 {
+		return "", false
+	}
+	if (target.Gen == GenVersion || target.Gen == GenTag) && len(tagPrefix) > 0 {
+		return "", false
+	}
+	for key := range target.Opts {
+		if !containsString(commonOptions, key) && (target.Gen != GenTime || (key != OptFormat && key != OptUTC)) {
+			return "", false
+		}
+	}
+	if target.Gen == GenTime {
+		layout := timeFormat
+		if format, ok := target.Opts[OptFormat]; ok {
+			layout = format
+		}
+		template = fmt.Sprintf(template, strconv.Quote(layout))
+	}
+	return template, true
+}
+
+// formatYAML makes the YAML document with the root package, the list of targets with
+// their values sorted by package and variable, and the value of -ldflags argument.
+func formatYAML(values []TargetValue) (string, error) {
+	type yamlTarget struct {
+		Pkg   string `yaml:"pkg"`
+		Var   string `yaml:"var"`
+		Gen   string `yaml:"gen"`
+		Value string `yaml:"value"`
+	}
+	var doc struct {
+		Root    string       `yaml:"root,omitempty"`
+		Targets []yamlTarget `yaml:"targets"`
+		LDFlags string       `yaml:"ldflags"`
+	}
+	doc.Root = rootPackage
+	doc.Targets = []yamlTarget{}
+
+	for _, v := range values {
+		doc.Targets = append(doc.Targets, yamlTarget{Pkg: v.Pkg, Var: v.Var, Gen: v.Gen, Value: v.Value})
+	}
+
+	var err error
+	if doc.LDFlags, err = formatLDFlags(generateLDFlags(values)); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	enc := yaml.NewEncoder(&sb)
+	enc.SetIndent(manifestIndent)
+	if err := enc.Encode(&doc); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// formatDocker makes --build-arg arguments of docker build, one per distinct target variable name.
+// ARG names are upper cased variable names. Arguments are separated with spaces or
+// with line breaks in newline mode, values are shell quoted when needed.
+func formatDocker(values []TargetValue) (string, error) {
+	args := make(map[string]string)
+	for _, v := range values {
+		name := strings.ToUpper(v.Var)
+		if _, ok := args[name]; ok {
+			continue
+		}
+		if len(v.Value) > 0 {
+			args[name] = dockerBuildArgFlag + " " + quoteShell(name+mapAssignment+v.Value)
+		}
+	}
+
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, args[name])
+	}
+
+	if dockerNewline {
+		if len(lines) == 0 {
+			return "", nil
+		}
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+	return strings.Join(lines, " "), nil
+}
+
+// quoteShell single quotes the argument for POSIX shells if it contains characters
+// other than known safe ones. Single quotes inside are closed, escaped and reopened.
+func quoteShell(s string) string {
+	if len(s) > 0 && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// formatBazel makes x_defs of rules_go mapping pkg.Var to values in the style selected.
+// Targets with empty values are omitted. Values are the ones of -X flags, so the variable
+// found more than once gets the value of the first target, see generateTargetValues.
+func formatBazel(values []TargetValue) (string, error) {
+	defs := make(map[string]string, len(values))
+	keys := make([]string, 0, len(values))
+	for _, v := range values {
+		if len(v.Value) > 0 {
+			key := v.Pkg + "." + v.Var
+			keys = append(keys, key)
+			defs[key] = v.Value
+		}
+	}
+	sort.Strings(keys)
+
+	if bazelStyle == BazelStyleBzl {
+		var sb strings.Builder
+		sb.WriteString(bazelDictName + " = {\n")
+		for _, key := range keys {
+			sb.WriteString("    " + quoteStarlark(key) + ": " + quoteStarlark(defs[key]) + ",\n")
+		}
+		sb.WriteString("}\n")
+		return sb.String(), nil
+	}
+
+	out, err := json.MarshalIndent(defs, "", strings.Repeat(" ", manifestIndent))
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+// quoteStarlark makes the double quoted Starlark string literal escaping backslashes,
+// quotes and control characters.
+func quoteStarlark(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '"':
+			sb.WriteString(`\"`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, `\x%02x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// printRsp prints the response file content into the output file if one is given,
+// otherwise it writes the content into the temporary file and prints the reference to it.
+// The reference is the linker argument, e.g. for go tool link, the go command itself
+// does not accept @ arguments in -ldflags.
+func printRsp(content string) {
+	if len(outputOpts.Path) > 0 {
+		printOutput(content)
+		return
+	}
+
+	file, err := ioutil.TempFile("", rspPattern)
+	if err != nil {
+		fail(ExitOutput, "failed to create response file", err)
+	}
+	if _, err = file.WriteString(content); err != nil {
+		_ = file.Close()
+		fail(ExitOutput, "failed to write response file", err)
+	}
+	if err = file.Close(); err != nil {
+		fail(ExitOutput, "failed to write response file", err)
+	}
+
+	msgWith(Fields{"file": file.Name()}, "Response file is written to %s\n", file.Name())
+	printOutput(rspPrefix + file.Name())
+}
+
+// formatRsp makes the linker response file content from the extra flags and the assignments
+// in the form pkg.Var=value. Every argument is written on its own line, so -X and the assignment
+// go on separate lines.
+func formatRsp(assigns []string) (string, error) {
+	var sb strings.Builder
+	for _, extra := range extraFlags {
+		args, err := splitLDFlags(extra)
+		if err != nil {
+			return "", err
+		}
+		for _, arg := range args {
+			sb.WriteString(encodeRspArg(arg) + "\n")
+		}
+	}
+	for _, assign := range assigns {
+		sb.WriteString(linkerSetFlag + "\n" + encodeRspArg(assign) + "\n")
+	}
+	strip, err := stripFlags(nil)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range strip {
+		sb.WriteString(f + "\n")
+	}
+	return sb.String(), nil
+}
+
+// encodeRspArg quotes the argument for the response file the way the linker splits it,
+// that is with GCC compatible rules. The argument with whitespaces, quotes or escapes is
+// double quoted with backslashes, double quotes, dollars and backticks escaped inside.
+func encodeRspArg(arg string) string {
+	if len(arg) == 0 {
+		return `""`
+	}
+	if !strings.ContainsAny(arg, " \t\n\r'\"\\$`") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(arg) + `"`
+}
+
+// printLDFlags formats the linker flags with the assignments given and prints them.
+func printLDFlags(assigns []string) {
+	value, err := formatLDFlags(assigns)
+	if err != nil {
+		fail(ExitOutput, "failed to format LDFLAGS", err)
+	}
+	printOutput(quoteForShell(value, shellName))
+}
+
+// quoteForShell quotes the value so the shell given passes it to the command as a single argument.
+func quoteForShell(s, shell string) string {
+	switch shell {
+	case ShellPosix:
+		return quoteShell(s)
+	case ShellPowerShell:
+		return quotePowerShell(s)
+	case ShellCmd:
+		return quoteCmd(s)
+	default:
+		return s
+	}
+}
+
+// quotePowerShell single quotes the argument for PowerShell. Nothing is expanded inside
+// single quotes, e.g. $env:X and backticks are literal, and single quotes are doubled.
+func quotePowerShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quoteCmd quotes the argument for the Windows command prompt. The argument is double quoted
+// the way programs split their command line, then characters special to cmd including quotes
+// and percents are escaped with carets so %VAR% is not expanded.
+func quoteCmd(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	var slashes int
+	for _, r := range s {
+		switch r {
+		case '\\':
+			slashes++
+			continue
+		case '"':
+			sb.WriteString(strings.Repeat(`\`, 2*slashes+1))
+		default:
+			sb.WriteString(strings.Repeat(`\`, slashes))
+		}
+		slashes = 0
+		sb.WriteRune(r)
+	}
+	sb.WriteString(strings.Repeat(`\`, 2*slashes))
+	sb.WriteByte('"')
+
+	var escaped strings.Builder
+	for _, r := range sb.String() {
+		if strings.ContainsRune(`()%!^"<>&|`, r) {
+			escaped.WriteByte('^')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// formatLDFlags makes the linker flags string from the extra flags given verbatim followed by
+// the assignments in the form pkg.Var=value and -s -w with -strip. The assignments are quoted as a whole the way the go command splits the -ldflags value,
+// so values with whitespace survive both go build -ldflags "$(goxver)" and the wrap mode
+// where the complete -ldflags= argument is made.
+func formatLDFlags(assigns []string) (string, error) {
+	flags := make([]string, 0, len(extraFlags)+len(assigns))
+	flags = append(flags, extraFlags...)
+
+	var args []string
+	if len(mergeFlags) > 0 {
+		merged, err := mergeLDFlags(mergeFlags, assigns)
+		if err != nil {
+			return "", err
+		}
+		args = merged
+	} else {
+		for _, assign := range assigns {
+			args = append(args, linkerSetFlag, assign)
+		}
+	}
+
+	for i := 0; i < len(args); i++ {
+		quoted, err := quoteLDFlagsArg(args[i])
+		if err != nil {
+			return "", err
+		}
+		if args[i] == linkerSetFlag && i+1 < len(args) {
+			i++
+			arg, err := quoteLDFlagsArg(args[i])
+			if err != nil {
+				return "", err
+			}
+			quoted += " " + arg
+		}
+		flags = append(flags, quoted)
+	}
+	strip, err := stripFlags(args)
+	if err != nil {
+		return "", err
+	}
+	flags = append(flags, strip...)
+
+	value := strings.Join(flags, flagSeparators[flagSep])
+	if wrapFlags {
+		value = ldflagsPrefix + value
+	}
+	return value, nil
+}
+
+// stripFlags returns linker flags -strip adds, that is -s and -w which are neither among the extra
+// flags nor among the arguments given, e.g. merged with -merge, so no flag is given twice.
+// The flag given with the value, e.g. -s=false, is left as is.
+func stripFlags(args []string) ([]string, error) {
+	if !stripSymbols {
+		return nil, nil
+	}
+	given := append([]string(nil), args...)
+	for _, extra := range extraFlags {
+		tokens, err := splitLDFlags(extra)
+		if err != nil {
+			return nil, err
+		}
+		given = append(given, tokens...)
+	}
+
+	var flags []string
+	for _, f := range stripLinkerFlags {
+		found := false
+		for _, arg := range given {
+			if arg == f || strings.HasPrefix(arg, f+mapAssignment) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			flags = append(flags, f)
+		}
+	}
+	return flags, nil
+}
+
+// mergeLDFlags merges the assignments in the form pkg.Var=value into the existing linker flags.
+// The first existing -X flag setting the same variable gets the value of the assignment and later
+// ones setting it are dropped, the rest of assignments are appended and other flags are kept untouched. Both -X pkg.Var=value and
+// -X=pkg.Var=value forms of existing flags are understood, the result uses the former.
+func mergeLDFlags(existing string, assigns []string) ([]string, error) {
+	tokens, err := splitLDFlags(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(assigns))
+	for _, assign := range assigns {
+		values[assignName(assign)] = assign
+	}
+
+	merged := make(map[string]bool, len(assigns))
+	args := make([]string, 0, len(tokens)+2*len(assigns))
+	for i := 0; i < len(tokens); i++ {
+		var assign string
+		switch {
+		case tokens[i] == linkerSetFlag && i+1 < len(tokens):
+			i++
+			assign = tokens[i]
+		case strings.HasPrefix(tokens[i], linkerSetFlag+mapAssignment):
+			assign = tokens[i][len(linkerSetFlag+mapAssignment):]
+		default:
+			args = append(args, tokens[i])
+			continue
+		}
+
+		name := assignName(assign)
+		if override, ok := values[name]; ok {
+			if merged[name] {
+				msg("Dropping %s merged already\n", assign)
+				continue
+			}
+			msg("Merging %s over %s\n", override, assign)
+			assign = override
+			merged[name] = true
+		}
+		args = append(args, linkerSetFlag, assign)
+	}
+
+	for _, assign := range assigns {
+		if name := assignName(assign); !merged[name] {
+			args = append(args, linkerSetFlag, assign)
+			merged[name] = true
+		}
+	}
+	return args, nil
+}
+
+// assignName returns the pkg.Var part of the assignment in the form pkg.Var=value.
+func assignName(assign string) string {
+	if i := strings.Index(assign, mapAssignment); i >= 0 {
+		return assign[:i]
+	}
+	return assign
+}
+
+// quoteLDFlagsArg quotes the argument so the go command reads it as a single field when splitting
+// the -ldflags value. By default single quotes are used unless double quotes are preferred with -qq
+// or the argument contains single quotes. The style given with -quote uses only the kind of quote
+// selected or none. The go command understands single and double quotes but no escaping inside or
+// outside them, so the argument containing the quote of the style, or both kinds of quote, cannot be
+// represented and the error is returned instead of the argument the go command would split wrong.
+func quoteLDFlagsArg(arg string) (string, error) {
+	if len(arg) > 0 && !strings.ContainsAny(arg, " \t\n\r\v\f'\"") {
+		return arg, nil
+	}
+	var quotes []string
+	switch quoteStyle {
+	case QuoteNone:
+		return "", fmt.Errorf("argument %s contains whitespaces or quotes and cannot be left unquoted, use other -quote style", arg)
+	case QuoteSingle:
+		quotes = []string{"'"}
+	case QuoteDouble:
+		quotes = []string{`"`}
+	default:
+		quotes = []string{"'", `"`}
+		if doubleQuote {
+			quotes[0], quotes[1] = quotes[1], quotes[0]
+		}
+	}
+	for _, q := range quotes {
+		if !strings.Contains(arg, q) {
+			return q + arg + q, nil
+		}
+	}
+	if len(quotes) == 1 {
+		return "", fmt.Errorf("argument %s contains %s quotes and cannot be quoted with them, use other -quote style", arg, quoteStyle)
+	}
+	return "", fmt.Errorf("argument %s contains both single and double quotes", arg)
+}
+
+// splitLDFlags splits the -ldflags value into arguments the way the go command does. Arguments
+// are separated by whitespaces and the argument starting with a single or double quote
+// lasts until the matching quote.
+func splitLDFlags(s string) ([]string, error) {
+	var args []string
+	for {
+		s = strings.TrimLeft(s, " \t\n\r\v\f")
+		if len(s) == 0 {
+			return args, nil
+		}
+		if s[0] == '\'' || s[0] == '"' {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %c quote in %s", s[0], s)
+			}
+			args = append(args, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+		end := strings.IndexAny(s, " \t\n\r\v\f")
+		if end < 0 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+}
+
+// printOutput prints the value to STDOUT or writes it into the output file if one is given.
+// The output file is always written, even with the empty value, so the stale content never survives.
+func printOutput(value string) {
+	if len(outputOpts.Path) == 0 {
+		fmt.Print(value)
+		return
+	}
+
+	msgWith(Fields{"file": outputOpts.Path}, "Writing output to %s\n", outputOpts.Path)
+	if err := writeFileAtomic(outputOpts.Path, []byte(value)); err != nil {
+		fail(ExitOutput, "failed to write output", err)
+	}
+}
+
+// captureOutput prints what the report function writes with printOutput, so reports like
+// the list of targets go to the output file given with -o the same way output formats do.
+func captureOutput(report func(w io.Writer)) {
+	var buf bytes.Buffer
+	report(&buf)
+	printOutput(buf.String())
+}
+
+// writeFileAtomic writes the data into the temporary file next to the path and then
+// renames it to the path, so readers never observe partially written file.
+// Parent directories are created if they do not exist.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, dirPerm); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), filePerm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// formatEnv makes the dotenv file content with one variable per distinct generator used by targets.
+// Variables are named after generators prefixed with the environment prefix and sorted by name.
+// Generators producing empty values are omitted.
+func formatEnv(repo *git.Repository, values []TargetValue) (string, error) {
+	gens, err := generatorValues(repo, values)
+	if err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0, len(gens))
+	for gen, value := range gens {
+		lines = append(lines, envPrefix+envName(gen)+mapAssignment+quoteEnvValue(value))
+	}
+	sort.Strings(lines)
+
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// generatorValues makes the value of each distinct generator used by targets. Values of generators
+// are keyed by names, so options and fallbacks of targets are not applied, but values are finished
+// the same way values of targets are, see finishValue. The value of the target with the generator alone
+// is taken as is, so e.g. the time is the same in -X flags. Generators producing empty values are omitted.
+func generatorValues(repo *git.Repository, values []TargetValue) (map[string]string, error) {
+	gens := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if v.GenSpec() == v.Gen && !isIntType(v.Type) {
+			seen[v.Gen] = true
+			gens[v.Gen] = v.Value
+		}
+	}
+	for _, v := range values {
+		if seen[v.Gen] {
+			continue
+		}
+		seen[v.Gen] = true
+
+		target := Target{Gen: v.Gen}
+		value, err := generateValue(repo, target)
+		if err != nil {
+			return nil, err
+		}
+		if gens[v.Gen], err = finishValue(target, value); err != nil {
+			return nil, err
+		}
+	}
+	for gen, value := range gens {
+		if len(value) == 0 {
+			delete(gens, gen)
+		}
+	}
+	return gens, nil
+}
+
+// formatMake makes the Makefile include with the LDFLAGS variable and one variable per
+// distinct generator used by targets. Variables are named like in env format.
+func formatMake(repo *git.Repository, values []TargetValue) (string, error) {
+	ldflags, err := formatLDFlags(generateLDFlags(values))
+	if err != nil {
+		return "", err
+	}
+	gens, err := generatorValues(repo, values)
+	if err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0, len(gens))
+	for gen, value := range gens {
+		escaped, err := escapeMakeValue(value)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, envPrefix+envName(gen)+" := "+escaped)
+	}
+	sort.Strings(lines)
+
+	escaped, err := escapeMakeValue(ldflags)
+	if err != nil {
+		return "", err
+	}
+	lines = append([]string{envPrefix + makeLDFlagsName + " := " + escaped}, lines...)
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// escapeMakeValue escapes the value so Make reads it literally in the right side of the assignment.
+// Dollars are doubled and hashes are backslash escaped. Line breaks cannot be represented.
+func escapeMakeValue(s string) (string, error) {
+	if strings.ContainsAny(s, "\n\r") {
+		return "", fmt.Errorf("value %q contains line break", s)
+	}
+	return strings.NewReplacer("$", "$$", "#", `\#`).Replace(s), nil
+}
+
+// envName makes the environment variable name from the generator by upper casing it and
+// replacing characters which are not allowed in names with underscores, e.g. hash:12 becomes HASH_12.
+func envName(gen string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, gen)
+}
+
+// quoteEnvValue double quotes the value if it contains characters which have special
+// meaning in dotenv files. Backslashes, double quotes and line breaks are escaped inside quotes.
+func quoteEnvValue(s string) string {
+	if !strings.ContainsAny(s, " \t\n\r#'\"\\`$") {
+		return s
+	}
+	s = strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+	).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputFile(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"ldflags", nil, "-X main.Version=v1.2.3"},
+		{"format", []string{"-format", FormatYAML}, "ldflags: -X main.Version=v1.2.3"},
+		{"dry-run", []string{"-dry-run"}, "main.go  main     Version   version    v1.2.3"},
+		{"list", []string{"-list"}, "main     Version   version    main.go"},
+		{"check", []string{"-check"}, "Version = version:\n  - main.Version (main.go)\nOK\n"},
+		{"print", []string{"-print", GenVersion}, "v1.2.3\n"},
+		{"version", []string{"-version"}, "goxver " + goxverVersion},
+		{"list-generators", []string{"-list-generators"}, GenDescriptions[GenVersion]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "out", tt.name, "output.txt")
+			args := append([]string{"-m", "Version=version", "-o", path}, tt.args...)
+			stdout, stderr, code := runMain(t, dir, nil, args...)
+			if code != ExitOk {
+				t.Fatalf("exit code %d, stderr %s", code, stderr)
+			}
+			if len(stdout) > 0 {
+				t.Errorf("STDOUT is not empty: %q", stdout)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tt.want) {
+				t.Errorf("output %q does not contain %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputFileError(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+
+	// The parent of the output file is the regular file, so the directory cannot be created
+	for _, args := range [][]string{nil, {"-list"}, {"-print", GenVersion}} {
+		args = append([]string{"-m", "Version=version", "-o", filepath.Join(dir, "main.go", "output.txt")}, args...)
+		if _, stderr, code := runMain(t, dir, nil, args...); code != ExitOutput {
+			t.Errorf("%v: exit code %d, want %d, stderr %s", args, code, ExitOutput, stderr)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	path := filepath.Join(dir, "dist", "manifest.json")
+
+	// The time with nanoseconds differs if it is generated twice, and empty values are not stamped
+	const layout = "2006-01-02T15:04:05.000000000"
+	stdout, stderr, code := runMain(t, dir, nil, "-manifest", path,
+		"-m", "Version=version(prefix=release-),Commit=time(format="+layout+"),Missing=env:APP_MISSING")
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc Manifest
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("manifest %s is not JSON: %s", data, err.Error())
+	}
+	if doc.Commit != hash {
+		t.Errorf("commit %s, want %s", doc.Commit, hash)
+	}
+	if _, err := time.Parse(time.RFC3339, doc.BuildTime); err != nil {
+		t.Errorf("build time %s: %s", doc.BuildTime, err.Error())
+	}
+	if len(doc.Targets) != 2 {
+		t.Fatalf("targets %+v, want Commit and Version", doc.Targets)
+	}
+	commit, version := doc.Targets[0], doc.Targets[1]
+	if commit.Pkg != mainPkgName || commit.Var != "Commit" || commit.Gen != "time(format="+layout+")" {
+		t.Errorf("target %+v", commit)
+	}
+	if _, err := time.Parse(layout, commit.Value); err != nil {
+		t.Errorf("time %s: %s", commit.Value, err.Error())
+	}
+	if version != (ManifestTarget{Pkg: mainPkgName, Var: "Version", Gen: "version(prefix=release-)", Value: "release-v1.2.3"}) {
+		t.Errorf("target %+v", version)
+	}
+
+	// The manifest has the values -X flags have
+	if want := "-X main.Commit=" + commit.Value + " -X main.Version=" + version.Value; stdout != want {
+		t.Errorf("STDOUT %q, want %q", stdout, want)
+	}
+}
+
+func TestDuplicateTargetsFormats(t *testing.T) {
+	const source = "package main\n\nvar Version string\n\nfunc main() {}\n"
+	dir, _, cleanup := testRepo(t, map[string]string{
+		"go.mod":          "module example.com/app\n",
+		"cmd/a/main.go":   source,
+		"cmd/b/main.go":   source,
+		defaultConfigName: "Version=version\n",
+	}, "v1.2.3")
+	defer cleanup()
+
+	// Both main packages have main.Version, the one mapped by the configuration goes first
+	// in every format whatever the other one is mapped to with -m
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "-X main.Version=v1.2.3"},
+		{[]string{"-format", FormatLines}, "-X main.Version=v1.2.3\n"},
+		{[]string{"-format", FormatBazel}, "{\n  \"main.Version\": \"v1.2.3\"\n}\n"},
+		{[]string{"-format", FormatBazel, "-bazel-style", BazelStyleBzl}, bazelDictName + " = {\n    \"main.Version\": \"v1.2.3\",\n}\n"},
+		{[]string{"-format", FormatDocker}, "--build-arg VERSION=v1.2.3"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-m", "example.com/app/cmd/b.Version=tag(prefix=b-)"}, tt.args...)
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+}
+
+func TestGoReleaserTemplate(t *testing.T) {
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Target{Gen: GenVersion}, "{{.Tag}}"},
+		{Target{Gen: GenTag}, "{{.Tag}}"},
+		{Target{Gen: GenHashShort}, "{{.ShortCommit}}"},
+		{Target{Gen: GenHashLong}, "{{.FullCommit}}"},
+		{Target{Gen: GenTimestamp}, "{{.Timestamp}}"},
+		{Target{Gen: GenGOOS}, "{{.Os}}"},
+		{Target{Gen: GenGOARCH}, "{{.Arch}}"},
+		{Target{Gen: GenTime}, `{{ time "2006-01-02_15:04:05_Z07:00" }}`},
+		{Target{Gen: GenTime, Opts: GenOptions{OptFormat: "2006-01-02", OptUTC: "true"}}, `{{ time "2006-01-02" }}`},
+		{Target{Gen: GenVersion, Opts: GenOptions{OptPrefix: "release-"}}, "{{.Tag}}"},
+		{Target{Gen: GenHashLong, Opts: GenOptions{OptUpper: "true"}}, ""},
+		{Target{Gen: GenVersion, Fallback: "v0.0.0-dev"}, ""},
+		{Target{Gen: GenCommitCount}, ""},
+		{Target{Gen: "hash:12"}, ""},
+	}
+	for _, tt := range tests {
+		got, ok := goReleaserTemplate(tt.target)
+		if got != tt.want || ok != (len(tt.want) > 0) {
+			t.Errorf("goReleaserTemplate(%s) = %q, %v, want %q", tt.target.GenSpec(), got, ok, tt.want)
+		}
+	}
+
+	defer func(prefix string) { tagPrefix = prefix }(tagPrefix)
+	tagPrefix = "backend/"
+	for _, gen := range []string{GenVersion, GenTag} {
+		if got, ok := goReleaserTemplate(Target{Gen: gen}); ok {
+			t.Errorf("goReleaserTemplate(%s) with tag prefix = %q", gen, got)
+		}
+	}
+}
+
+func TestFormatGoReleaser(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	stdout, stderr, code := runMain(t, dir, nil, "-format", FormatGoReleaser, "-extra", "-s -w",
+		"-m", "Version=version(suffix=-rc),Commit=hash:10,Count=commit_count,BuildTime=time(format=2006)")
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+	want := "ldflags:\n" +
+		"  - -s -w\n" +
+		"  - -X main.Commit=" + hash[:10] + "\n" +
+		"  - -X main.Version={{.Tag}}-rc\n"
+	if stdout != want {
+		t.Errorf("got\n%s\nwant\n%s", stdout, want)
+	}
+}
+
+func TestFormatMakeInclude(t *testing.T) {
+	makeCmd, err := exec.LookPath("make")
+	if err != nil {
+		t.Skip("make is not found")
+	}
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		"Makefile": "include version.mk\n$(info $(GOXVER_LDFLAGS))\n$(info $(GOXVER_VERSION))\n$(info $(GOXVER_ENV_APP_VALUE))\nall: ;\n",
+	})
+
+	const value = `a $b $$c #d \e`
+	_, stderr, code := runMain(t, dir, []string{"APP_VALUE=" + value}, "-format", FormatMake, "-o", "version.mk",
+		"-m", "Version=version,Commit=env:APP_VALUE")
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+
+	cmd := exec.Command(makeCmd, "-s", "-f", "Makefile")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("make failed: %s\n%s", err.Error(), out)
+	}
+	want := "-X 'main.Commit=" + value + "' -X main.Version=v1.2.3\nv1.2.3\n" + value + "\n"
+	if string(out) != want {
+		t.Errorf("make printed\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestEscapeMakeValue(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"v1.2.3", "v1.2.3"},
+		{"$HOME", "$$HOME"},
+		{"a#b", `a\#b`},
+		{"$$#", `$$$$\#`},
+	}
+	for _, tt := range tests {
+		if got, err := escapeMakeValue(tt.s); err != nil || got != tt.want {
+			t.Errorf("escapeMakeValue(%q) = %q, %v, want %q", tt.s, got, err, tt.want)
+		}
+	}
+	if _, err := escapeMakeValue("a\nb"); err == nil {
+		t.Error("line break is not rejected")
+	}
+}
+
+// buildProject is the module which prints Version and Commit quoted.
+var buildProject = map[string]string{
+	"go.mod":  "module example.com/app\n",
+	"main.go": "package main\n\nimport \"fmt\"\n\nvar (\n\tVersion string\n\tCommit  string\n)\n\nfunc main() {\n\tfmt.Printf(\"%q %q\\n\", Version, Commit)\n}\n",
+}
+
+func TestLDFlagsGoBuild(t *testing.T) {
+	dir, _, cleanup := testRepo(t, buildProject, "v1.2.3")
+	defer cleanup()
+
+	values := []string{
+		"v1 2.0",
+		"  leading and trailing  ",
+		"it's",
+		`say "hi"`,
+		"$HOME and ${PATH} `pwd`",
+		`back\slash`,
+	}
+	for _, value := range values {
+		for _, wrap := range []bool{false, true} {
+			args := []string{"-m", "Version=version,Commit=env:APP_VALUE"}
+			if wrap {
+				args = append(args, "-wrap")
+			}
+			stdout, stderr, code := runMain(t, dir, []string{"APP_VALUE=" + value}, args...)
+			if code != ExitOk {
+				t.Errorf("%q: exit code %d, STDERR %s", value, code, stderr)
+				continue
+			}
+
+			// The output is the single argument as go build -ldflags "$(goxver)" passes it
+			var out string
+			if wrap {
+				out = buildAndRun(t, dir, stdout)
+			} else {
+				out = buildAndRun(t, dir, "-ldflags", stdout)
+			}
+			if want := strconv.Quote("v1.2.3") + " " + strconv.Quote(value) + "\n"; out != want {
+				t.Errorf("%q with -wrap %v: ldflags %s, binary printed %s", value, wrap, stdout, out)
+			}
+		}
+	}
+}
+
+func TestExtraGoBuild(t *testing.T) {
+	dir, _, cleanup := testRepo(t, buildProject, "v1.2.3")
+	defer cleanup()
+	const want = `"v1.2.3" "from extra"` + "\n"
+
+	for _, format := range [][]string{nil, {"-wrap"}, {"-sep", SepNewline}, {"-format", FormatRsp}} {
+		args := append([]string{"-m", "Version=version", "-extra", "-s -w", "-extra", "-X 'main.Commit=from extra'"}, format...)
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if code != ExitOk {
+			t.Errorf("%v: exit code %d, STDERR %s", format, code, stderr)
+			continue
+		}
+
+		var out string
+		switch {
+		case len(format) > 0 && format[0] == "-wrap":
+			out = buildAndRun(t, dir, stdout)
+		case strings.HasPrefix(stdout, rspPrefix):
+			out = linkAndRun(t, dir, stdout)
+			_ = os.Remove(stdout[len(rspPrefix):])
+		default:
+			out = buildAndRun(t, dir, "-ldflags", stdout)
+		}
+		if out != want {
+			t.Errorf("%v: ldflags %s, binary printed %s", format, stdout, out)
+		}
+	}
+}
+
+// linkAndRun compiles main.go of the directory importing only fmt and links it with the linker
+// arguments given, e.g. the response file reference, as the go command rejects @ arguments.
+// It runs the binary and returns its output. The test is skipped without the go command.
+func linkAndRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command is not found")
+	}
+	run := func(args ...string) []byte {
+		cmd := exec.Command(goCmd, args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("go %v failed: %s", args, err.Error())
+		}
+		return out
+	}
+
+	cfg, bin := filepath.Join(dir, "importcfg"), filepath.Join(dir, "app.bin")
+	deps := run("list", "-export", "-deps", "-f", "{{if .Export}}packagefile {{.ImportPath}}={{.Export}}{{end}}", "fmt")
+	if err := ioutil.WriteFile(cfg, deps, filePerm); err != nil {
+		t.Fatal(err)
+	}
+	run("tool", "compile", "-p", mainPkgName, "-importcfg", cfg, "-o", "main.a", "main.go")
+	run(append(append([]string{"tool", "link", "-importcfg", cfg, "-o", bin}, args...), "main.a")...)
+
+	out, err := exec.Command(bin).Output()
+	if err != nil {
+		t.Fatalf("%s failed: %s", bin, err.Error())
+	}
+	return string(out)
+}
+
+func TestStripFlags(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	rsp := filepath.Join(dir, "out", "flags.rsp")
+
+	// -s and -w are added once whatever flags are given already
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "-X main.Version=v1.2.3 -s -w"},
+		{[]string{"-extra", "-s -w"}, "-s -w -X main.Version=v1.2.3"},
+		{[]string{"-extra", "-w"}, "-w -X main.Version=v1.2.3 -s"},
+		{[]string{"-extra", "-s", "-extra", "-w"}, "-s -w -X main.Version=v1.2.3"},
+		{[]string{"-extra", "-s=false"}, "-s=false -X main.Version=v1.2.3 -w"},
+		{[]string{"-merge", "-s -X main.Version=dev"}, "-s -X main.Version=v1.2.3 -w"},
+		{[]string{"-format", FormatLines}, "-X main.Version=v1.2.3\n"},
+		{[]string{"-format", FormatGoReleaser}, "ldflags:\n  - -X main.Version={{.Tag}}\n  - -s -w\n"},
+		{[]string{"-format", FormatGoReleaser, "-extra", "-s -w"}, "ldflags:\n  - -s -w\n  - -X main.Version={{.Tag}}\n"},
+		{[]string{"-format", FormatGoReleaser, "-extra", "-w"}, "ldflags:\n  - -w\n  - -X main.Version={{.Tag}}\n  - -s\n"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-m", "Version=version", "-strip"}, tt.args...)
+		stdout, stderr, code := runMain(t, dir, nil, args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	for extra, want := range map[string]string{
+		"":      "-X\nmain.Version=v1.2.3\n-s\n-w\n",
+		"-w -s": "-w\n-s\n-X\nmain.Version=v1.2.3\n",
+	} {
+		args := []string{"-m", "Version=version", "-strip", "-format", FormatRsp, "-o", rsp}
+		if len(extra) > 0 {
+			args = append(args, "-extra", extra)
+		}
+		if _, stderr, code := runMain(t, dir, nil, args...); code != ExitOk {
+			t.Errorf("rsp with %q: exit code %d, STDERR %s", extra, code, stderr)
+		}
+		if data, err := ioutil.ReadFile(rsp); err != nil || string(data) != want {
+			t.Errorf("rsp with %q: %q, %v, want %q", extra, data, err, want)
+		}
+	}
+
+	// The extra flags which cannot be split are the error
+	if _, _, code := runMain(t, dir, nil, "-m", "Version=version", "-strip", "-extra", "-X 'main.Commit=x"); code != ExitOutput {
+		t.Errorf("unterminated quote: exit code %d, want %d", code, ExitOutput)
+	}
+}
+
+func TestMergeLDFlags(t *testing.T) {
+	assigns := []string{"main.Version=v1.2.3", "main.Commit=abc"}
+	tests := []struct {
+		existing string
+		want     []string
+	}{
+		{"", []string{"-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+		{"-s -w", []string{"-s", "-w", "-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+		{"-s -X main.Version=dev", []string{"-s", "-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+		{"-X=main.Version=dev -w", []string{"-X", "main.Version=v1.2.3", "-w", "-X", "main.Commit=abc"}},
+		{"-s -X main.Version=1 -X main.Version=2", []string{"-s", "-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+		{"-X main.Version=1 -w -X=main.Version=2 -X main.Commit=3 -X main.Commit=4",
+			[]string{"-X", "main.Version=v1.2.3", "-w", "-X", "main.Commit=abc"}},
+		{"-X 'main.Name=my app' -X main.Version=dev", []string{"-X", "main.Name=my app", "-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+		{"-X main.Name=1 -X main.Name=2", []string{"-X", "main.Name=1", "-X", "main.Name=2", "-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+		{"-X main.Versions=dev", []string{"-X", "main.Versions=dev", "-X", "main.Version=v1.2.3", "-X", "main.Commit=abc"}},
+	}
+	for _, tt := range tests {
+		got, err := mergeLDFlags(tt.existing, assigns)
+		if err != nil {
+			t.Errorf("mergeLDFlags(%q) error %s", tt.existing, err.Error())
+		} else if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("mergeLDFlags(%q) = %q, want %q", tt.existing, got, tt.want)
+		}
+	}
+
+	if _, err := mergeLDFlags("-X 'main.Version=dev", assigns); err == nil {
+		t.Error("unterminated quote is not rejected")
+	}
+}
+
+func TestQuoteLDFlagsArg(t *testing.T) {
+	defer func(style string, double bool) { quoteStyle, doubleQuote = style, double }(quoteStyle, doubleQuote)
+
+	// The empty result means the argument cannot be represented in the style
+	values := []string{"main.V=v1.2.3", "main.V=a b", "main.V=it's", `main.V=say "hi"`, `main.V=it's "both"`, ""}
+	tests := []struct {
+		style  string
+		double bool
+		want   []string
+	}{
+		{QuoteAuto, false, []string{"main.V=v1.2.3", "'main.V=a b'", `"main.V=it's"`, `'main.V=say "hi"'`, "", "''"}},
+		{QuoteAuto, true, []string{"main.V=v1.2.3", `"main.V=a b"`, `"main.V=it's"`, `'main.V=say "hi"'`, "", `""`}},
+		{QuoteNone, false, []string{"main.V=v1.2.3", "", "", "", "", ""}},
+		{QuoteSingle, false, []string{"main.V=v1.2.3", "'main.V=a b'", "", `'main.V=say "hi"'`, "", "''"}},
+		{QuoteDouble, false, []string{"main.V=v1.2.3", `"main.V=a b"`, `"main.V=it's"`, "", "", `""`}},
+	}
+	for _, tt := range tests {
+		quoteStyle, doubleQuote = tt.style, tt.double
+		for i, value := range values {
+			got, err := quoteLDFlagsArg(value)
+			if len(tt.want[i]) == 0 {
+				if err == nil {
+					t.Errorf("style %q: %q is quoted as %q, want error", tt.style, value, got)
+				}
+				continue
+			}
+			if err != nil || got != tt.want[i] {
+				t.Errorf("style %q, -qq %v: quoteLDFlagsArg(%q) = %q, %v, want %q", tt.style, tt.double, value, got, err, tt.want[i])
+				continue
+			}
+
+			// The go command reads the quoted argument back as the value
+			if args, err := splitLDFlags(got); err != nil || len(args) != 1 || args[0] != value {
+				t.Errorf("style %q: %q splits to %q, %v", tt.style, got, args, err)
+			}
+		}
+	}
+}
+
+func TestQuoteStyleGoBuild(t *testing.T) {
+	dir, _, cleanup := testRepo(t, buildProject, "v1.2.3")
+	defer cleanup()
+
+	for _, style := range ValidQuotes {
+		for _, value := range []string{"it's", `say "hi"`, `it's "both"`} {
+			env := []string{"APP_VALUE=" + value}
+			stdout, stderr, code := runMain(t, dir, env, "-quote", style, "-m", "Version=version,Commit=env:APP_VALUE")
+			if strings.Contains(value, "'") && strings.Contains(value, `"`) || style == QuoteNone ||
+				style == QuoteSingle && strings.Contains(value, "'") || style == QuoteDouble && strings.Contains(value, `"`) {
+				if code != ExitOutput {
+					t.Errorf("%s: %q gives exit code %d, want %d, STDOUT %s", style, value, code, ExitOutput, stdout)
+				}
+				continue
+			}
+			if code != ExitOk {
+				t.Errorf("%s: %q gives exit code %d, STDERR %s", style, value, code, stderr)
+				continue
+			}
+			if out, want := buildAndRun(t, dir, "-ldflags", stdout), `"v1.2.3" `+strconv.Quote(value)+"\n"; out != want {
+				t.Errorf("%s: ldflags %s, binary printed %s", style, stdout, out)
+			}
+		}
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	dir, hash, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{defaultConfigName: "format = lines\nVersion=version\nCommit=hash:4\n"})
+	lines := "-X main.Commit=" + hash[:4] + "\n-X main.Version=v1.2.3\n"
+
+	// The format of the configuration is used unless any format flag is given,
+	// even -format with the default format overrides it
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, lines},
+		{[]string{"-format", FormatEnv}, "GOXVER_HASH_4=" + hash[:4] + "\nGOXVER_VERSION=v1.2.3\n"},
+		{[]string{"-format", FormatLDFlags}, "-X main.Commit=" + hash[:4] + " -X main.Version=v1.2.3"},
+		{[]string{"-print0"}, strings.Replace(lines, "\n", "\x00", -1)},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, nil, tt.args...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	// The user configuration declares the format too and the project one overrides it
+	home, cleanupHome := tempDir(t)
+	defer cleanupHome()
+	writeFiles(t, home, map[string]string{".goxver": "format = env\n"})
+	if stdout, stderr, code := runMain(t, dir, []string{"HOME=" + home}); code != ExitOk || stdout != lines {
+		t.Errorf("user configuration: exit code %d, STDOUT %q, want %q, STDERR %s", code, stdout, lines, stderr)
+	}
+
+	// The invalid format is the configuration error
+	writeFiles(t, dir, map[string]string{defaultConfigName: "format = xml\nVersion=version\n"})
+	if _, stderr, code := runMain(t, dir, nil, "-format", FormatLines); code != ExitUsage || !strings.Contains(stderr, "invalid format xml") {
+		t.Errorf("invalid format: exit code %d, STDERR %s", code, stderr)
+	}
+}
+
+func TestFlagSeparators(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	env := []string{"APP_VALUE=a b"}
+	mapping := []string{"-m", "Version=version,Commit=env:APP_VALUE"}
+
+	// The separator joins -X flags with their quoted values and flags -strip adds,
+	// the prefix of -wrap goes before the first flag only and other formats ignore the separator
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "-X 'main.Commit=a b' -X main.Version=v1.2.3"},
+		{[]string{"-sep", SepSpace}, "-X 'main.Commit=a b' -X main.Version=v1.2.3"},
+		{[]string{"-sep", SepNewline}, "-X 'main.Commit=a b'\n-X main.Version=v1.2.3"},
+		{[]string{"-sep", SepNull}, "-X 'main.Commit=a b'\x00-X main.Version=v1.2.3"},
+		{[]string{"-sep", SepNewline, "-wrap", "-strip"}, ldflagsPrefix + "-X 'main.Commit=a b'\n-X main.Version=v1.2.3\n-s\n-w"},
+		{[]string{"-sep", SepNull, "-format", FormatEnv}, "GOXVER_ENV_APP_VALUE=\"a b\"\nGOXVER_VERSION=v1.2.3\n"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runMain(t, dir, env, append(mapping, tt.args...)...)
+		if code != ExitOk || stdout != tt.want {
+			t.Errorf("%v: exit code %d, STDOUT %q, want %q, STDERR %s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+
+	if _, stderr, code := runMain(t, dir, env, "-sep", "tab"); code != ExitUsage || !strings.Contains(stderr, "invalid separator tab") {
+		t.Errorf("invalid separator: exit code %d, STDERR %s", code, stderr)
+	}
+}
+
+func TestEncodeRspArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"main.Version=v1.2.3", "main.Version=v1.2.3"},
+		{"main.Version=версия", "main.Version=версия"},
+		{"", `""`},
+		{"main.Commit=a b", `"main.Commit=a b"`},
+		{"main.Commit=it's", `"main.Commit=it's"`},
+		{`main.Commit=say "hi"`, `"main.Commit=say \"hi\""`},
+		{`main.Commit=back\slash`, `"main.Commit=back\\slash"`},
+		{"main.Commit=$HOME `pwd`", "\"main.Commit=\\$HOME \\`pwd\\`\""},
+	}
+	for _, tt := range tests {
+		if got := encodeRspArg(tt.arg); got != tt.want {
+			t.Errorf("encodeRspArg(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestRspGoBuild(t *testing.T) {
+	dir, _, cleanup := testRepo(t, buildProject, "v1.2.3")
+	defer cleanup()
+
+	// The linker reads every value back as it is from the temporary response file
+	values := []string{
+		"v1 2.0",
+		"  leading and trailing  ",
+		"it's",
+		`say "hi"`,
+		"$HOME and ${PATH} `pwd`",
+		`back\slash`,
+		"версия 1.0 ✓",
+	}
+	for _, value := range values {
+		stdout, stderr, code := runMain(t, dir, []string{"APP_VALUE=" + value}, "-m", "Version=version,Commit=env:APP_VALUE", "-format", FormatRsp)
+		if code != ExitOk || !strings.HasPrefix(stdout, rspPrefix) {
+			t.Errorf("%q: exit code %d, STDOUT %q, STDERR %s", value, code, stdout, stderr)
+			continue
+		}
+		out := linkAndRun(t, dir, stdout)
+		_ = os.Remove(stdout[len(rspPrefix):])
+		if want := strconv.Quote("v1.2.3") + " " + strconv.Quote(value) + "\n"; out != want {
+			t.Errorf("%q: binary printed %s, want %s", value, out, want)
+		}
+	}
+
+	// With -o the response file is written there and nothing is printed
+	rsp := filepath.Join(dir, "version.rsp")
+	stdout, stderr, code := runMain(t, dir, []string{"APP_VALUE=a b"}, "-m", "Version=version,Commit=env:APP_VALUE", "-format", FormatRsp, "-o", rsp)
+	if code != ExitOk || len(stdout) > 0 {
+		t.Fatalf("-o: exit code %d, STDOUT %q, STDERR %s", code, stdout, stderr)
+	}
+	const want = "-X\n\"main.Commit=a b\"\n-X\nmain.Version=v1.2.3\n"
+	if data, err := ioutil.ReadFile(rsp); err != nil || string(data) != want {
+		t.Errorf("-o: %q, %v, want %q", data, err, want)
+	}
+	if out := linkAndRun(t, dir, rspPrefix+rsp); out != `"v1.2.3" "a b"`+"\n" {
+		t.Errorf("-o: binary printed %s", out)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Constants of manifest patching
+const (
+	patchFileSeparator = ":"
+	keyPathSeparator   = "."
+	manifestIndent     = 2
+	extJSON            = ".json"
+	extYAML            = ".yaml"
+	extYML             = ".yml"
+)
+
+// Patch sets the key of the manifest file to the value of the generator.
+type Patch struct {
+	File    string
+	KeyPath []string
+	Gen     string
+}
+
+// stringsFlag is the repeatable command line flag which collects all values given.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parsePatch parses the patch in the format FILE:KEYPATH=gen where
+// - FILE is the path to YAML or JSON file
+// - KEYPATH is the dot separated path to the key, e.g. image.tag
+// - gen is the valid name of value generator (one of ValidGens)
+func parsePatch(s string) (p Patch, err error) {
+	assignAt := strings.LastIndex(s, mapAssignment)
+	if assignAt < 0 {
+		return p, fmt.Errorf("invalid patch %s", s)
+	}
+	p.Gen = s[assignAt+len(mapAssignment):]
+	if !isValidGen(p.Gen) {
+		return p, fmt.Errorf("invalid generator %s", s)
+	}
+
+	sepAt := strings.LastIndex(s[:assignAt], patchFileSeparator)
+	if sepAt <= 0 {
+		return p, fmt.Errorf("invalid patch %s", s)
+	}
+	p.File = s[:sepAt]
+	p.KeyPath = strings.Split(s[sepAt+len(patchFileSeparator):assignAt], keyPathSeparator)
+	for _, key := range p.KeyPath {
+		if len(key) == 0 {
+			return p, fmt.Errorf("invalid key path in patch %s", s)
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(p.File)) {
+	case extJSON, extYAML, extYML:
+	default:
+		return p, fmt.Errorf("unsupported file type in patch %s", s)
+	}
+
+	return p, nil
+}
+
+// applyPatches sets values of generators into manifest files.
+func applyPatches(repo *git.Repository, patches []Patch) error {
+	for _, p := range patches {
+		value, err := generateValue(repo, Target{Gen: p.Gen})
+		if err != nil {
+			return err
+		}
+
+		msgWith(Fields{"file": p.File, "generator": p.Gen}, "Patching %s in %s with %s\n", strings.Join(p.KeyPath, keyPathSeparator), p.File, value)
+		if err = patchFile(p.File, p.KeyPath, value); err != nil {
+			return fmt.Errorf("failed to patch %s: %s", p.File, err.Error())
+		}
+	}
+	return nil
+}
+
+// patchFile sets the key of the manifest file to the value and writes the file back.
+func patchFile(path string, keyPath []string, value string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case extJSON:
+		data, err = patchJSON(data, keyPath, value)
+	case extYAML, extYML:
+		data, err = patchYAML(data, keyPath, value)
+	default:
+		err = fmt.Errorf("unsupported file type %s", filepath.Ext(path))
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// patchYAML sets the key of the YAML document to the value.
+// The document is patched on the node level so comments and the order of keys are preserved.
+func patchYAML(data []byte, keyPath []string, value string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, fmt.Errorf("document is empty")
+	}
+
+	node := doc.Content[0]
+	for i, key := range keyPath {
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("key %s is not a mapping", strings.Join(keyPath[:i], keyPathSeparator))
+		}
+
+		var child *yaml.Node
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == key {
+				child = node.Content[j+1]
+				break
+			}
+		}
+
+		if child == nil {
+			if i < len(keyPath)-1 {
+				return nil, fmt.Errorf("key %s not found", strings.Join(keyPath[:i+1], keyPathSeparator))
+			}
+			child = &yaml.Node{}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+		}
+		node = child
+	}
+
+	*node = yaml.Node{
+		Kind:        yaml.ScalarNode,
+		Tag:         "!!str",
+		Value:       value,
+		HeadComment: node.HeadComment,
+		LineComment: node.LineComment,
+		FootComment: node.FootComment,
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(manifestIndent)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// patchJSON sets the key of the JSON document to the value.
+// The order of object keys is preserved.
+func patchJSON(data []byte, keyPath []string, value string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	doc, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := doc.(*jsonObject)
+	for i, key := range keyPath {
+		if !ok {
+			return nil, fmt.Errorf("key %s is not an object", strings.Join(keyPath[:i], keyPathSeparator))
+		}
+		if i == len(keyPath)-1 {
+			obj.Set(key, value)
+			break
+		}
+
+		child, found := obj.values[key]
+		if !found {
+			return nil, fmt.Errorf("key %s not found", strings.Join(keyPath[:i+1], keyPathSeparator))
+		}
+		obj, ok = child.(*jsonObject)
+	}
+
+	out, err := json.MarshalIndent(doc, "", strings.Repeat(" ", manifestIndent))
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// jsonObject is the JSON object which remembers the order of its keys.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Set sets the value of the key adding the key to the end if it does not exist.
+func (o *jsonObject) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// MarshalJSON encodes the object with keys in the original order.
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeJSONValue decodes the next JSON value from the token stream with objects decoded
+// into jsonObject so the order of keys is preserved.
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("document is empty")
+		}
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := &jsonObject{values: make(map[string]interface{})}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := keyTok.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid object key %v", keyTok)
+			}
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(key, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	default:
+		return tok, nil
+	}
+}
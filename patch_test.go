@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Patch
+		wantErr string
+	}{
+		{s: "values.yaml:image.tag=version", want: Patch{File: "values.yaml", KeyPath: []string{"image", "tag"}, Gen: GenVersion}},
+		{s: "C:/deploy/app.JSON:version=hash:12", want: Patch{File: "C:/deploy/app.JSON", KeyPath: []string{"version"}, Gen: "hash:12"}},
+		{s: "chart.yml:appVersion=tag", want: Patch{File: "chart.yml", KeyPath: []string{"appVersion"}, Gen: GenTag}},
+		{s: "values.toml:image.tag=version", wantErr: "unsupported file type"},
+		{s: "values.yaml:image..tag=version", wantErr: "invalid key path"},
+		{s: "values.yaml:image.tag=unknown", wantErr: "invalid generator"},
+		{s: "values.yaml=version", wantErr: "invalid patch"},
+		{s: "values.yaml:image.tag", wantErr: "invalid patch"},
+	}
+	for _, tt := range tests {
+		p, err := parsePatch(tt.s)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsePatch(%q) error %v, want %q", tt.s, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePatch(%q) error %v", tt.s, err)
+			continue
+		}
+		if p.File != tt.want.File || p.Gen != tt.want.Gen || strings.Join(p.KeyPath, ".") != strings.Join(tt.want.KeyPath, ".") {
+			t.Errorf("parsePatch(%q) = %+v, want %+v", tt.s, p, tt.want)
+		}
+	}
+}
+
+func TestPatchYAML(t *testing.T) {
+	const doc = `# Values of the chart
+replicas: 2
+image:
+  repository: example/app # The image
+  tag: latest
+  pullPolicy: IfNotPresent
+ports: [80, 443]
+`
+	tests := []struct {
+		keyPath string
+		want    string
+		wantErr string
+	}{
+		{keyPath: "image.tag", want: `# Values of the chart
+replicas: 2
+image:
+  repository: example/app # The image
+  tag: v1.2.3
+  pullPolicy: IfNotPresent
+ports: [80, 443]
+`},
+		{keyPath: "image.repository", want: `# Values of the chart
+replicas: 2
+image:
+  repository: v1.2.3 # The image
+  tag: latest
+  pullPolicy: IfNotPresent
+ports: [80, 443]
+`},
+		{keyPath: "version", want: doc + "version: v1.2.3\n"},
+		{keyPath: "replicas", want: strings.Replace(doc, "replicas: 2", "replicas: v1.2.3", 1)},
+		{keyPath: "chart.version", wantErr: "key chart not found"},
+		{keyPath: "replicas.count", wantErr: "key replicas is not a mapping"},
+	}
+	for _, tt := range tests {
+		out, err := patchYAML([]byte(doc), strings.Split(tt.keyPath, keyPathSeparator), "v1.2.3")
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %v, want %q", tt.keyPath, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error %v", tt.keyPath, err)
+		} else if string(out) != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.keyPath, out, tt.want)
+		}
+	}
+
+	// Values are always strings even if they look like numbers
+	out, err := patchYAML([]byte(doc), []string{"replicas"}, "3")
+	if err != nil || !strings.Contains(string(out), `replicas: "3"`) {
+		t.Errorf("numeric value: got %s, error %v", out, err)
+	}
+}
+
+func TestPatchJSON(t *testing.T) {
+	const doc = `{"name": "app", "build": {"version": "dev", "number": 12345678901234567890, "tags": ["a", null, true]}, "empty": {}}`
+	tests := []struct {
+		keyPath string
+		want    string
+		wantErr string
+	}{
+		{keyPath: "build.version", want: `{
+  "name": "app",
+  "build": {
+    "version": "v1.2.3",
+    "number": 12345678901234567890,
+    "tags": [
+      "a",
+      null,
+      true
+    ]
+  },
+  "empty": {}
+}
+`},
+		{keyPath: "empty.version", want: `{
+  "name": "app",
+  "build": {
+    "version": "dev",
+    "number": 12345678901234567890,
+    "tags": [
+      "a",
+      null,
+      true
+    ]
+  },
+  "empty": {
+    "version": "v1.2.3"
+  }
+}
+`},
+		{keyPath: "release.version", wantErr: "key release not found"},
+		{keyPath: "name.version", wantErr: "key name is not an object"},
+	}
+	for _, tt := range tests {
+		out, err := patchJSON([]byte(doc), strings.Split(tt.keyPath, keyPathSeparator), "v1.2.3")
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %v, want %q", tt.keyPath, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error %v", tt.keyPath, err)
+		} else if string(out) != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.keyPath, out, tt.want)
+		}
+	}
+
+	if _, err := patchJSON(nil, []string{"version"}, "v1.2.3"); err == nil || err.Error() != "document is empty" {
+		t.Errorf("empty document error %v", err)
+	}
+}
+
+func TestPatchFiles(t *testing.T) {
+	dir, _, cleanup := testRepo(t, testProject, "v1.2.3")
+	defer cleanup()
+	writeFiles(t, dir, map[string]string{
+		"deploy/values.yaml":   "image:\n  tag: latest\n",
+		"deploy/manifest.json": "{\"version\": \"dev\"}\n",
+	})
+
+	_, stderr, code := runMain(t, dir, nil,
+		"-patch", "deploy/values.yaml:image.tag=version",
+		"-patch", "deploy/manifest.json:version=version")
+	if code != ExitOk {
+		t.Fatalf("exit code %d, STDERR %s", code, stderr)
+	}
+	for name, want := range map[string]string{
+		"deploy/values.yaml":   "image:\n  tag: v1.2.3\n",
+		"deploy/manifest.json": "{\n  \"version\": \"v1.2.3\"\n}\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+
+	if _, _, code := runMain(t, dir, nil, "-patch", "deploy/values.ini:image.tag=version"); code != ExitUsage {
+		t.Errorf("unsupported file type: exit code %d, want %d", code, ExitUsage)
+	}
+	if _, _, code := runMain(t, dir, nil, "-patch", "deploy/values.yaml:chart.version=version"); code != ExitOutput {
+		t.Errorf("missing key: exit code %d, want %d", code, ExitOutput)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// statsPrefix starts every line of statistics.
+const statsPrefix = "stats: "
+
+// Stat is the time elapsed in the phase of processing with optional details.
+type Stat struct {
+	Phase    string
+	Duration time.Duration
+	Detail   string
+}
+
+var (
+	statsMut   sync.Mutex
+	statsList  []Stat
+	statsStart = time.Now()
+)
+
+// recordStat records the time elapsed since the start of the phase if statistics are enabled.
+func recordStat(phase string, start time.Time, detail string) {
+	if !showStats {
+		return
+	}
+	statsMut.Lock()
+	statsList = append(statsList, Stat{Phase: phase, Duration: time.Since(start), Detail: detail})
+	statsMut.Unlock()
+}
+
+// printStats prints to STDERR phases recorded in the order they finished followed by the total
+// time, one per line in the form "stats: PHASE: DURATION[ (DETAIL)]".
+func printStats() {
+	statsMut.Lock()
+	defer statsMut.Unlock()
+	for _, s := range statsList {
+		line := statsPrefix + s.Phase + ": " + s.Duration.String()
+		if len(s.Detail) > 0 {
+			line += " (" + s.Detail + ")"
+		}
+		_, _ = fmt.Fprintln(os.Stderr, line)
+	}
+	_, _ = fmt.Fprintln(os.Stderr, statsPrefix+"total: "+time.Since(statsStart).String())
+}
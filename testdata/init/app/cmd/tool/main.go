@@ -0,0 +1,5 @@
+package main
+
+var Commit string
+
+func main() {}
@@ -0,0 +1,7 @@
+package info
+
+// GitCommit is the full hash of the revision
+var GitCommit string
+
+// BuildTime cannot be stamped with -X, so it is not proposed
+var BuildTime int64
@@ -0,0 +1,17 @@
+package main
+
+import "fmt"
+
+// Version information stamped at build time
+var (
+	Version   string
+	BuildDate string
+	Name      = "app"
+)
+
+// Revision is annotated, so it needs no mapping
+var Revision string //goxver:hash_long
+
+func main() {
+	fmt.Println(Name, Version, BuildDate, Revision)
+}